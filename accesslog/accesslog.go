@@ -0,0 +1,352 @@
+// Package accesslog writes a line for each request to stdout, a rotating file or syslog, as JSON, logfmt or Combined
+// Log Format.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+// Entry describes one request and how it was handled. Fields which do not apply to the request are left empty.
+type Entry struct {
+	// Message is used as the message when logging to slog, e.g. "Redirect"
+	Message string
+
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Host       string
+	RequestURI string
+	Protocol   string
+	UserAgent  string
+	Referer    string
+
+	Code    int
+	Bytes   int64
+	Latency time.Duration
+
+	Domain            string
+	Rule              string
+	Labels            map[string]string
+	Action            string
+	Destination       string
+	SplitDestination  string
+	Regexp            string
+	RedirectMapSource string
+	RedirectMapLine   int
+	Source            string
+	Limit             string
+	List              string
+	Reason            string
+}
+
+// value returns the value of the named field, as used in json and logfmt output.
+func (e *Entry) value(field string) any {
+	switch field {
+	case "time":
+		return e.Time.Format(time.RFC3339Nano)
+	case "remote_addr":
+		return e.RemoteAddr
+	case "method":
+		return e.Method
+	case "host":
+		return e.Host
+	case "request_uri":
+		return e.RequestURI
+	case "protocol":
+		return e.Protocol
+	case "user_agent":
+		return e.UserAgent
+	case "referer":
+		return e.Referer
+	case "code":
+		return e.Code
+	case "bytes":
+		return e.Bytes
+	case "latency":
+		return e.Latency.Seconds()
+	case "domain":
+		return e.Domain
+	case "rule":
+		return e.Rule
+	case "labels":
+		return e.Labels
+	case "action":
+		return e.Action
+	case "destination":
+		return e.Destination
+	case "split_destination":
+		return e.SplitDestination
+	case "regexp":
+		return e.Regexp
+	case "redirect_map_source":
+		return e.RedirectMapSource
+	case "redirect_map_line":
+		return e.RedirectMapLine
+	case "source":
+		return e.Source
+	case "limit":
+		return e.Limit
+	case "list":
+		return e.List
+	case "reason":
+		return e.Reason
+	default:
+		return nil
+	}
+}
+
+// Logger writes Entries. A Logger created from nil options logs each Entry to slog.Default(), which is how requests
+// were logged before access_log existed.
+type Logger struct {
+	format string
+	fields []string
+
+	mutex  sync.Mutex
+	output io.WriteCloser
+	closed bool
+}
+
+// New creates a Logger according to options, opening its output. If options is nil, the Logger uses slog.
+func New(options *configuration.AccessLog) (*Logger, error) {
+	if options == nil {
+		return &Logger{}, nil
+	}
+
+	logger := &Logger{format: options.Format, fields: options.Fields}
+	if logger.format == "" {
+		logger.format = configuration.AccessLogFormatJSON
+	}
+	if len(logger.fields) == 0 {
+		logger.fields = configuration.DefaultAccessLogFields
+	}
+
+	var err error
+	switch options.Output {
+	case "", configuration.AccessLogOutputStdout:
+		logger.output = nopCloser{os.Stdout}
+	case configuration.AccessLogOutputFile:
+		logger.output, err = openRotatingFile(options.File, options.MaxSize, time.Duration(options.RotateInterval), options.MaxBackups)
+	case configuration.AccessLogOutputSyslog:
+		logger.output, err = openSyslog(options.SyslogNetwork, options.SyslogAddress, options.SyslogTag)
+	default:
+		err = fmt.Errorf("unknown output %s", options.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+// Log writes entry. Errors writing to the output are logged to slog.Default().
+func (l *Logger) Log(entry *Entry) {
+	if l.output == nil {
+		slog.Default().Info(entry.Message, entry.slogAttrs()...)
+		return
+	}
+
+	var line []byte
+	switch l.format {
+	case configuration.AccessLogFormatLogfmt:
+		line = formatLogfmt(entry, l.fields)
+	case configuration.AccessLogFormatCLF:
+		line = formatCLF(entry)
+	default:
+		line = formatJSON(entry, l.fields)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	if _, err := l.output.Write(line); err != nil {
+		slog.Default().Error("Unable to write access log", "error", err)
+	}
+}
+
+// Close closes the Logger's output. Entries logged after Close are lost.
+func (l *Logger) Close() error {
+	if l.output == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	return l.output.Close()
+}
+
+// slogAttrs returns the request attributes, followed by any other fields which are set.
+func (e *Entry) slogAttrs() []any {
+	attrs := []any{
+		"remote_addr", e.RemoteAddr,
+		"method", e.Method,
+		"host", e.Host,
+		"request_uri", e.RequestURI,
+		"user_agent", e.UserAgent,
+		"referer", e.Referer,
+	}
+
+	for _, attr := range []struct {
+		key   string
+		value string
+	}{
+		{"rule_domain", e.Domain},
+		{"rule_index", e.Rule},
+		{"regexp", e.Regexp},
+		{"redirect_map_source", e.RedirectMapSource},
+	} {
+		if attr.value != "" {
+			attrs = append(attrs, attr.key, attr.value)
+		}
+	}
+	if e.RedirectMapLine != 0 {
+		attrs = append(attrs, "redirect_map_line", e.RedirectMapLine)
+	}
+	if len(e.Labels) > 0 {
+		attrs = append(attrs, "labels", e.Labels)
+	}
+	attrs = append(attrs, "code", e.Code)
+
+	for _, attr := range []struct {
+		key   string
+		value string
+	}{
+		{"destination", e.Destination},
+		{"split_destination", e.SplitDestination},
+		{"source", e.Source},
+		{"limit", e.Limit},
+		{"list", e.List},
+		{"reason", e.Reason},
+	} {
+		if attr.value != "" {
+			attrs = append(attrs, attr.key, attr.value)
+		}
+	}
+
+	return append(attrs, "bytes", e.Bytes, "latency", e.Latency)
+}
+
+func formatJSON(entry *Entry, fields []string) []byte {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for index, field := range fields {
+		if index > 0 {
+			line.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		value, _ := json.Marshal(entry.value(field))
+		line.Write(key)
+		line.WriteByte(':')
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+	return line.Bytes()
+}
+
+func formatLogfmt(entry *Entry, fields []string) []byte {
+	var line bytes.Buffer
+	for index, field := range fields {
+		if index > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(field)
+		line.WriteByte('=')
+
+		switch value := entry.value(field).(type) {
+		case string:
+			if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+				line.WriteString(strconv.Quote(value))
+			} else {
+				line.WriteString(value)
+			}
+		case float64:
+			line.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		case map[string]string:
+			// Written as a single quoted value, e.g. labels="team=web,tier=1"
+			names := make([]string, 0, len(value))
+			for name := range value {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for index, name := range names {
+				names[index] = name + "=" + value[name]
+			}
+			line.WriteString(strconv.Quote(strings.Join(names, ",")))
+		default:
+			fmt.Fprint(&line, value)
+		}
+	}
+	line.WriteByte('\n')
+	return line.Bytes()
+}
+
+// formatCLF formats entry in the Combined Log Format used by Apache and nginx:
+//
+//	host - - [02/Jan/2006:15:04:05 -0700] "GET /path HTTP/1.1" 301 0 "referer" "user agent"
+func formatCLF(entry *Entry) []byte {
+	host := entry.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = "-"
+	}
+
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	return []byte(fmt.Sprintf(
+		"%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		host,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(entry.Method),
+		clfEscape(entry.RequestURI),
+		clfEscape(entry.Protocol),
+		entry.Code,
+		size,
+		clfEscape(entry.Referer),
+		clfEscape(entry.UserAgent),
+	))
+}
+
+// clfEscape escapes quotes, backslashes and control characters in the same way as Apache's mod_log_config.
+func clfEscape(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&escaped, "\\x%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+var testEntry = &Entry{
+	Time:        time.Date(2024, time.March, 5, 6, 7, 8, 0, time.UTC),
+	RemoteAddr:  "192.0.2.1:1234",
+	Method:      "GET",
+	Host:        "example.com",
+	RequestURI:  "/path?q=a b",
+	Protocol:    "HTTP/1.1",
+	UserAgent:   `Mozilla/5.0 "quoted"`,
+	Code:        301,
+	Bytes:       57,
+	Latency:     1500 * time.Microsecond,
+	Domain:      "example.com",
+	Rule:        "0",
+	Action:      "redirect",
+	Destination: "https://example.net/path",
+}
+
+func TestFormatJSON(t *testing.T) {
+	expected := `{"time":"2024-03-05T06:07:08Z","code":301,"latency":0.0015,"rule":"0","referer":"","user_agent":"Mozilla/5.0 \"quoted\""}` + "\n"
+	if line := string(formatJSON(testEntry, []string{"time", "code", "latency", "rule", "referer", "user_agent"})); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	expected := `method=GET request_uri="/path?q=a b" bytes=57 latency=0.0015 referer="" user_agent="Mozilla/5.0 \"quoted\""` + "\n"
+	if line := string(formatLogfmt(testEntry, []string{"method", "request_uri", "bytes", "latency", "referer", "user_agent"})); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+}
+
+func TestFormatCLF(t *testing.T) {
+	expected := `192.0.2.1 - - [05/Mar/2024:06:07:08 +0000] "GET /path?q=a b HTTP/1.1" 301 57 "" "Mozilla/5.0 \"quoted\""` + "\n"
+	if line := string(formatCLF(testEntry)); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+
+	empty := &Entry{Time: testEntry.Time, Method: "GET", RequestURI: "/\x01", Protocol: "HTTP/1.1", Code: 421}
+	expected = `- - - [05/Mar/2024:06:07:08 +0000] "GET /\x01 HTTP/1.1" 421 - "" ""` + "\n"
+	if line := string(formatCLF(empty)); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+}
+
+func TestLoggerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := New(&configuration.AccessLog{Format: "logfmt", Fields: []string{"code", "rule"}, Output: "file", File: path})
+	if err != nil {
+		t.Fatalf("Expected no error opening access log, but got %v", err)
+	}
+
+	logger.Log(testEntry)
+	logger.Log(&Entry{Code: 421, Rule: "default"})
+	if err := logger.Close(); err != nil {
+		t.Errorf("Expected no error closing access log, but got %v", err)
+	}
+	logger.Log(testEntry)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error reading access log, but got %v", err)
+	}
+	if expected := "code=301 rule=0\ncode=421 rule=default\n"; string(contents) != expected {
+		t.Errorf("Expected access log to contain %q, but got %q", expected, string(contents))
+	}
+}
+
+func TestNewInvalidOutput(t *testing.T) {
+	if _, err := New(&configuration.AccessLog{Output: "file", File: filepath.Join(t.TempDir(), "missing", "access.log")}); err == nil {
+		t.Errorf("Expected error opening access log in a directory which does not exist, but got none")
+	}
+	if _, err := New(&configuration.AccessLog{Output: "stderr"}); err == nil || !strings.Contains(err.Error(), "stderr") {
+		t.Errorf("Expected error for unknown output, but got %v", err)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	entry := &Entry{Rule: "old-pages", Labels: map[string]string{"team": "web", "owner": "docs team"}}
+
+	expected := `rule=old-pages labels="owner=docs team,team=web"` + "\n"
+	if line := string(formatLogfmt(entry, []string{"rule", "labels"})); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+
+	expected = `{"rule":"old-pages","labels":{"owner":"docs team","team":"web"}}` + "\n"
+	if line := string(formatJSON(entry, []string{"rule", "labels"})); line != expected {
+		t.Errorf("Expected %s, but got %s", expected, line)
+	}
+}
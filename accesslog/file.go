@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatedFileTimeFormat is appended to the name of rotated files. It sorts in time order, and avoids characters which
+// are not allowed in file names on some platforms.
+const rotatedFileTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile appends to a file, which is renamed with a timestamp suffix and replaced by a new file when it would
+// grow beyond maxSize bytes, or has been open for interval. Either limit is ignored if it is zero. Only maxBackups
+// rotated files are kept, unless maxBackups is zero. It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	now        func() time.Time
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		// A previous rotation failed to open the new file, so try again
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	sizeExceeded := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	intervalExceeded := f.interval > 0 && f.now().Sub(f.opened) >= f.interval
+	if sizeExceeded || intervalExceeded {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if err := os.Rename(f.path, f.path+"."+f.now().UTC().Format(rotatedFileTimeFormat)); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	return f.removeOldBackups()
+}
+
+func (f *rotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(globEscape(f.path) + ".*")
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedFileTimeFormat, strings.TrimPrefix(match, f.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// globEscape escapes the characters in path which filepath.Glob would treat as a pattern.
+func globEscape(path string) string {
+	escaped := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '*', '?', '[', '\\':
+			if filepath.Separator != '\\' {
+				escaped = append(escaped, '\\')
+			}
+		}
+		escaped = append(escaped, path[i])
+	}
+	return string(escaped)
+}
@@ -0,0 +1,86 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, time.March, 5, 6, 7, 8, 0, time.UTC)
+
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("Expected no error opening file, but got %v", err)
+	}
+	f.now = func() time.Time { return now }
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		now = now.Add(time.Second)
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Expected no error writing %q, but got %v", line, err)
+		}
+	}
+	f.Close()
+
+	expectFile(t, path, "fourth\n")
+	backups := expectBackups(t, path, 2)
+	expectFile(t, backups[0], "second\n")
+	expectFile(t, backups[1], "third\n")
+}
+
+func TestRotatingFileByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("existing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, time.March, 5, 6, 7, 8, 0, time.UTC)
+	f, err := openRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Expected no error opening file, but got %v", err)
+	}
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	f.Write([]byte("first\n"))
+	now = now.Add(59 * time.Minute)
+	f.Write([]byte("second\n"))
+	now = now.Add(time.Minute)
+	f.Write([]byte("third\n"))
+	f.Close()
+
+	expectFile(t, path, "third\n")
+	backups := expectBackups(t, path, 1)
+	if expected := path + ".2024-03-05T07-07-08.000"; backups[0] != expected {
+		t.Errorf("Expected rotated file to be named %s, but got %s", expected, backups[0])
+	}
+	expectFile(t, backups[0], "existing\nfirst\nsecond\n")
+}
+
+func expectFile(t *testing.T, path string, expected string) {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error reading %s, but got %v", path, err)
+	}
+	if string(contents) != expected {
+		t.Errorf("Expected %s to contain %q, but got %q", path, expected, string(contents))
+	}
+}
+
+func expectBackups(t *testing.T, path string, count int) []string {
+	t.Helper()
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != count {
+		t.Fatalf("Expected %d rotated files, but got %d: %v", count, len(backups), backups)
+	}
+	sort.Strings(backups)
+	return backups
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the syslog daemon at address over network, or the local daemon if network is empty.
+func openSyslog(network string, address string, tag string) (io.WriteCloser, error) {
+	if tag == "" {
+		tag = "redirector"
+	}
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,280 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+// requestError is returned from a change function to reject a request with a particular status code.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func notFound(format string, a ...any) error {
+	return &requestError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func badRequest(format string, a ...any) error {
+	return &requestError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+// MakeHandler returns a handler for the admin API, which reads and changes the config in store. Every request must
+// include the admin_token from the current config as a bearer token.
+//
+// The API is:
+//
+//	GET    /default_response
+//	PUT    /default_response
+//	GET    /domains
+//	GET    /domains/{domain}
+//	GET    /domains/{domain}/default_response
+//	PUT    /domains/{domain}/default_response
+//	DELETE /domains/{domain}/default_response
+//	GET    /domains/{domain}/rules
+//	POST   /domains/{domain}/rules[?index={index}]
+//	GET    /domains/{domain}/rules/{index}
+//	PUT    /domains/{domain}/rules/{index}
+//	DELETE /domains/{domain}/rules/{index}
+//
+// Changes are validated in the same way as the config file, and only take effect if there are no problems.
+func MakeHandler(store *configuration.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := store.Current()
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="redirector"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(segments) == 1 && segments[0] == "default_response":
+			handleDefaultResponse(w, r, store, config)
+		case len(segments) == 1 && segments[0] == "domains":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+			} else {
+				writeJSON(w, http.StatusOK, config.Domains)
+			}
+		case len(segments) == 2 && segments[0] == "domains":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+			} else if domain, ok := config.Domains[segments[1]]; ok {
+				writeJSON(w, http.StatusOK, domain)
+			} else {
+				writeError(w, notFound("Domain %s not found", segments[1]))
+			}
+		case len(segments) == 3 && segments[0] == "domains" && segments[2] == "default_response":
+			handleDomainDefaultResponse(w, r, store, config, segments[1])
+		case len(segments) == 3 && segments[0] == "domains" && segments[2] == "rules":
+			handleRules(w, r, store, config, segments[1])
+		case len(segments) == 4 && segments[0] == "domains" && segments[2] == "rules":
+			handleRule(w, r, store, config, segments[1], segments[3])
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	}
+}
+
+func handleDefaultResponse(w http.ResponseWriter, r *http.Request, store *configuration.Store, config *configuration.Config) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, config.DefaultResponse)
+	case http.MethodPut:
+		defaultResponse := &configuration.DefaultResponse{}
+		if !readJSON(w, r, defaultResponse) {
+			return
+		}
+		update(w, r, store, http.StatusOK, defaultResponse, func(config *configuration.Config) error {
+			config.DefaultResponse = defaultResponse
+			return nil
+		})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+func handleDomainDefaultResponse(w http.ResponseWriter, r *http.Request, store *configuration.Store, config *configuration.Config, origin string) {
+	switch r.Method {
+	case http.MethodGet:
+		if domain, ok := config.Domains[origin]; !ok {
+			writeError(w, notFound("Domain %s not found", origin))
+		} else if domain.DefaultResponse == nil {
+			writeError(w, notFound("Domain %s has no default response", origin))
+		} else {
+			writeJSON(w, http.StatusOK, domain.DefaultResponse)
+		}
+	case http.MethodPut, http.MethodDelete:
+		var defaultResponse *configuration.DefaultResponse
+		if r.Method == http.MethodPut {
+			defaultResponse = &configuration.DefaultResponse{}
+			if !readJSON(w, r, defaultResponse) {
+				return
+			}
+		}
+		update(w, r, store, http.StatusOK, defaultResponse, func(config *configuration.Config) error {
+			domain, ok := config.Domains[origin]
+			if !ok {
+				return notFound("Domain %s not found", origin)
+			}
+			domain.DefaultResponse = defaultResponse
+			config.Domains[origin] = domain
+			return nil
+		})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func handleRules(w http.ResponseWriter, r *http.Request, store *configuration.Store, config *configuration.Config, origin string) {
+	switch r.Method {
+	case http.MethodGet:
+		if domain, ok := config.Domains[origin]; ok {
+			writeJSON(w, http.StatusOK, domain.RewriteRules)
+		} else {
+			writeError(w, notFound("Domain %s not found", origin))
+		}
+	case http.MethodPost:
+		rule := configuration.Rule{}
+		if !readJSON(w, r, &rule) {
+			return
+		}
+		update(w, r, store, http.StatusCreated, rule, func(config *configuration.Config) error {
+			domain, ok := config.Domains[origin]
+			if !ok {
+				return notFound("Domain %s not found", origin)
+			}
+
+			index := len(domain.RewriteRules)
+			if r.URL.Query().Has("index") {
+				var err error
+				if index, err = strconv.Atoi(r.URL.Query().Get("index")); err != nil || index < 0 || index > len(domain.RewriteRules) {
+					return badRequest("Invalid index %s: must be between 0 and %d inclusive", r.URL.Query().Get("index"), len(domain.RewriteRules))
+				}
+			}
+
+			domain.RewriteRules = append(domain.RewriteRules[:index], append([]configuration.Rule{rule}, domain.RewriteRules[index:]...)...)
+			config.Domains[origin] = domain
+			return nil
+		})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func handleRule(w http.ResponseWriter, r *http.Request, store *configuration.Store, config *configuration.Config, origin string, indexSegment string) {
+	index, err := strconv.Atoi(indexSegment)
+	if err != nil {
+		writeError(w, notFound("Rule %s not found", indexSegment))
+		return
+	}
+
+	// findRule is used against whichever config is being read or changed
+	findRule := func(config *configuration.Config) (configuration.Domain, error) {
+		domain, ok := config.Domains[origin]
+		if !ok {
+			return domain, notFound("Domain %s not found", origin)
+		}
+		if index < 0 || index >= len(domain.RewriteRules) {
+			return domain, notFound("Rule %d not found for domain %s", index, origin)
+		}
+		return domain, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if domain, err := findRule(config); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, http.StatusOK, domain.RewriteRules[index])
+		}
+	case http.MethodPut:
+		rule := configuration.Rule{}
+		if !readJSON(w, r, &rule) {
+			return
+		}
+		update(w, r, store, http.StatusOK, rule, func(config *configuration.Config) error {
+			domain, err := findRule(config)
+			if err != nil {
+				return err
+			}
+			domain.RewriteRules[index] = rule
+			return nil
+		})
+	case http.MethodDelete:
+		update(w, r, store, http.StatusOK, nil, func(config *configuration.Config) error {
+			domain, err := findRule(config)
+			if err != nil {
+				return err
+			}
+			domain.RewriteRules = append(domain.RewriteRules[:index], domain.RewriteRules[index+1:]...)
+			config.Domains[origin] = domain
+			return nil
+		})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// update applies change to the config in store and, if successful, responds with status and result.
+func update(w http.ResponseWriter, r *http.Request, store *configuration.Store, status int, result any, change func(config *configuration.Config) error) {
+	problems, err := store.Update(change, store.Current().AdminWriteConfig)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string][]string{"problems": problems})
+		return
+	}
+
+	slog.Default().Info("Config changed through admin API", "method", r.Method, "path", r.URL.Path, "remote_addr", store.Current().LogPrivacy.ClientAddr(r.RemoteAddr))
+	writeJSON(w, status, result)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, badRequest("Error parsing request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var requestErr *requestError
+	if errors.As(err, &requestErr) {
+		writeJSON(w, requestErr.status, map[string]string{"error": requestErr.message})
+	} else {
+		slog.Default().Error("Error in admin API", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
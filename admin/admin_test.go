@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+const testToken = "test-token"
+
+const testConfig = `{
+	"listen_address": ":8080",
+	"admin_address": ":8081",
+	"admin_token": "test-token",
+	"default_response": {"code": 421},
+	"domains": {
+		"example.com": {
+			"rewrites": [
+				{
+					"regexp": "^/a(.*)$",
+					"replacement": "https://a.example.com$1",
+					"code": 301
+				}
+			]
+		}
+	}
+}`
+
+func makeStore(t *testing.T, config string) *configuration.Store {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	store := configuration.NewStore(path)
+	if problems := store.Reload(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	return store
+}
+
+func request(store *configuration.Store, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rr := httptest.NewRecorder()
+	MakeHandler(store)(rr, req)
+	return rr
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	store := makeStore(t, testConfig)
+
+	for _, authorization := range []string{"", "Bearer wrong-token", "Basic dGVzdC10b2tlbg==", testToken} {
+		req := httptest.NewRequest(http.MethodGet, "/domains", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		MakeHandler(store)(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code %d with Authorization '%s', but got %d", http.StatusUnauthorized, authorization, rr.Code)
+		}
+	}
+
+	if rr := request(store, http.MethodGet, "/domains", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d with correct token, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestAdminListDomainsAndRules(t *testing.T) {
+	store := makeStore(t, testConfig)
+
+	rr := request(store, http.MethodGet, "/domains", "")
+	var domains map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &domains); err != nil || len(domains) != 1 {
+		t.Errorf("Expected one domain, but got %s (error: %v)", rr.Body, err)
+	}
+
+	rr = request(store, http.MethodGet, "/domains/example.com/rules/0", "")
+	var rule map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &rule); err != nil || rule["regexp"] != "^/a(.*)$" {
+		t.Errorf("Expected rule with regexp '^/a(.*)$', but got %s (error: %v)", rr.Body, err)
+	}
+
+	if rr := request(store, http.MethodGet, "/domains/example.net/rules", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for unknown domain, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if rr := request(store, http.MethodGet, "/domains/example.com/rules/1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for unknown rule, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if rr := request(store, http.MethodPost, "/domains", "{}"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, but got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
+
+func TestAdminChangeRules(t *testing.T) {
+	store := makeStore(t, testConfig)
+	original := store.Current()
+
+	rr := request(store, http.MethodPost, "/domains/example.com/rules?index=0", `{"regexp": "^/b(.*)$", "replacement": "https://b.example.com$1", "code": 302}`)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+
+	rules := store.Current().Domains["example.com"].RewriteRules
+	if len(rules) != 2 || rules[0].Replacement != "https://b.example.com$1" || rules[1].Replacement != "https://a.example.com$1" {
+		t.Errorf("Expected new rule to be inserted at index 0, but got %v", rules)
+	}
+	if len(original.Domains["example.com"].RewriteRules) != 1 {
+		t.Errorf("Expected original config to be unchanged, but got %v", original.Domains["example.com"].RewriteRules)
+	}
+
+	rr = request(store, http.MethodPut, "/domains/example.com/rules/1", `{"regexp": "^/c(.*)$", "replacement": "https://c.example.com$1", "code": 307}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rule := store.Current().Domains["example.com"].RewriteRules[1]; rule.Code != 307 || rule.Regexp.String() != "^/c(.*)$" {
+		t.Errorf("Expected rule at index 1 to be replaced, but got %v", rule)
+	}
+
+	rr = request(store, http.MethodDelete, "/domains/example.com/rules/0", "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rules := store.Current().Domains["example.com"].RewriteRules; len(rules) != 1 || rules[0].Code != 307 {
+		t.Errorf("Expected only the replaced rule to remain, but got %v", rules)
+	}
+
+	if _, domain, ok := store.Current().MatchDomain("example.com"); !ok || len(domain.RewriteRules) != 1 {
+		t.Errorf("Expected host index to reflect changed config, but got %v (ok = %t)", domain, ok)
+	}
+}
+
+func TestAdminRejectsInvalidChanges(t *testing.T) {
+	store := makeStore(t, testConfig)
+	original := store.Current()
+
+	rr := request(store, http.MethodPost, "/domains/example.com/rules", `{"regexp": "^/b(.*)$", "replacement": "https://b.example.com$2", "code": 200}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status code %d, but got %d: %s", http.StatusUnprocessableEntity, rr.Code, rr.Body)
+	}
+
+	var response map[string][]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || len(response["problems"]) != 2 {
+		t.Errorf("Expected 2 problems (invalid code, invalid replacement group), but got %s (error: %v)", rr.Body, err)
+	}
+
+	if rr := request(store, http.MethodPost, "/domains/example.com/rules", `{"regexp": "(unterminated"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for invalid regexp, but got %d: %s", http.StatusBadRequest, rr.Code, rr.Body)
+	}
+
+	if rr := request(store, http.MethodPost, "/domains/example.com/rules?index=5", `{"regexp": "^/b(.*)$", "replacement": "https://b.example.com$1", "code": 302}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for invalid index, but got %d: %s", http.StatusBadRequest, rr.Code, rr.Body)
+	}
+
+	if store.Current() != original {
+		t.Errorf("Expected config to be unchanged after invalid requests")
+	}
+}
+
+func TestAdminChangeDefaultResponses(t *testing.T) {
+	store := makeStore(t, testConfig)
+
+	rr := request(store, http.MethodPut, "/default_response", `{"code": 404, "body": "Not found\n"}`)
+	if rr.Code != http.StatusOK || store.Current().DefaultResponse.Code != 404 {
+		t.Errorf("Expected default response to be changed, but got status %d and %v", rr.Code, store.Current().DefaultResponse)
+	}
+
+	rr = request(store, http.MethodPut, "/domains/example.com/default_response", `{"code": 410}`)
+	if rr.Code != http.StatusOK || store.Current().Domains["example.com"].DefaultResponse.Code != 410 {
+		t.Errorf("Expected domain default response to be changed, but got status %d and %v", rr.Code, store.Current().Domains["example.com"].DefaultResponse)
+	}
+
+	if rr := request(store, http.MethodGet, "/domains/example.com/default_response", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	rr = request(store, http.MethodDelete, "/domains/example.com/default_response", "")
+	if rr.Code != http.StatusOK || store.Current().Domains["example.com"].DefaultResponse != nil {
+		t.Errorf("Expected domain default response to be removed, but got status %d and %v", rr.Code, store.Current().Domains["example.com"].DefaultResponse)
+	}
+}
+
+func TestAdminWriteConfig(t *testing.T) {
+	config := strings.Replace(testConfig, `"admin_token": "test-token",`, `"admin_token": "test-token", "admin_write_config": true,`, 1)
+	store := makeStore(t, config)
+
+	rr := request(store, http.MethodPut, "/domains/example.com/rules/0", `{"regexp": "^/z(.*)$", "replacement": "https://z.example.com$1", "code": 308}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	// Reloading from the file should give the same result
+	reloaded := configuration.NewStore(store.Path())
+	if problems := reloaded.Reload(); len(problems) != 0 {
+		t.Fatalf("Expected no problems reloading written config, but got %d problems: %v", len(problems), problems)
+	}
+	if rule := reloaded.Current().Domains["example.com"].RewriteRules[0]; rule.Code != 308 || rule.Regexp.String() != "^/z(.*)$" {
+		t.Errorf("Expected changed rule to be written to config file, but got %v", rule)
+	}
+}
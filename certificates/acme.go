@@ -0,0 +1,510 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+const (
+	// acmeAccountKeyName is the cache key for the account key, which is shared with autocert.Manager
+	acmeAccountKeyName = "acme_account+key"
+	// acmeObtainTimeout is the maximum time to spend obtaining a single certificate
+	acmeObtainTimeout = 5 * time.Minute
+	// acmeDefaultRenewBefore matches the default used by autocert.Manager
+	acmeDefaultRenewBefore = 30 * 24 * time.Hour
+)
+
+// acmeManager obtains certificates over ACME. Certificates for each domain's name are obtained on demand by
+// autocert.Manager, using HTTP-01 or TLS-ALPN-01 challenges. For domains with match_subdomains, wildcard certificates
+// are obtained using DNS-01.
+type acmeManager struct {
+	options       *configuration.ACME
+	currentConfig func() *configuration.Config
+	client        *acme.Client
+	cache         autocert.Cache
+	autocert      *autocert.Manager
+	renewBefore   time.Duration
+
+	registerMutex sync.Mutex
+	registered    bool
+
+	wildcardsMutex sync.Mutex
+	wildcards      map[string]*wildcardCertificate
+}
+
+type wildcardCertificate struct {
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	renewing    bool
+}
+
+// EnableACME configures m to obtain certificates over ACME for domains which do not have certificate files.
+// It must be called before m is used.
+func (m *Manager) EnableACME(options *configuration.ACME) error {
+	httpClient := http.DefaultClient
+	if options.CARootFile != "" {
+		caRoot, err := os.ReadFile(options.CARootFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caRoot) {
+			return fmt.Errorf("no certificates found in %s", options.CARootFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	directoryURL := options.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+
+	renewBefore := time.Duration(options.RenewBefore)
+	if renewBefore == 0 {
+		renewBefore = acmeDefaultRenewBefore
+	}
+
+	cache := autocert.DirCache(options.CacheDir)
+	accountKey, err := loadOrCreateAccountKey(context.Background(), cache)
+	if err != nil {
+		return err
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: directoryURL,
+		HTTPClient:   httpClient,
+		UserAgent:    "redirector",
+	}
+
+	a := &acmeManager{
+		options:       options,
+		currentConfig: m.currentConfig,
+		client:        client,
+		cache:         cache,
+		renewBefore:   renewBefore,
+		wildcards:     map[string]*wildcardCertificate{},
+	}
+	a.autocert = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       cache,
+		HostPolicy:  a.hostPolicy,
+		RenewBefore: renewBefore,
+		Client:      client,
+		Email:       options.Email,
+	}
+
+	m.acme = a
+	return nil
+}
+
+// HTTPHandler returns a handler which responds to ACME HTTP-01 challenges, and passes all other requests to fallback.
+// If ACME is not enabled, fallback is returned unchanged.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	if m.acme == nil {
+		return fallback
+	}
+	return m.acme.autocert.HTTPHandler(fallback)
+}
+
+// TLSConfig returns a tls.Config which uses m to choose certificates.
+func (m *Manager) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{GetCertificate: m.GetCertificate}
+	if m.acme != nil {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return tlsConfig
+}
+
+// PrefetchACME obtains a certificate over ACME for every configured domain which would use one, so that the first
+// connection for each domain does not have to wait. Errors are logged rather than returned.
+func (m *Manager) PrefetchACME() {
+	if m.acme == nil {
+		return
+	}
+
+	config := m.currentConfig()
+	for origin, domain := range config.Domains {
+		if !m.usesACME(config, origin, domain) {
+			continue
+		}
+
+		names := []string{hostname(origin)}
+		if domain.MatchSubdomains && m.acme.dns01Enabled() {
+			// Any subdomain will do, since it gets us the wildcard certificate
+			names = append(names, "_prefetch."+hostname(origin))
+		}
+
+		for _, name := range names {
+			if _, err := m.acme.getCertificate(&tls.ClientHelloInfo{ServerName: name}, origin, domain); err != nil {
+				slog.Default().Error("Unable to obtain certificate over ACME", "domain", origin, "server_name", name, "error", err)
+			}
+		}
+	}
+}
+
+// usesACME returns true if certificates for origin should be obtained over ACME, which is the case if ACME is
+// enabled and not disabled for this domain, and there is no certificate on disk.
+func (m *Manager) usesACME(config *configuration.Config, origin string, domain configuration.Domain) bool {
+	if m.acme == nil || domain.DisableACME || domain.TLSCertificate != nil {
+		return false
+	}
+
+	if certFile, _, ok := config.CertificateFiles(origin, domain); ok {
+		if _, err := os.Stat(certFile); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isACMEChallenge returns true if hello is from an ACME server performing a TLS-ALPN-01 challenge.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+func (a *acmeManager) dns01Enabled() bool {
+	return len(a.options.DNS01PresentCommand) > 0
+}
+
+// getCertificate returns a certificate for hello, which has already been matched to origin and domain. Certificates
+// are only obtained for the domain's own name and, for domains with match_subdomains, the wildcard obtained with
+// DNS-01. Other names are refused, so that clients cannot have a certificate ordered for every name they make up.
+func (a *acmeManager) getCertificate(hello *tls.ClientHelloInfo, origin string, domain configuration.Domain) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	base := hostname(origin)
+
+	if name == base {
+		return a.autocert.GetCertificate(hello)
+	}
+
+	// A wildcard certificate only covers one level of subdomain
+	if domain.MatchSubdomains && a.dns01Enabled() {
+		if _, parent, found := strings.Cut(name, "."); found && parent == base {
+			return a.wildcardCertificate(base)
+		}
+	}
+
+	return nil, fmt.Errorf("acme: no certificate is obtained for %q under domain %s", name, origin)
+}
+
+// hostPolicy allows autocert to obtain certificates only for the names of configured domains, and not for their
+// subdomains. Domains which include a port are matched on their name alone, because server names never include a
+// port.
+func (a *acmeManager) hostPolicy(_ context.Context, host string) error {
+	for origin, domain := range a.currentConfig().Domains {
+		if !domain.DisableACME && hostname(origin) == host {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("acme: host %q is not configured", host)
+}
+
+// wildcardCertificate returns a certificate for "*." + name, obtaining it over ACME using DNS-01 if there is not one
+// in the cache. If the certificate is due for renewal, renewal is started in the background and the existing
+// certificate is returned.
+func (a *acmeManager) wildcardCertificate(name string) (*tls.Certificate, error) {
+	a.wildcardsMutex.Lock()
+	entry := a.wildcards[name]
+	if entry == nil {
+		entry = &wildcardCertificate{}
+		a.wildcards[name] = entry
+	}
+	a.wildcardsMutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+	defer cancel()
+
+	if entry.certificate == nil {
+		if certificate, err := a.loadCachedWildcard(ctx, name); err == nil {
+			entry.certificate = certificate
+		} else if !errors.Is(err, autocert.ErrCacheMiss) {
+			slog.Default().Warn("Unable to load cached wildcard certificate", "name", "*."+name, "error", err)
+		}
+	}
+
+	if entry.certificate == nil {
+		certificate, err := a.obtainWildcard(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		entry.certificate = certificate
+	}
+
+	if time.Until(entry.certificate.Leaf.NotAfter) < a.renewBefore && !entry.renewing {
+		entry.renewing = true
+		go a.renewWildcard(name, entry)
+	}
+
+	return entry.certificate, nil
+}
+
+func (a *acmeManager) renewWildcard(name string, entry *wildcardCertificate) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+	defer cancel()
+
+	certificate, err := a.obtainWildcard(ctx, name)
+	if err != nil {
+		slog.Default().Error("Unable to renew wildcard certificate", "name", "*."+name, "error", err)
+	} else {
+		slog.Default().Info("Renewed wildcard certificate", "name", "*."+name, "not_after", certificate.Leaf.NotAfter)
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	entry.renewing = false
+	if err == nil {
+		entry.certificate = certificate
+	}
+}
+
+// obtainWildcard obtains a certificate for "*." + name using the DNS-01 challenge, and stores it in the cache.
+func (a *acmeManager) obtainWildcard(ctx context.Context, name string) (*tls.Certificate, error) {
+	if err := a.register(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs("*."+name))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authorizationURL := range order.AuthzURLs {
+		authorization, err := a.client.GetAuthorization(ctx, authorizationURL)
+		if err != nil {
+			return nil, err
+		}
+		if authorization.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authorization.Challenges {
+			if c.Type == "dns-01" {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, fmt.Errorf("acme: no dns-01 challenge offered for %s", authorization.Identifier.Value)
+		}
+
+		value, err := a.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		domain := authorization.Identifier.Value
+		if err := runDNS01Command(ctx, a.options.DNS01PresentCommand, domain, value); err != nil {
+			return nil, err
+		}
+		defer func() {
+			// The context may have expired, but we still want to clean up
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := runDNS01Command(cleanupCtx, a.options.DNS01CleanupCommand, domain, value); err != nil {
+				slog.Default().Warn("Unable to clean up DNS-01 challenge record", "domain", domain, "error", err)
+			}
+		}()
+
+		if _, err := a.client.Accept(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if _, err := a.client.WaitAuthorization(ctx, authorization.URI); err != nil {
+			return nil, err
+		}
+	}
+
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"*." + name}}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := makeCertificate(key, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded, err := encodeCertificate(key, chain); err != nil {
+		slog.Default().Warn("Unable to encode wildcard certificate for cache", "name", "*."+name, "error", err)
+	} else if err := a.cache.Put(ctx, wildcardCacheKey(name), encoded); err != nil {
+		slog.Default().Warn("Unable to cache wildcard certificate", "name", "*."+name, "error", err)
+	}
+
+	return certificate, nil
+}
+
+func (a *acmeManager) register(ctx context.Context) error {
+	a.registerMutex.Lock()
+	defer a.registerMutex.Unlock()
+
+	if a.registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if a.options.Email != "" {
+		account.Contact = []string{"mailto:" + a.options.Email}
+	}
+
+	_, err := a.client.Register(ctx, account, acme.AcceptTOS)
+	var acmeError *acme.Error
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) && !(errors.As(err, &acmeError) && acmeError.StatusCode == http.StatusConflict) {
+		return err
+	}
+
+	a.registered = true
+	return nil
+}
+
+func (a *acmeManager) loadCachedWildcard(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := a.cache.Get(ctx, wildcardCacheKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	var chain [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			chain = append(chain, block.Bytes)
+		}
+	}
+
+	if key == nil || len(chain) == 0 {
+		return nil, fmt.Errorf("acme: cached certificate for *.%s is incomplete", name)
+	}
+
+	return makeCertificate(key, chain)
+}
+
+func wildcardCacheKey(name string) string {
+	return "wildcard+" + name
+}
+
+func makeCertificate(key crypto.Signer, chain [][]byte) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func encodeCertificate(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return nil, err
+	}
+
+	for _, certificate := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certificate}); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// loadOrCreateAccountKey uses the same cache key and format as autocert.Manager, so the account is shared.
+func loadOrCreateAccountKey(ctx context.Context, cache autocert.Cache) (crypto.Signer, error) {
+	data, err := cache.Get(ctx, acmeAccountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("acme: invalid account key in cache")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Put(ctx, acmeAccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// runDNS01Command runs a DNS-01 hook command. The domain being validated, the name of the TXT record and the value
+// it must contain are passed in the ACME_DOMAIN, ACME_RECORD_NAME and ACME_RECORD_VALUE environment variables.
+func runDNS01Command(ctx context.Context, command []string, domain string, value string) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(
+		os.Environ(),
+		"ACME_DOMAIN="+domain,
+		"ACME_RECORD_NAME=_acme-challenge."+domain,
+		"ACME_RECORD_VALUE="+value,
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("acme: DNS-01 command %v failed: %w (output: %q)", command, err, output)
+	}
+	return nil
+}
+
+// hostname returns origin without any port.
+func hostname(origin string) string {
+	if name, _, err := net.SplitHostPort(origin); err == nil {
+		return name
+	}
+	return origin
+}
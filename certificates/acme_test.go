@@ -0,0 +1,242 @@
+package certificates
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+func TestACMEHostPolicy(t *testing.T) {
+	config := &configuration.Config{
+		Domains: map[string]configuration.Domain{
+			"example.com":      {MatchSubdomains: true},
+			"example.net":      {},
+			"example.org:8443": {MatchSubdomains: true},
+			"internal.example": {DisableACME: true},
+		},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+	if err := manager.EnableACME(&configuration.ACME{CacheDir: t.TempDir(), AcceptTOS: true}); err != nil {
+		t.Fatalf("Unable to enable ACME: %v", err)
+	}
+
+	testCases := []struct {
+		host    string
+		allowed bool
+	}{
+		{"example.com", true},
+		{"www.example.com", false},
+		{"example.net", true},
+		{"www.example.net", false},
+		{"example.org", true},
+		{"www.example.org", false},
+		{"internal.example", false},
+		{"example.invalid", false},
+	}
+
+	for _, testCase := range testCases {
+		if err := manager.acme.hostPolicy(context.Background(), testCase.host); (err == nil) != testCase.allowed {
+			t.Errorf("Expected host policy for '%s' to allow = %t, but got error: %v", testCase.host, testCase.allowed, err)
+		}
+	}
+}
+
+func TestACMEGetCertificateRefusesSubdomains(t *testing.T) {
+	config := &configuration.Config{
+		Domains: map[string]configuration.Domain{
+			"example.com": {MatchSubdomains: true},
+		},
+	}
+
+	testCases := []struct {
+		acme       *configuration.ACME
+		serverName string
+	}{
+		{&configuration.ACME{CacheDir: t.TempDir(), AcceptTOS: true}, "www.example.com"},
+		{&configuration.ACME{CacheDir: t.TempDir(), AcceptTOS: true, DNS01PresentCommand: []string{"true"}, DNS01CleanupCommand: []string{"true"}}, "a.b.example.com"},
+	}
+
+	for _, testCase := range testCases {
+		manager := NewManager(func() *configuration.Config { return config })
+		if err := manager.EnableACME(testCase.acme); err != nil {
+			t.Fatalf("Unable to enable ACME: %v", err)
+		}
+
+		certificate, err := manager.acme.getCertificate(&tls.ClientHelloInfo{ServerName: testCase.serverName}, "example.com", config.Domains["example.com"])
+		if err == nil || certificate != nil {
+			t.Errorf("Expected no certificate to be obtained for %s (DNS-01: %t), but got %v, %v", testCase.serverName, manager.acme.dns01Enabled(), certificate, err)
+		}
+	}
+}
+
+func TestACMEAccountKeyIsReused(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+
+	first, err := loadOrCreateAccountKey(context.Background(), cache)
+	if err != nil {
+		t.Fatalf("Unable to create account key: %v", err)
+	}
+
+	second, err := loadOrCreateAccountKey(context.Background(), cache)
+	if err != nil {
+		t.Fatalf("Unable to load account key: %v", err)
+	}
+
+	if !first.(*ecdsa.PrivateKey).Equal(second) {
+		t.Errorf("Expected account key to be loaded from cache, but a different key was returned")
+	}
+}
+
+func TestACMEWildcardFromCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	config := &configuration.Config{
+		Domains: map[string]configuration.Domain{
+			"example.com": {MatchSubdomains: true},
+		},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+	err := manager.EnableACME(&configuration.ACME{
+		CacheDir:            cacheDir,
+		AcceptTOS:           true,
+		DNS01PresentCommand: []string{"false"},
+		DNS01CleanupCommand: []string{"false"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to enable ACME: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.example.com"},
+		DNSNames:     []string{"*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	encoded, err := encodeCertificate(key, [][]byte{der})
+	if err != nil {
+		t.Fatalf("Unable to encode certificate: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, wildcardCacheKey("example.com")), encoded, 0o600); err != nil {
+		t.Fatalf("Unable to write cached certificate: %v", err)
+	}
+
+	// The DNS-01 commands always fail, so this only succeeds if the cached certificate is used
+	certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if err != nil {
+		t.Fatalf("Expected cached wildcard certificate, but got error: %v", err)
+	}
+	if commonName(certificate) != "*.example.com" {
+		t.Errorf("Expected certificate with common name '*.example.com', but got '%s'", commonName(certificate))
+	}
+}
+
+func TestACMEPrefersCertificateFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, filepath.Join(dir, "example.com.crt"), filepath.Join(dir, "example.com.key"), "from disk")
+
+	config := &configuration.Config{
+		TLSCertificateDir: dir,
+		Domains: map[string]configuration.Domain{
+			"example.com": {},
+			"example.net": {},
+		},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+	if err := manager.EnableACME(&configuration.ACME{CacheDir: t.TempDir(), AcceptTOS: true}); err != nil {
+		t.Fatalf("Unable to enable ACME: %v", err)
+	}
+
+	if manager.usesACME(config, "example.com", config.Domains["example.com"]) {
+		t.Errorf("Expected example.com to use the certificate in tls_certificate_dir, not ACME")
+	}
+	if !manager.usesACME(config, "example.net", config.Domains["example.net"]) {
+		t.Errorf("Expected example.net to use ACME because there is no certificate in tls_certificate_dir")
+	}
+
+	if certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err != nil || commonName(certificate) != "from disk" {
+		t.Errorf("Expected certificate from disk, but got %v (error: %v)", certificate, err)
+	}
+
+	if tlsConfig := manager.TLSConfig(); len(tlsConfig.NextProtos) == 0 || tlsConfig.NextProtos[len(tlsConfig.NextProtos)-1] != acme.ALPNProto {
+		t.Errorf("Expected TLS config to support the ACME TLS-ALPN-01 protocol, but got %v", tlsConfig.NextProtos)
+	}
+}
+
+func TestRunDNS01Command(t *testing.T) {
+	command := []string{"sh", "-c", `test "$ACME_DOMAIN" = example.com && test "$ACME_RECORD_NAME" = _acme-challenge.example.com && test "$ACME_RECORD_VALUE" = value`}
+	if err := runDNS01Command(context.Background(), command, "example.com", "value"); err != nil {
+		t.Errorf("Expected DNS-01 command to succeed, but got error: %v", err)
+	}
+
+	if err := runDNS01Command(context.Background(), []string{"false"}, "example.com", "value"); err == nil {
+		t.Errorf("Expected error from failing DNS-01 command, but got none")
+	}
+}
+
+// TestACMEPebble obtains real certificates from a Pebble test CA (https://github.com/letsencrypt/pebble).
+// It is skipped unless REDIRECTOR_TEST_ACME_DIRECTORY is set to Pebble's directory URL (e.g.
+// https://localhost:14000/dir) and REDIRECTOR_TEST_ACME_CA_ROOT is set to the path of Pebble's minica.pem.
+// Pebble must be run with PEBBLE_VA_ALWAYS_VALID=1 so it does not need to connect back to this test.
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("REDIRECTOR_TEST_ACME_DIRECTORY")
+	caRoot := os.Getenv("REDIRECTOR_TEST_ACME_CA_ROOT")
+	if directoryURL == "" || caRoot == "" {
+		t.Skip("REDIRECTOR_TEST_ACME_DIRECTORY and REDIRECTOR_TEST_ACME_CA_ROOT not set")
+	}
+
+	config := &configuration.Config{
+		Domains: map[string]configuration.Domain{
+			"redirector.example": {MatchSubdomains: true},
+		},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+	err := manager.EnableACME(&configuration.ACME{
+		DirectoryURL:        directoryURL,
+		CARootFile:          caRoot,
+		CacheDir:            t.TempDir(),
+		AcceptTOS:           true,
+		DNS01PresentCommand: []string{"true"},
+		DNS01CleanupCommand: []string{"true"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to enable ACME: %v", err)
+	}
+
+	certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "redirector.example"})
+	if err != nil {
+		t.Fatalf("Expected certificate for redirector.example, but got error: %v", err)
+	}
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err != nil || leaf.VerifyHostname("redirector.example") != nil {
+		t.Errorf("Expected certificate to be valid for redirector.example, but got %v (error: %v)", leaf, err)
+	}
+
+	certificate, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.redirector.example"})
+	if err != nil {
+		t.Fatalf("Expected wildcard certificate for www.redirector.example, but got error: %v", err)
+	}
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err != nil || leaf.VerifyHostname("anything.redirector.example") != nil {
+		t.Errorf("Expected wildcard certificate for *.redirector.example, but got %v (error: %v)", leaf, err)
+	}
+}
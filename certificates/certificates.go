@@ -0,0 +1,143 @@
+package certificates
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+// DefaultCheckInterval is how often certificate files are checked for changes.
+const DefaultCheckInterval = 10 * time.Second
+
+// Manager chooses a certificate for each TLS connection based on the server name sent by the client (SNI), using
+// the same domain matching as the HTTP handler. Certificates are loaded from disk when first needed, and reloaded
+// if their files change. If EnableACME() has been called, certificates for domains without files on disk are
+// obtained over ACME instead.
+type Manager struct {
+	currentConfig func() *configuration.Config
+	// CheckInterval is the minimum time between checks of whether a loaded certificate's files have changed
+	CheckInterval time.Duration
+
+	mutex  sync.Mutex
+	loaded map[keyPair]*loadedCertificate
+
+	// acme is set by EnableACME()
+	acme *acmeManager
+}
+
+type keyPair struct {
+	certFile string
+	keyFile  string
+}
+
+type loadedCertificate struct {
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastChecked time.Time
+}
+
+// NewManager creates a Manager which chooses certificates according to the config returned by currentConfig,
+// which is called for every new connection.
+func NewManager(currentConfig func() *configuration.Config) *Manager {
+	return &Manager{
+		currentConfig: currentConfig,
+		CheckInterval: DefaultCheckInterval,
+		loaded:        map[keyPair]*loadedCertificate{},
+	}
+}
+
+// GetCertificate is suitable for use as tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.acme != nil && isACMEChallenge(hello) {
+		return m.acme.autocert.GetCertificate(hello)
+	}
+
+	config := m.currentConfig()
+
+	origin, domain, ok := matchServerName(config, hello)
+	if !ok {
+		return nil, fmt.Errorf("no domain configured for server name %q", hello.ServerName)
+	}
+
+	if m.usesACME(config, origin, domain) {
+		return m.acme.getCertificate(hello, origin, domain)
+	}
+
+	certFile, keyFile, ok := config.CertificateFiles(origin, domain)
+	if !ok {
+		return nil, fmt.Errorf("no certificate configured for domain %s", origin)
+	}
+
+	return m.load(keyPair{certFile, keyFile})
+}
+
+// matchServerName finds the domain for the server name in hello. Because server names never include a port, if
+// there is no match on the name alone we also try the name with the port the connection was received on.
+func matchServerName(config *configuration.Config, hello *tls.ClientHelloInfo) (string, configuration.Domain, bool) {
+	if origin, domain, ok := config.MatchDomain(hello.ServerName); ok {
+		return origin, domain, ok
+	}
+
+	if hello.Conn != nil {
+		if _, port, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			return config.MatchDomain(net.JoinHostPort(hello.ServerName, port))
+		}
+	}
+
+	return "", configuration.Domain{}, false
+}
+
+// load returns the certificate for files, loading it from disk if it has not been loaded before or has changed
+// since it was last loaded. If reloading a changed certificate fails, the previous certificate continues to be used.
+func (m *Manager) load(files keyPair) (*tls.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	existing := m.loaded[files]
+	if existing != nil && now.Sub(existing.lastChecked) < m.CheckInterval {
+		return existing.certificate, nil
+	}
+
+	certInfo, certErr := os.Stat(files.certFile)
+	keyInfo, keyErr := os.Stat(files.keyFile)
+	if existing != nil {
+		existing.lastChecked = now
+		if certErr != nil || keyErr != nil || (certInfo.ModTime().Equal(existing.certModTime) && keyInfo.ModTime().Equal(existing.keyModTime)) {
+			// Either nothing has changed, or the files are part way through being replaced
+			return existing.certificate, nil
+		}
+	} else if certErr != nil {
+		return nil, certErr
+	} else if keyErr != nil {
+		return nil, keyErr
+	}
+
+	certificate, err := tls.LoadX509KeyPair(files.certFile, files.keyFile)
+	if err != nil {
+		if existing != nil {
+			slog.Default().Error("Unable to reload changed certificate; continuing to use previous certificate", "cert_file", files.certFile, "key_file", files.keyFile, "error", err)
+			return existing.certificate, nil
+		}
+		return nil, err
+	}
+
+	if existing != nil {
+		slog.Default().Info("Reloaded changed certificate", "cert_file", files.certFile, "key_file", files.keyFile)
+	}
+
+	m.loaded[files] = &loadedCertificate{
+		certificate: &certificate,
+		certModTime: certInfo.ModTime(),
+		keyModTime:  keyInfo.ModTime(),
+		lastChecked: now,
+	}
+	return &certificate, nil
+}
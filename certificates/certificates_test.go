@@ -0,0 +1,148 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, filepath.Join(dir, "example.com.crt"), filepath.Join(dir, "example.com.key"), "*.example.com", "example.com")
+	writeCertificate(t, filepath.Join(dir, "example.net.crt"), filepath.Join(dir, "example.net.key"), "example.net")
+	ownCertFile, ownKeyFile := filepath.Join(dir, "own.crt"), filepath.Join(dir, "own.key")
+	writeCertificate(t, ownCertFile, ownKeyFile, "example.org")
+
+	config := &configuration.Config{
+		TLSCertificateDir: dir,
+		Domains: map[string]configuration.Domain{
+			"example.com":     {MatchSubdomains: true},
+			"example.net":     {},
+			"example.org":     {TLSCertificate: &configuration.TLSCertificate{CertFile: ownCertFile, KeyFile: ownKeyFile}},
+			"missing.example": {},
+		},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+
+	testCases := []struct {
+		serverName string
+		commonName string
+	}{
+		{"example.com", "*.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"example.net", "example.net"},
+		{"example.org", "example.org"},
+		{"www.example.net", ""},
+		{"missing.example", ""},
+		{"", ""},
+	}
+
+	for _, testCase := range testCases {
+		certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: testCase.serverName})
+		if testCase.commonName == "" {
+			if err == nil {
+				t.Errorf("Expected error getting certificate for '%s', but got certificate %v", testCase.serverName, commonName(certificate))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected certificate for '%s', but got error: %v", testCase.serverName, err)
+		} else if commonName(certificate) != testCase.commonName {
+			t.Errorf("Expected certificate for '%s' to have common name '%s', but got '%s'", testCase.serverName, testCase.commonName, commonName(certificate))
+		}
+	}
+}
+
+func TestGetCertificateReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "example.com.crt"), filepath.Join(dir, "example.com.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	config := &configuration.Config{
+		TLSCertificateDir: dir,
+		Domains:           map[string]configuration.Domain{"example.com": {}},
+	}
+	manager := NewManager(func() *configuration.Config { return config })
+	manager.CheckInterval = 0
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	if certificate, err := manager.GetCertificate(hello); err != nil || commonName(certificate) != "first" {
+		t.Fatalf("Expected certificate with common name 'first', but got %v (error: %v)", certificate, err)
+	}
+
+	writeCertificate(t, certFile, keyFile, "second")
+	// Make sure the modification time changes even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	if certificate, err := manager.GetCertificate(hello); err != nil || commonName(certificate) != "second" {
+		t.Errorf("Expected certificate with common name 'second' after files changed, but got %v (error: %v)", certificate, err)
+	}
+
+	// A broken replacement should not stop us serving the previous certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(certFile, evenLater, evenLater)
+
+	if certificate, err := manager.GetCertificate(hello); err != nil || commonName(certificate) != "second" {
+		t.Errorf("Expected certificate with common name 'second' after invalid replacement, but got %v (error: %v)", certificate, err)
+	}
+}
+
+func commonName(certificate *tls.Certificate) string {
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.Subject.CommonName
+}
+
+// writeCertificate writes a self-signed certificate for names, with the first name as the common name.
+func writeCertificate(t *testing.T, certFile string, keyFile string, names ...string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Unable to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("Unable to write key: %v", err)
+	}
+}
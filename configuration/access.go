@@ -0,0 +1,81 @@
+package configuration
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+)
+
+const (
+	AccessDeniedByDenyList  = "deny_cidrs"
+	AccessDeniedByAllowList = "allow_cidrs"
+)
+
+var defaultBlockedResponse = &DefaultResponse{
+	Code: http.StatusForbidden,
+	Headers: map[string]string{
+		"Content-Type": "text/plain",
+	},
+	Body: "403 Forbidden\n",
+}
+
+// AccessDenial describes why a request was refused by allow_cidrs or deny_cidrs.
+type AccessDenial struct {
+	// List is "global" if the request was refused by the global lists, or otherwise the domain whose lists refused it
+	List string
+	// Reason is AccessDeniedByDenyList or AccessDeniedByAllowList
+	Reason   string
+	Response *DefaultResponse
+}
+
+// CheckAccess returns an AccessDenial if a request from remoteAddr to domain (which may be "" if no domain matched)
+// is refused by the global or domain's allow_cidrs and deny_cidrs, or nil if it is allowed. The global lists are
+// checked first. A client in deny_cidrs is refused; otherwise, if allow_cidrs is set, a client not in it is refused.
+func (c *Config) CheckAccess(domain string, remoteAddr string) *AccessDenial {
+	addr, ok := parseNode(remoteAddr)
+
+	if reason := checkAccessLists(addr, ok, parsedPrefixList(c.allowCIDRs, c.AllowCIDRs), parsedPrefixList(c.denyCIDRs, c.DenyCIDRs)); reason != "" {
+		return &AccessDenial{List: "global", Reason: reason, Response: c.blockedResponse(nil)}
+	}
+
+	if domain != "" {
+		d := c.Domains[domain]
+		if reason := checkAccessLists(addr, ok, parsedPrefixList(d.allowCIDRs, d.AllowCIDRs), parsedPrefixList(d.denyCIDRs, d.DenyCIDRs)); reason != "" {
+			return &AccessDenial{List: domain, Reason: reason, Response: c.blockedResponse(d.BlockedResponse)}
+		}
+	}
+
+	return nil
+}
+
+// checkAccessLists returns the reason a client is refused, or "" if it is allowed. Clients whose address could not be
+// parsed are only refused if there is an allow list.
+func checkAccessLists(addr netip.AddrPort, ok bool, allow prefixList, deny prefixList) string {
+	if ok && deny.Contains(addr.Addr()) {
+		return AccessDeniedByDenyList
+	}
+	if allow != nil && (!ok || !allow.Contains(addr.Addr())) {
+		return AccessDeniedByAllowList
+	}
+	return ""
+}
+
+// validateAllowList rejects an empty allow_cidrs, which would refuse every client.
+func validateAllowList(location string, entries []string) []string {
+	if entries != nil && len(entries) == 0 {
+		return []string{fmt.Sprintf("Invalid %s. The list must not be empty, since that would refuse every client; remove it to allow all clients.", location)}
+	}
+	return nil
+}
+
+// blockedResponse returns domainResponse if it is set, or otherwise the global blocked_response, or 403 Forbidden.
+func (c *Config) blockedResponse(domainResponse *DefaultResponse) *DefaultResponse {
+	switch {
+	case domainResponse != nil:
+		return domainResponse
+	case c.BlockedResponse != nil:
+		return c.BlockedResponse
+	default:
+		return defaultBlockedResponse
+	}
+}
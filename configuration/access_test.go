@@ -0,0 +1,131 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+const accessTestConfig = `{
+	"default_response": {"code": 421},
+	"deny_cidrs": ["203.0.113.0/24"],
+	"blocked_response": {"code": 0},
+	"domains": {
+		"internal.example.com": {
+			"allow_cidrs": ["10.0.0.0/8", "2001:db8::/32"],
+			"deny_cidrs": ["10.9.0.0/16"],
+			"blocked_response": {"code": 404, "body": "not found\n"}
+		},
+		"staff.example.com": {
+			"allow_cidrs": ["192.0.2.0/24"]
+		},
+		"example.com": {}
+	}
+}`
+
+func TestCheckAccess(t *testing.T) {
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(accessTestConfig), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		domain     string
+		remoteAddr string
+		list       string
+		reason     string
+		code       int
+	}{
+		{"example.com", "198.51.100.1:1234", "", "", 0},
+		{"", "198.51.100.1:1234", "", "", 0},
+		{"example.com", "203.0.113.9:1234", "global", AccessDeniedByDenyList, 0},
+		{"", "203.0.113.9:1234", "global", AccessDeniedByDenyList, 0},
+		{"internal.example.com", "203.0.113.9:1234", "global", AccessDeniedByDenyList, 0},
+		{"internal.example.com", "10.1.2.3:1234", "", "", 0},
+		{"internal.example.com", "[::ffff:10.1.2.3]:1234", "", "", 0},
+		{"internal.example.com", "[2001:db8::1]:1234", "", "", 0},
+		{"internal.example.com", "10.9.2.3:1234", "internal.example.com", AccessDeniedByDenyList, 404},
+		{"internal.example.com", "198.51.100.1:1234", "internal.example.com", AccessDeniedByAllowList, 404},
+		{"internal.example.com", "not an address", "internal.example.com", AccessDeniedByAllowList, 404},
+		{"example.com", "not an address", "", "", 0},
+		{"staff.example.com", "198.51.100.1:1234", "staff.example.com", AccessDeniedByAllowList, 0},
+		{"staff.example.com", "192.0.2.1", "", "", 0},
+	}
+
+	for _, testCase := range testCases {
+		denial := config.CheckAccess(testCase.domain, testCase.remoteAddr)
+		if testCase.list == "" {
+			if denial != nil {
+				t.Errorf("Expected %s to be allowed for domain '%s', but got %+v", testCase.remoteAddr, testCase.domain, denial)
+			}
+			continue
+		}
+
+		if denial == nil {
+			t.Errorf("Expected %s to be refused for domain '%s', but it was allowed", testCase.remoteAddr, testCase.domain)
+			continue
+		}
+		if denial.List != testCase.list || denial.Reason != testCase.reason || denial.Response.Code != testCase.code {
+			t.Errorf("Expected %s to be refused for domain '%s' by %s %s with code %d, but got %s %s with code %d", testCase.remoteAddr, testCase.domain, testCase.list, testCase.reason, testCase.code, denial.List, denial.Reason, denial.Response.Code)
+		}
+	}
+
+	if denial := (&Config{}).CheckAccess("", "203.0.113.9:1234"); denial != nil {
+		t.Errorf("Expected all clients to be allowed without allow_cidrs or deny_cidrs, but got %+v", denial)
+	}
+	if denial := (&Config{AllowCIDRs: []string{"192.0.2.0/24"}}).CheckAccess("", "203.0.113.9:1234"); denial == nil || denial.Response.Code != 403 {
+		t.Errorf("Expected client to be refused with 403 by config not created by LoadConfig(), but got %+v", denial)
+	}
+}
+
+func TestLoadConfigAccessLists(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"allow_cidrs": ["10.0.0.0/8", "10.0.0.0/40"],
+		"deny_cidrs": ["nope"],
+		"blocked_response": {"code": 100},
+		"domains": {
+			"example.com": {
+				"allow_cidrs": ["::1/129"],
+				"deny_cidrs": ["192.0.2.1"],
+				"blocked_response": {"code": 1000}
+			}
+		}
+	}`), config)
+
+	expected := []string{"10.0.0.0/40", "nope", "::1/129", "code 100.", "code 1000."}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %d problems: %v", len(expected), len(problems), problems)
+	}
+	for _, substring := range expected {
+		if !strings.Contains(strings.Join(problems, "\n"), substring) {
+			t.Errorf("Expected a problem mentioning %s, but got %v", substring, problems)
+		}
+	}
+}
+
+func TestLoadConfigEmptyAllowList(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"allow_cidrs": [],
+		"domains": {
+			"example.com": {
+				"allow_cidrs": []
+			},
+			"example.net": {
+				"deny_cidrs": ["192.0.2.1"]
+			}
+		}
+	}`), config)
+
+	expected := []string{"Invalid allow_cidrs. ", "Invalid allow_cidrs for domain example.com."}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %d problems: %v", len(expected), len(problems), problems)
+	}
+	for _, substring := range expected {
+		if !strings.Contains(strings.Join(problems, "\n"), substring) {
+			t.Errorf("Expected a problem mentioning %s, but got %v", substring, problems)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package configuration
+
+import (
+	"fmt"
+	"time"
+)
+
+// AccessLog configures how requests are logged. Only requests for which log_hits is set are logged.
+type AccessLog struct {
+	Format         string   `json:"format,omitempty" note:"\"json\", \"logfmt\" or \"clf\" (Combined Log Format); defaults to \"json\""`
+	Fields         []string `json:"fields,omitempty" note:"Fields to include in json and logfmt output, in order; defaults to DefaultAccessLogFields"`
+	Output         string   `json:"output,omitempty" note:"\"stdout\", \"file\" or \"syslog\"; defaults to \"stdout\""`
+	File           string   `json:"file,omitempty" note:"Path of the log file, for output \"file\""`
+	MaxSize        int64    `json:"max_size,omitempty" note:"Rotate the log file before it grows beyond this many bytes"`
+	RotateInterval Duration `json:"rotate_interval,omitempty" note:"Rotate the log file this often"`
+	MaxBackups     int      `json:"max_backups,omitempty" note:"Number of rotated log files to keep, or all of them if zero"`
+	SyslogNetwork  string   `json:"syslog_network,omitempty" note:"\"udp\", \"tcp\" or \"unix\", for output \"syslog\"; if not set, the local syslog daemon is used"`
+	SyslogAddress  string   `json:"syslog_address,omitempty" note:"Address of the syslog daemon, if syslog_network is set"`
+	SyslogTag      string   `json:"syslog_tag,omitempty" note:"Defaults to \"redirector\""`
+}
+
+const (
+	AccessLogFormatJSON   = "json"
+	AccessLogFormatLogfmt = "logfmt"
+	AccessLogFormatCLF    = "clf"
+
+	AccessLogOutputStdout = "stdout"
+	AccessLogOutputFile   = "file"
+	AccessLogOutputSyslog = "syslog"
+)
+
+// AccessLogFields are the fields which may be included in json and logfmt access logs.
+var AccessLogFields = []string{
+	"time",
+	"remote_addr",
+	"method",
+	"host",
+	"request_uri",
+	"protocol",
+	"user_agent",
+	"referer",
+	"code",
+	"bytes",
+	"latency",
+	"domain",
+	"rule",
+	"labels",
+	"action",
+	"destination",
+	"split_destination",
+	"regexp",
+	"redirect_map_source",
+	"redirect_map_line",
+	"source",
+	"limit",
+	"list",
+	"reason",
+}
+
+// DefaultAccessLogFields are used if an AccessLog does not set Fields.
+var DefaultAccessLogFields = []string{
+	"time",
+	"remote_addr",
+	"method",
+	"host",
+	"request_uri",
+	"code",
+	"bytes",
+	"latency",
+	"domain",
+	"rule",
+	"action",
+	"destination",
+	"user_agent",
+	"referer",
+}
+
+func validateAccessLog(accessLog *AccessLog) []string {
+	var problems []string
+
+	switch accessLog.Format {
+	case "", AccessLogFormatJSON, AccessLogFormatLogfmt, AccessLogFormatCLF:
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid access_log format '%s'. Format must be '%s', '%s' or '%s'.", accessLog.Format, AccessLogFormatJSON, AccessLogFormatLogfmt, AccessLogFormatCLF))
+	}
+
+	known := map[string]bool{}
+	for _, field := range AccessLogFields {
+		known[field] = true
+	}
+	for _, field := range accessLog.Fields {
+		if !known[field] {
+			problems = append(problems, fmt.Sprintf("Invalid access_log field '%s'.", field))
+		}
+	}
+	if accessLog.Format == AccessLogFormatCLF && len(accessLog.Fields) > 0 {
+		problems = append(problems, fmt.Sprintf("Invalid access_log fields. Fields must not be set if format is '%s'.", AccessLogFormatCLF))
+	}
+
+	switch accessLog.Output {
+	case "", AccessLogOutputStdout, AccessLogOutputSyslog:
+		if accessLog.File != "" || accessLog.MaxSize != 0 || accessLog.RotateInterval != 0 || accessLog.MaxBackups != 0 {
+			problems = append(problems, fmt.Sprintf("Invalid access_log configuration. file, max_size, rotate_interval and max_backups may only be set if output is '%s'.", AccessLogOutputFile))
+		}
+	case AccessLogOutputFile:
+		if accessLog.File == "" {
+			problems = append(problems, fmt.Sprintf("Invalid access_log configuration. file must be set if output is '%s'.", AccessLogOutputFile))
+		}
+		if accessLog.MaxSize < 0 || accessLog.RotateInterval < 0 || accessLog.MaxBackups < 0 {
+			problems = append(problems, "Invalid access_log configuration. max_size, rotate_interval and max_backups must not be negative.")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid access_log output '%s'. Output must be '%s', '%s' or '%s'.", accessLog.Output, AccessLogOutputStdout, AccessLogOutputFile, AccessLogOutputSyslog))
+	}
+
+	if accessLog.Output != AccessLogOutputSyslog && (accessLog.SyslogNetwork != "" || accessLog.SyslogAddress != "" || accessLog.SyslogTag != "") {
+		problems = append(problems, fmt.Sprintf("Invalid access_log configuration. syslog_network, syslog_address and syslog_tag may only be set if output is '%s'.", AccessLogOutputSyslog))
+	}
+	if (accessLog.SyslogNetwork == "") != (accessLog.SyslogAddress == "") {
+		problems = append(problems, "Invalid access_log configuration. syslog_network and syslog_address must be set together.")
+	}
+
+	if accessLog.RotateInterval > 0 && time.Duration(accessLog.RotateInterval) < time.Second {
+		problems = append(problems, fmt.Sprintf("Invalid access_log rotate_interval %s. Interval must be at least 1s.", time.Duration(accessLog.RotateInterval)))
+	}
+
+	return problems
+}
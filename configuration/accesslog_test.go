@@ -0,0 +1,49 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigAccessLog(t *testing.T) {
+	valid := []string{
+		`{}`,
+		`{"format": "logfmt", "fields": ["time", "latency", "bytes", "rule"]}`,
+		`{"format": "clf", "output": "file", "file": "/var/log/redirector.log", "max_size": 1048576, "rotate_interval": "24h", "max_backups": 7}`,
+		`{"output": "syslog"}`,
+		`{"output": "syslog", "syslog_network": "udp", "syslog_address": "localhost:514", "syslog_tag": "redirects"}`,
+	}
+	for _, accessLog := range valid {
+		config := &Config{}
+		if problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "access_log": `+accessLog+`}`), config); len(problems) != 0 {
+			t.Errorf("Expected no problems with access_log %s, but got %d problems: %v", accessLog, len(problems), problems)
+		}
+	}
+
+	invalid := []struct {
+		accessLog string
+		problem   string
+	}{
+		{`{"format": "xml"}`, "format 'xml'"},
+		{`{"fields": ["time", "cookie"]}`, "field 'cookie'"},
+		{`{"format": "clf", "fields": ["time"]}`, "Fields must not be set"},
+		{`{"output": "stderr"}`, "output 'stderr'"},
+		{`{"output": "file"}`, "file must be set"},
+		{`{"file": "/var/log/redirector.log"}`, "may only be set if output is 'file'"},
+		{`{"output": "file", "file": "redirector.log", "max_backups": -1}`, "must not be negative"},
+		{`{"output": "file", "file": "redirector.log", "rotate_interval": "1ms"}`, "at least 1s"},
+		{`{"syslog_tag": "redirects"}`, "may only be set if output is 'syslog'"},
+		{`{"output": "syslog", "syslog_network": "udp"}`, "must be set together"},
+	}
+	for _, testCase := range invalid {
+		config := &Config{}
+		problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "access_log": `+testCase.accessLog+`}`), config)
+		if len(problems) != 1 {
+			t.Errorf("Expected 1 problem with access_log %s, but got %d problems: %v", testCase.accessLog, len(problems), problems)
+			continue
+		}
+		if !strings.Contains(problems[0], testCase.problem) {
+			t.Errorf("Expected problem with access_log %s to contain '%s', but got '%s'", testCase.accessLog, testCase.problem, problems[0])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package configuration
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// prefixList is a list of IP networks, given in the config file as CIDRs like "10.0.0.0/8" or single addresses.
+type prefixList []netip.Prefix
+
+// parsePrefixList parses entries, returning a problem for each which is not a valid CIDR or address. location
+// identifies the config key, for use in problems. If entries is nil (i.e. the key was not set), so is the result.
+func parsePrefixList(location string, entries []string) (prefixList, []string) {
+	if entries == nil {
+		return nil, nil
+	}
+
+	var problems []string
+
+	prefixes := make(prefixList, 0, len(entries))
+	for _, entry := range entries {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid entry '%s' in %s. Entries must be CIDRs like 10.0.0.0/8 or IP addresses.", entry, location))
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, problems
+}
+
+// parsedPrefixList returns parsed if it is set, or otherwise entries parsed on the fly (ignoring invalid entries), so
+// that configs which were not created by LoadConfig() still work.
+func parsedPrefixList(parsed prefixList, entries []string) prefixList {
+	if parsed == nil && entries != nil {
+		parsed, _ = parsePrefixList("", entries)
+	}
+	return parsed
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Contains reports whether addr is in any of the networks in l. IPv4-mapped IPv6 addresses are treated as IPv4.
+func (l prefixList) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProxyProtocolSource reports whether connections from addr to listen_address start with a PROXY protocol header.
+func (c *Config) IsProxyProtocolSource(addr netip.Addr) bool {
+	return parsedPrefixList(c.proxyProtocol, c.ProxyProtocol).Contains(addr)
+}
+
+// IsTrustedProxy reports whether addr (a host and port, or just an IP address) is in trusted_proxies.
+func (c *Config) IsTrustedProxy(addr string) bool {
+	peer, ok := parseNode(addr)
+	return ok && parsedPrefixList(c.trustedProxies, c.TrustedProxies).Contains(peer.Addr())
+}
+
+// ClientAddr returns the address of the client which made req, as host:port.
+//
+// If client_ip_header is not set, or the request did not come from one of trusted_proxies (including when
+// trusted_proxies is not set), this is req.RemoteAddr. Otherwise, the header is read as a list of hops (in the form of
+// X-Forwarded-For, or of RFC 7239 if the header is Forwarded), and the rightmost hop which is not a trusted proxy is
+// used. If the header is not present, or that hop is not a valid IP address (e.g. "unknown"), req.RemoteAddr is used.
+// Hops without a port are given port 0.
+func (c *Config) ClientAddr(req *http.Request) string {
+	if c.ClientIPHeader == "" || !c.IsTrustedProxy(req.RemoteAddr) {
+		return req.RemoteAddr
+	}
+
+	trusted := parsedPrefixList(c.trustedProxies, c.TrustedProxies)
+
+	var hops []string
+	values := req.Header.Values(c.ClientIPHeader)
+	if http.CanonicalHeaderKey(c.ClientIPHeader) == "Forwarded" {
+		hops = forwardedForValues(values)
+	} else {
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	for index := len(hops) - 1; index >= 0; index-- {
+		hop, ok := parseNode(hops[index])
+		if !ok {
+			return req.RemoteAddr
+		}
+		if index == 0 || !trusted.Contains(hop.Addr()) {
+			return hop.String()
+		}
+	}
+
+	return req.RemoteAddr
+}
+
+// parseNode parses an address like "192.0.2.1", "192.0.2.1:1234", "2001:db8::1" or "[2001:db8::1]:1234". A missing
+// or obfuscated port is given as 0. IPv4-mapped IPv6 addresses are converted to IPv4.
+func parseNode(node string) (netip.AddrPort, bool) {
+	node = strings.TrimSpace(node)
+
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0), true
+	}
+
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		// net.SplitHostPort() does not accept an IPv6 address in brackets without a port
+		if !strings.HasPrefix(node, "[") || !strings.HasSuffix(node, "]") {
+			return netip.AddrPort{}, false
+		}
+		host, port = node[1:len(node)-1], ""
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		number = 0
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(number)), true
+}
+
+// forwardedForValues returns the for= parameter of each element in RFC 7239 Forwarded header values, in order.
+// Elements without a for= parameter are skipped.
+func forwardedForValues(values []string) []string {
+	var nodes []string
+
+	for _, value := range values {
+		for _, element := range splitOutsideQuotes(value, ',') {
+			for _, pair := range splitOutsideQuotes(element, ';') {
+				name, node, found := strings.Cut(pair, "=")
+				if found && strings.EqualFold(strings.TrimSpace(name), "for") {
+					nodes = append(nodes, unquote(strings.TrimSpace(node)))
+				}
+			}
+		}
+	}
+
+	return nodes
+}
+
+// splitOutsideQuotes splits s at each sep which is not inside a quoted string.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+
+	start, quoted, escaped := 0, false, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and escapes from an RFC 7230 quoted-string, or returns s unchanged if it is not quoted.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	var unquoted strings.Builder
+	escaped := false
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		unquoted.WriteByte(s[i])
+	}
+	return unquoted.String()
+}
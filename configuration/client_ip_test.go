@@ -0,0 +1,133 @@
+package configuration
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	testCases := []struct {
+		header         string
+		trustedProxies []string
+		remoteAddr     string
+		values         []string
+		expected       string
+	}{
+		// Header not configured or not present
+		{"", nil, "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+
+		// Single-value headers
+		{"Fly-Client-IP", []string{"192.0.2.1"}, "192.0.2.1:1234", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"Fly-Client-IP", []string{"192.0.2.1"}, "192.0.2.1:1234", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"Fly-Client-IP", []string{"192.0.2.1"}, "192.0.2.1:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1:0"},
+		{"Fly-Client-IP", []string{"192.0.2.1"}, "192.0.2.1:1234", []string{"not an address"}, "192.0.2.1:1234"},
+		{"Fly-Client-IP", nil, "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234"},
+		{"Fly-Client-IP", []string{"10.0.0.0/8"}, "10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"Fly-Client-IP", []string{"10.0.0.0/8"}, "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234"},
+		{"Fly-Client-IP", []string{"10.0.0.1"}, "10.0.0.2:1234", []string{"198.51.100.1"}, "10.0.0.2:1234"},
+		{"Fly-Client-IP", []string{"10.0.0.0/8"}, "[::ffff:10.1.2.3]:1234", []string{"198.51.100.1"}, "198.51.100.1:0"},
+
+		// X-Forwarded-For
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"203.0.113.7, 198.51.100.1, 10.0.0.2"}, "198.51.100.1:0"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"203.0.113.7, 198.51.100.1", "10.0.0.2"}, "198.51.100.1:0"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:0"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"198.51.100.1:5678"}, "198.51.100.1:5678"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"unknown, 10.0.0.2"}, "10.0.0.1:1234"},
+		{"X-Forwarded-For", []string{"10.0.0.0/8", "2001:db8::/32"}, "[2001:db8::2]:1234", []string{"2001:db8:ffff::1, 2001:db8::3"}, "[2001:db8:ffff::1]:0"},
+		{"X-Forwarded-For", nil, "192.0.2.1:1234", []string{"203.0.113.7, 198.51.100.1"}, "192.0.2.1:1234"},
+
+		// Forwarded
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`for=198.51.100.1;proto=https, for=10.0.0.2`}, "198.51.100.1:0"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`for="[2001:db8::1]:4711"`}, "[2001:db8::1]:4711"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`for="[2001:db8::1]"`}, "[2001:db8::1]:0"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`For="198.51.100.1:_hidden"`}, "198.51.100.1:0"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`for=_hidden, for=10.0.0.2`}, "10.0.0.1:1234"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`by=10.0.0.9;host="a,b;c";for=198.51.100.1`}, "198.51.100.1:0"},
+		{"Forwarded", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{`for=203.0.113.7`, `proto=https;for=198.51.100.1, host=example.com`}, "198.51.100.1:0"},
+	}
+
+	for _, testCase := range testCases {
+		config := &Config{ClientIPHeader: testCase.header, TrustedProxies: testCase.trustedProxies}
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = testCase.remoteAddr
+		for _, value := range testCase.values {
+			req.Header.Add(testCase.header, value)
+		}
+
+		if actual := config.ClientAddr(req); actual != testCase.expected {
+			t.Errorf("Expected client address %s for %s %v from %s with trusted_proxies %v, but got %s", testCase.expected, testCase.header, testCase.values, testCase.remoteAddr, testCase.trustedProxies, actual)
+		}
+	}
+}
+
+func TestLoadConfigTrustedProxies(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"domains": {},
+		"client_ip_header": "X-Forwarded-For",
+		"trusted_proxies": ["10.0.0.0/8", "2001:db8::/32", "192.0.2.1", "10.0.0.0/33", "example.com"]
+	}`), config)
+
+	if len(problems) != 2 {
+		t.Fatalf("Expected two problems, but got %d problems: %v", len(problems), problems)
+	}
+	if !strings.Contains(problems[0], "10.0.0.0/33") || !strings.Contains(problems[1], "example.com") {
+		t.Errorf("Expected problems for invalid trusted_proxies entries, but got %v", problems)
+	}
+	if len(config.Warnings) != 0 {
+		t.Errorf("Expected no warnings, but got %v", config.Warnings)
+	}
+
+	config = &Config{}
+	problems = LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"domains": {},
+		"client_ip_header": "X-Forwarded-For"
+	}`), config)
+
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	if len(config.Warnings) != 1 || !strings.Contains(config.Warnings[0], "trusted_proxies") {
+		t.Errorf("Expected a warning that client_ip_header is ignored without trusted_proxies, but got %v", config.Warnings)
+	}
+}
+
+func TestIsProxyProtocolSource(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"domains": {},
+		"proxy_protocol": ["10.0.0.0/8", "2001:db8::1", "10.0.0.0/8/8"]
+	}`), config)
+
+	if len(problems) != 1 || !strings.Contains(problems[0], "10.0.0.0/8/8") {
+		t.Errorf("Expected a problem for the invalid proxy_protocol entry, but got %v", problems)
+	}
+
+	testCases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+
+	for _, testCase := range testCases {
+		if actual := config.IsProxyProtocolSource(netip.MustParseAddr(testCase.addr)); actual != testCase.expected {
+			t.Errorf("Expected IsProxyProtocolSource(%s) to be %v, but got %v", testCase.addr, testCase.expected, actual)
+		}
+	}
+
+	if (&Config{}).IsProxyProtocolSource(netip.MustParseAddr("10.1.2.3")) {
+		t.Errorf("Expected no PROXY protocol sources when proxy_protocol is not set")
+	}
+}
@@ -1,51 +1,198 @@
 package configuration
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	ListenAddress   string            `json:"listen_address"`
-	MetricsAddress  string            `json:"metrics_address"`
-	MetricsPath     string            `json:"metrics_path"`
-	ClientIPHeader  string            `json:"client_ip_header" note:"Read the client IP address from this HTTP header, instead of Request.RemoteAddr (ignored if header is empty or not present)"`
-	DefaultResponse *DefaultResponse  `json:"default_response"`
-	Domains         map[string]Domain `json:"domains" note:"Keys must be valid fully qualified DNS domain names in ASCII lower case and punycode if required."`
+	ListenAddress       string            `json:"listen_address"`
+	MetricsAddress      string            `json:"metrics_address,omitempty"`
+	MetricsPath         string            `json:"metrics_path,omitempty"`
+	ClientIPHeader      string            `json:"client_ip_header,omitempty" note:"Read the client IP address from this HTTP header, instead of Request.RemoteAddr (ignored if header is empty or not present)"`
+	TrustedProxies      []string          `json:"trusted_proxies,omitempty" note:"CIDRs of proxies from which client_ip_header is accepted; if not set, client_ip_header is ignored"`
+	ProxyProtocol       []string          `json:"proxy_protocol,omitempty" note:"CIDRs of load balancers which send a PROXY protocol header on listen_address; other connections are handled as plain HTTP"`
+	ReadTimeout         Duration          `json:"read_timeout,omitempty" note:"Maximum time to read a whole request, including the body; defaults to 1 minute"`
+	ReadHeaderTimeout   Duration          `json:"read_header_timeout,omitempty" note:"Maximum time to read request headers; defaults to 10 seconds"`
+	WriteTimeout        Duration          `json:"write_timeout,omitempty" note:"Maximum time from the end of the request headers to the end of the response, or no limit if zero"`
+	IdleTimeout         Duration          `json:"idle_timeout,omitempty" note:"Maximum time to wait for the next request on a keep-alive connection; defaults to 2 minutes"`
+	MaxHeaderBytes      int               `json:"max_header_bytes,omitempty" note:"Maximum size of request headers; defaults to 64 KiB"`
+	ShutdownTimeout     Duration          `json:"shutdown_timeout,omitempty" note:"Maximum time to wait for in-flight requests to finish on SIGTERM or SIGINT; defaults to 5 seconds"`
+	ConfigWatchInterval Duration          `json:"config_watch_interval,omitempty" note:"If set, poll the config file at this interval and reload it when it changes (e.g. \"30s\")"`
+	TLSListenAddress    string            `json:"tls_listen_address,omitempty" note:"If set, also serve HTTPS on this address"`
+	TLSCertificateDir   string            `json:"tls_certificate_dir,omitempty" note:"Directory containing <domain>.crt and <domain>.key for each domain without its own tls_certificate"`
+	ACME                *ACME             `json:"acme,omitempty" note:"If set, obtain certificates over ACME for domains without a tls_certificate or a certificate in tls_certificate_dir"`
+	AdminAddress        string            `json:"admin_address,omitempty" note:"If set, serve the admin API on this address"`
+	AdminToken          string            `json:"admin_token,omitempty" note:"Bearer token required for all admin API requests"`
+	AdminWriteConfig    bool              `json:"admin_write_config,omitempty" note:"Write changes made through the admin API back to the config file"`
+	DefaultResponse     *DefaultResponse  `json:"default_response"`
+	Domains             map[string]Domain `json:"domains" note:"Keys must be valid fully qualified DNS domain names in ASCII lower case and punycode if required."`
+	AccessLog           *AccessLog        `json:"access_log,omitempty" note:"If not set, requests are logged with the rest of the application's logs"`
+	LogPrivacy          *LogPrivacy       `json:"log_privacy,omitempty" note:"Applies to every log which includes a client's address or referer"`
+	Tracing             *Tracing          `json:"tracing,omitempty" note:"If not set, traces are not exported"`
+	RateLimit           *RateLimit        `json:"rate_limit,omitempty" note:"Limits requests from each client across all domains"`
+	AllowCIDRs          []string          `json:"allow_cidrs,omitempty" note:"If set, only clients in these networks may make requests"`
+	DenyCIDRs           []string          `json:"deny_cidrs,omitempty" note:"Clients in these networks may not make requests"`
+	BlockedResponse     *DefaultResponse  `json:"blocked_response,omitempty" note:"Sent to clients refused by allow_cidrs or deny_cidrs; defaults to 403 Forbidden"`
+	Tests               []TestCase        `json:"tests,omitempty" note:"Requests and their expected responses, checked by LoadConfig() but otherwise ignored"`
+
+	// Warnings are found by LoadConfig() and, unlike problems, do not prevent the config being used
+	Warnings []string `json:"-"`
+
+	// Clock returns the current time, which determines whether rules and domains are active; if nil, time.Now is used
+	Clock func() time.Time `json:"-"`
+
+	// hosts is built by LoadConfig() for use by MatchDomain()
+	hosts *hostIndex
+
+	// trustedProxies is parsed from TrustedProxies by LoadConfig() for use by ClientAddr()
+	trustedProxies prefixList
+
+	// proxyProtocol is parsed from ProxyProtocol by LoadConfig() for use by IsProxyProtocolSource()
+	proxyProtocol prefixList
+
+	// allowCIDRs and denyCIDRs are parsed from AllowCIDRs and DenyCIDRs by LoadConfig() for use by CheckAccess()
+	allowCIDRs prefixList
+	denyCIDRs  prefixList
+}
+
+// Duration is a time.Duration which is represented in JSON as a string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 type DefaultResponse struct {
 	Code    int               `json:"code"`
-	Headers map[string]string `json:"headers"`
-	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
 	LogHits bool              `json:"log_hits"`
+	ID      string            `json:"id,omitempty" note:"Identifies this response in metrics and logs, instead of e.g. \"default\"; must be unique within each domain"`
+	Labels  map[string]string `json:"labels,omitempty" note:"Free-form labels included in logs and traces"`
 }
 
 type Domain struct {
-	RewriteRules    []Rule           `json:"rewrites"`
-	DefaultResponse *DefaultResponse `json:"default_response"`
-	MatchSubdomains bool             `json:"match_subdomains"`
+	RewriteRules       []Rule                      `json:"rewrites,omitempty"`
+	DefaultResponse    *DefaultResponse            `json:"default_response,omitempty"`
+	MatchSubdomains    bool                        `json:"match_subdomains,omitempty"`
+	RedirectMapFile    string                      `json:"redirect_map,omitempty" note:"Path to a CSV (or TSV, if the name ends in .tsv) file of source path, destination and code, checked before rewrites"`
+	RedirectMapLogHits bool                        `json:"redirect_map_log_hits,omitempty"`
+	RedirectMap        map[string]RedirectMapEntry `json:"-" note:"Populated from RedirectMapFile by LoadConfig(), keyed by source path"`
+	TLSCertificate     *TLSCertificate             `json:"tls_certificate,omitempty" note:"Certificate to use for this domain, which should be a wildcard certificate if MatchSubdomains is set"`
+	DisableACME        bool                        `json:"disable_acme,omitempty" note:"Never obtain certificates for this domain over ACME, even if acme is configured"`
+	NotBefore          *time.Time                  `json:"not_before,omitempty" note:"RFC 3339 time before which requests for this domain are handled as if it did not exist"`
+	NotAfter           *time.Time                  `json:"not_after,omitempty" note:"RFC 3339 time from which requests for this domain are handled as if it did not exist"`
+	RateLimit          *RateLimit                  `json:"rate_limit,omitempty" note:"Limits requests for this domain from each client, in addition to any global rate_limit"`
+	AllowCIDRs         []string                    `json:"allow_cidrs,omitempty" note:"If set, only clients in these networks may make requests for this domain"`
+	DenyCIDRs          []string                    `json:"deny_cidrs,omitempty" note:"Clients in these networks may not make requests for this domain"`
+	BlockedResponse    *DefaultResponse            `json:"blocked_response,omitempty" note:"Sent to clients refused by allow_cidrs or deny_cidrs; defaults to the global blocked_response"`
+
+	// allowCIDRs and denyCIDRs are parsed from AllowCIDRs and DenyCIDRs by LoadConfig() for use by CheckAccess()
+	allowCIDRs prefixList
+	denyCIDRs  prefixList
+}
+
+type ACME struct {
+	DirectoryURL        string   `json:"directory_url,omitempty" note:"Defaults to Let's Encrypt"`
+	Email               string   `json:"email,omitempty"`
+	AcceptTOS           bool     `json:"accept_tos" note:"Must be true to indicate acceptance of the CA's terms of service"`
+	CacheDir            string   `json:"cache_dir" note:"Directory in which to store the account key and certificates"`
+	CARootFile          string   `json:"ca_root_file,omitempty" note:"PEM encoded CA certificate to trust when connecting to directory_url, e.g. for a test CA"`
+	RenewBefore         Duration `json:"renew_before,omitempty" note:"Renew certificates this long before they expire; defaults to 30 days"`
+	DNS01PresentCommand []string `json:"dns_01_present_command,omitempty" note:"Command to create a DNS-01 challenge TXT record, used to obtain wildcard certificates for domains with match_subdomains"`
+	DNS01CleanupCommand []string `json:"dns_01_cleanup_command,omitempty" note:"Command to remove a DNS-01 challenge TXT record"`
+}
+
+type TLSCertificate struct {
+	CertFile string `json:"cert_file" note:"PEM encoded certificate chain"`
+	KeyFile  string `json:"key_file" note:"PEM encoded private key"`
 }
 
 type Rule struct {
-	Regexp      *regexp.Regexp `json:"regexp"`
-	Replacement string         `json:"replacement"`
-	Code        int            `json:"code"`
-	LogHits     bool           `json:"log_hits"`
+	Regexp       *regexp.Regexp        `json:"regexp"`
+	Replacement  string                `json:"replacement"`
+	Code         int                   `json:"code"`
+	LogHits      bool                  `json:"log_hits"`
+	Action       string                `json:"action,omitempty" note:"Either \"redirect\" (the default if empty) or \"proxy\""`
+	Proxy        *ProxyOptions         `json:"proxy,omitempty" note:"Only valid if Action is \"proxy\""`
+	MatchHost    bool                  `json:"match_host,omitempty" note:"Match Regexp against the host (without port) followed by the request URI, e.g. \"www.example.com/path?query\""`
+	Template     *Template             `json:"template,omitempty" note:"A text/template which renders the destination, used instead of Replacement"`
+	MatchPath    bool                  `json:"match_path,omitempty" note:"Match Regexp against the path only, without the query string; implied if Query is set"`
+	Query        string                `json:"query,omitempty" note:"One of \"preserve\", \"drop\" or \"merge\" to control how the request's query string is added to the destination"`
+	Match        *MatchConditions      `json:"match,omitempty" note:"Conditions which the request must meet, besides matching Regexp"`
+	Destinations []WeightedDestination `json:"destinations,omitempty" note:"Replacements to choose between according to their weights, used instead of Replacement"`
+	Sticky       string                `json:"sticky,omitempty" note:"How to choose between Destinations: \"client_ip\" or \"cookie:<name>\" to choose based on a hash, or empty to choose randomly"`
+	NotBefore    *time.Time            `json:"not_before,omitempty" note:"RFC 3339 time before which this rule is skipped"`
+	NotAfter     *time.Time            `json:"not_after,omitempty" note:"RFC 3339 time from which this rule is skipped"`
+	ID           string                `json:"id,omitempty" note:"Identifies this rule in metrics and logs, instead of its index; must be unique within the domain"`
+	Labels       map[string]string     `json:"labels,omitempty" note:"Free-form labels included in logs and traces"`
 }
 
-// ruleWithPrimitiveValuesForUnmarshalling is used to unmarshal the JSON config file into a Rule.
-// It is not exported because it is only used for unmarshalling.
+const (
+	QueryPreserve = "preserve"
+	QueryDrop     = "drop"
+	QueryMerge    = "merge"
+)
+
+const (
+	ActionRedirect = "redirect"
+	ActionProxy    = "proxy"
+)
+
+// ProxyOptions configures how a request matching a Rule with Action "proxy" is forwarded to its destination.
+type ProxyOptions struct {
+	Timeout         Duration          `json:"timeout,omitempty" note:"Maximum time to wait to connect to the upstream and for its response headers, or no limit if zero; the response body is not limited"`
+	PreserveHost    bool              `json:"preserve_host,omitempty" note:"Send the original Host header upstream, instead of the host of the destination"`
+	XForwarded      bool              `json:"x_forwarded,omitempty" note:"Set X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto on the proxied request"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty" note:"Headers to set on the proxied request; an empty value removes the header"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty" note:"Headers to set on the response from upstream; an empty value removes the header"`
+}
+
+// ruleWithPrimitiveValuesForUnmarshalling is used to unmarshal the JSON config file into a Rule, and to marshal a Rule
+// back into JSON. It is not exported because it is only used for (un)marshalling.
 // It must precisely match the structure of Rule, except that Regexp is a string instead of a *regexp.Regexp.
 type ruleWithPrimitiveValuesForUnmarshalling struct {
-	Regexp      string `json:"regexp"`
-	Replacement string `json:"replacement"`
-	Code        int    `json:"code"`
-	LogHits     bool   `json:"log_hits"`
+	Regexp       string                `json:"regexp"`
+	Replacement  string                `json:"replacement"`
+	Code         int                   `json:"code"`
+	LogHits      bool                  `json:"log_hits"`
+	Action       string                `json:"action,omitempty"`
+	Proxy        *ProxyOptions         `json:"proxy,omitempty"`
+	MatchHost    bool                  `json:"match_host,omitempty"`
+	Template     *Template             `json:"template,omitempty"`
+	MatchPath    bool                  `json:"match_path,omitempty"`
+	Query        string                `json:"query,omitempty"`
+	Match        *MatchConditions      `json:"match,omitempty"`
+	Destinations []WeightedDestination `json:"destinations,omitempty"`
+	Sticky       string                `json:"sticky,omitempty"`
+	NotBefore    *time.Time            `json:"not_before,omitempty"`
+	NotAfter     *time.Time            `json:"not_after,omitempty"`
+	ID           string                `json:"id,omitempty"`
+	Labels       map[string]string     `json:"labels,omitempty"`
 }
 
 func (r *Rule) UnmarshalJSON(data []byte) error {
@@ -63,10 +210,49 @@ func (r *Rule) UnmarshalJSON(data []byte) error {
 	r.Replacement = temp.Replacement
 	r.Code = temp.Code
 	r.LogHits = temp.LogHits
+	r.Action = temp.Action
+	r.Proxy = temp.Proxy
+	r.MatchHost = temp.MatchHost
+	r.Template = temp.Template
+	r.MatchPath = temp.MatchPath
+	r.Query = temp.Query
+	r.Match = temp.Match
+	r.Destinations = temp.Destinations
+	r.Sticky = temp.Sticky
+	r.NotBefore = temp.NotBefore
+	r.NotAfter = temp.NotAfter
+	r.ID = temp.ID
+	r.Labels = temp.Labels
 
 	return nil
 }
 
+func (r Rule) MarshalJSON() ([]byte, error) {
+	temp := ruleWithPrimitiveValuesForUnmarshalling{
+		Replacement:  r.Replacement,
+		Code:         r.Code,
+		LogHits:      r.LogHits,
+		Action:       r.Action,
+		Proxy:        r.Proxy,
+		MatchHost:    r.MatchHost,
+		Template:     r.Template,
+		MatchPath:    r.MatchPath,
+		Query:        r.Query,
+		Match:        r.Match,
+		Destinations: r.Destinations,
+		Sticky:       r.Sticky,
+		NotBefore:    r.NotBefore,
+		NotAfter:     r.NotAfter,
+		ID:           r.ID,
+		Labels:       r.Labels,
+	}
+	if r.Regexp != nil {
+		temp.Regexp = r.Regexp.String()
+	}
+
+	return json.Marshal(temp)
+}
+
 func LoadConfig(file io.Reader, config *Config) []string {
 	var problems []string
 	var origins []string
@@ -80,6 +266,20 @@ func LoadConfig(file io.Reader, config *Config) []string {
 	}
 
 	for origin, domain := range config.Domains {
+		if domain.RedirectMapFile != "" {
+			var redirectMapProblems []string
+			domain.RedirectMap, redirectMapProblems = loadRedirectMapFile(origin, domain.RedirectMapFile)
+			problems = append(problems, redirectMapProblems...)
+			config.Domains[origin] = domain
+		}
+		if domain.AllowCIDRs != nil || domain.DenyCIDRs != nil {
+			var allowProblems, denyProblems []string
+			domain.allowCIDRs, allowProblems = parsePrefixList(fmt.Sprintf("allow_cidrs for domain %s", origin), domain.AllowCIDRs)
+			domain.denyCIDRs, denyProblems = parsePrefixList(fmt.Sprintf("deny_cidrs for domain %s", origin), domain.DenyCIDRs)
+			problems = append(append(problems, allowProblems...), denyProblems...)
+			problems = append(problems, validateAllowList(fmt.Sprintf("allow_cidrs for domain %s", origin), domain.AllowCIDRs)...)
+			config.Domains[origin] = domain
+		}
 		problems = append(problems, validateDomain(origin, domain)...)
 		origins = append(origins, origin)
 	}
@@ -98,6 +298,100 @@ func LoadConfig(file io.Reader, config *Config) []string {
 		validateDefaultResponse(config.DefaultResponse)
 	}
 
+	problems = append(problems, config.validateIDs()...)
+
+	if config.AccessLog != nil {
+		problems = append(problems, validateAccessLog(config.AccessLog)...)
+	}
+	if config.LogPrivacy != nil {
+		problems = append(problems, validateLogPrivacy(config.LogPrivacy)...)
+	}
+	if config.Tracing != nil {
+		problems = append(problems, validateTracing(config.Tracing)...)
+	}
+
+	if config.BlockedResponse != nil {
+		problems = append(problems, validateDefaultResponse(config.BlockedResponse)...)
+	}
+
+	if config.RateLimit != nil {
+		problems = append(problems, validateRateLimit("global rate_limit", config.RateLimit)...)
+	}
+
+	for _, timeout := range []struct {
+		name     string
+		duration Duration
+	}{
+		{"read_timeout", config.ReadTimeout},
+		{"read_header_timeout", config.ReadHeaderTimeout},
+		{"write_timeout", config.WriteTimeout},
+		{"idle_timeout", config.IdleTimeout},
+		{"shutdown_timeout", config.ShutdownTimeout},
+	} {
+		if timeout.duration < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid %s %s. Duration must not be negative.", timeout.name, time.Duration(timeout.duration)))
+		}
+	}
+
+	if config.MaxHeaderBytes < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid max_header_bytes %d. Size must not be negative.", config.MaxHeaderBytes))
+	}
+
+	if config.ConfigWatchInterval < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid config_watch_interval %s. Interval must not be negative.", time.Duration(config.ConfigWatchInterval)))
+	}
+
+	if config.TLSCertificateDir != "" {
+		if info, err := os.Stat(config.TLSCertificateDir); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read tls_certificate_dir: %v", err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("Invalid tls_certificate_dir %s. It must be a directory.", config.TLSCertificateDir))
+		}
+	}
+
+	if config.ACME != nil {
+		problems = append(problems, validateACME(config.ACME)...)
+		problems = append(problems, config.validateACMESubdomains()...)
+		if config.TLSListenAddress == "" {
+			problems = append(problems, "Invalid acme configuration. tls_listen_address must be set to use acme.")
+		}
+	}
+
+	if config.AdminAddress != "" && config.AdminToken == "" {
+		problems = append(problems, "Invalid admin configuration. admin_token must be set to use admin_address.")
+	}
+
+	if config.TrustedProxies != nil {
+		var trustedProxiesProblems []string
+		config.trustedProxies, trustedProxiesProblems = parsePrefixList("trusted_proxies", config.TrustedProxies)
+		problems = append(problems, trustedProxiesProblems...)
+	}
+
+	if config.AllowCIDRs != nil || config.DenyCIDRs != nil {
+		var allowProblems, denyProblems []string
+		config.allowCIDRs, allowProblems = parsePrefixList("allow_cidrs", config.AllowCIDRs)
+		config.denyCIDRs, denyProblems = parsePrefixList("deny_cidrs", config.DenyCIDRs)
+		problems = append(append(problems, allowProblems...), denyProblems...)
+		problems = append(problems, validateAllowList("allow_cidrs", config.AllowCIDRs)...)
+	}
+
+	if config.ProxyProtocol != nil {
+		var proxyProtocolProblems []string
+		config.proxyProtocol, proxyProtocolProblems = parsePrefixList("proxy_protocol", config.ProxyProtocol)
+		problems = append(problems, proxyProtocolProblems...)
+	}
+
+	config.hosts = newHostIndex(config.Domains)
+	config.Warnings = config.scheduleWarnings()
+	if config.ClientIPHeader != "" && config.TrustedProxies == nil {
+		config.Warnings = append(config.Warnings, fmt.Sprintf("client_ip_header %s is ignored because trusted_proxies is not set; set trusted_proxies to the addresses of the proxies which send it", config.ClientIPHeader))
+	}
+
+	// Tests are only meaningful against a config which is otherwise valid
+	if len(problems) == 0 {
+		problems = append(problems, config.runTests()...)
+	}
+
 	return problems
 }
 
@@ -117,6 +411,24 @@ func validateDomain(origin string, domain Domain) []string {
 		validateDefaultResponse(domain.DefaultResponse)
 	}
 
+	problems = append(problems, validateSchedule(fmt.Sprintf("domain %s", origin), domain.NotBefore, domain.NotAfter)...)
+
+	if domain.BlockedResponse != nil {
+		problems = append(problems, validateDefaultResponse(domain.BlockedResponse)...)
+	}
+
+	if domain.RateLimit != nil {
+		problems = append(problems, validateRateLimit(fmt.Sprintf("rate_limit of domain %s", origin), domain.RateLimit)...)
+	}
+
+	if domain.TLSCertificate != nil {
+		if domain.TLSCertificate.CertFile == "" || domain.TLSCertificate.KeyFile == "" {
+			problems = append(problems, fmt.Sprintf("Invalid tls_certificate for domain %s. Both cert_file and key_file must be set.", origin))
+		} else if _, err := tls.LoadX509KeyPair(domain.TLSCertificate.CertFile, domain.TLSCertificate.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to load tls_certificate for domain %s: %v", origin, err))
+		}
+	}
+
 	return problems
 }
 
@@ -132,25 +444,185 @@ func validateDefaultResponse(defaultResponse *DefaultResponse) []string {
 
 func validateRule(origin string, index int, rewriteRule Rule) []string {
 	var problems []string
-	replacementRegex := regexp.MustCompile(`\$(\S+)`)
+	replacementRegex := regexp.MustCompile(`\$(?:\{([^}]*)\}?|(\w*))`)
+	replacementNameRegex := regexp.MustCompile(`^\w+$`)
+
+	location := fmt.Sprintf("domain %s at index %d", origin, index)
+
+	// A rule produces its destination from either Replacement, one of Destinations, or Template
+	replacements := []string{rewriteRule.Replacement}
+	if len(rewriteRule.Destinations) > 0 {
+		replacements = nil
+		for _, destination := range rewriteRule.Destinations {
+			replacements = append(replacements, destination.Replacement)
+		}
+	}
+
+	switch rewriteRule.Action {
+	case "", ActionRedirect:
+		problems = append(problems, validateRedirectCode(location, rewriteRule.Code)...)
+		if rewriteRule.Proxy != nil {
+			problems = append(problems, fmt.Sprintf("Invalid proxy options for %s. Proxy options may only be set if action is '%s'.", location, ActionProxy))
+		}
+	case ActionProxy:
+		if rewriteRule.Code != 0 {
+			problems = append(problems, fmt.Sprintf("Invalid code for %s. Code must not be set if action is '%s'.", location, ActionProxy))
+		}
+		if rewriteRule.Proxy != nil && rewriteRule.Proxy.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid proxy timeout for %s. Timeout must not be negative.", location))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid action '%s' for %s. Action must be '%s' or '%s'.", rewriteRule.Action, location, ActionRedirect, ActionProxy))
+	}
+
+	if rewriteRule.Template == nil {
+		for _, replacement := range replacements {
+			problems = append(problems, validateDestination(location, replacement)...)
+		}
+	}
+
+	if len(rewriteRule.Destinations) > 0 {
+		problems = append(problems, validateWeightedDestinations(location, rewriteRule)...)
+	} else if rewriteRule.Sticky != "" {
+		problems = append(problems, fmt.Sprintf("Invalid sticky for %s. Sticky may only be set if destinations is set.", location))
+	}
+
+	switch rewriteRule.Query {
+	case "", QueryPreserve, QueryDrop, QueryMerge:
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid query mode '%s' for %s. Query mode must be '%s', '%s' or '%s'.", rewriteRule.Query, location, QueryPreserve, QueryDrop, QueryMerge))
+	}
+
+	if rewriteRule.Match != nil {
+		problems = append(problems, validateMatchConditions(location, rewriteRule.Match)...)
+	}
+
+	problems = append(problems, validateSchedule(location, rewriteRule.NotBefore, rewriteRule.NotAfter)...)
+
+	if rewriteRule.Template != nil {
+		if rewriteRule.Replacement != "" {
+			problems = append(problems, fmt.Sprintf("Invalid replacement for %s. Replacement must not be set if template is set.", location))
+		}
+		problems = append(problems, validateTemplate(location, rewriteRule.Regexp, rewriteRule.Template)...)
+		return problems
+	}
+
+	for _, replacement := range replacements {
+		// Drop all "$$" so we're only matching things that aren't literal "$"s in the replacement string. As in
+		// regexp.Expand(), a name is the longest sequence of letters, digits and underscores after the "$", or
+		// anything in braces.
+		matches := replacementRegex.FindAllStringSubmatch(strings.ReplaceAll(replacement, "$$", ""), -1)
+		for _, match := range matches {
+			name := match[2]
+			if strings.HasPrefix(match[0], "${") && strings.HasSuffix(match[0], "}") {
+				name = match[1]
+			}
+
+			if !replacementNameRegex.MatchString(name) {
+				problems = append(problems, fmt.Sprintf("Invalid replacement '%s' for domain %s at index %d. '%s' is not a valid replacement; use $$ for a literal $.", replacement, origin, index, match[0]))
+			} else if group, err := strconv.ParseInt(name, 10, 0); err == nil {
+				if int(group) < 0 || int(group) > rewriteRule.Regexp.NumSubexp() {
+					problems = append(problems, fmt.Sprintf("Invalid replacement '%s' for domain %s at index %d: replacement group $%d does not exist", replacement, origin, index, group))
+				}
+			} else if rewriteRule.Regexp.SubexpIndex(name) < 0 && !isHostVariable(name) {
+				problems = append(problems, fmt.Sprintf("Invalid replacement '%s' for domain %s at index %d: named replacement group ${%s} does not exist", replacement, origin, index, name))
+			}
+		}
+	}
+
+	return problems
+}
+
+func validateACME(acme *ACME) []string {
+	var problems []string
+
+	if !acme.AcceptTOS {
+		problems = append(problems, "Invalid acme configuration. accept_tos must be true to indicate acceptance of the CA's terms of service.")
+	}
 
-	if rewriteRule.Code < 300 || rewriteRule.Code > 399 {
-		problems = append(problems, fmt.Sprintf("Invalid redirect code for domain %s at index %d. Code must be between 300 and 399 inclusive.", origin, index))
+	if acme.CacheDir == "" {
+		problems = append(problems, "Invalid acme configuration. cache_dir must be set.")
 	}
 
-	if !strings.HasPrefix(rewriteRule.Replacement, "http://") && !strings.HasPrefix(rewriteRule.Replacement, "https://") {
-		problems = append(problems, fmt.Sprintf("Invalid replacement for domain %s at index %d. Destination must begin with 'http://' or 'https://'.", origin, index))
+	if acme.DirectoryURL != "" && !strings.HasPrefix(acme.DirectoryURL, "https://") {
+		problems = append(problems, fmt.Sprintf("Invalid acme directory_url %s. It must begin with 'https://'.", acme.DirectoryURL))
 	}
 
-	// Drop all "$$" so we're only matching things that aren't literal "$"s in the replacement string
-	matches := replacementRegex.FindAllString(strings.ReplaceAll(rewriteRule.Replacement, "$$", ""), -1)
-	for _, match := range matches {
-		if replacement, err := strconv.ParseInt(match[1:], 10, 0); err != nil {
-			problems = append(problems, fmt.Sprintf("Invalid replacement '%s' for domain %s at index %d. Only numbered replacements are supported: %v", rewriteRule.Replacement, origin, index, err))
-		} else if int(replacement) < 0 || int(replacement) > rewriteRule.Regexp.NumSubexp() {
-			problems = append(problems, fmt.Sprintf("Invalid replacement '%s' for domain %s at index %d: replacement group $%d does not exist", rewriteRule.Replacement, origin, index, replacement))
+	if acme.CARootFile != "" {
+		if _, err := os.Stat(acme.CARootFile); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read acme ca_root_file: %v", err))
 		}
 	}
 
+	if acme.RenewBefore < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid acme renew_before %s. Duration must not be negative.", time.Duration(acme.RenewBefore)))
+	}
+
+	if (len(acme.DNS01PresentCommand) == 0) != (len(acme.DNS01CleanupCommand) == 0) {
+		problems = append(problems, "Invalid acme configuration. dns_01_present_command and dns_01_cleanup_command must either both be set or both be empty.")
+	}
+
 	return problems
 }
+
+// validateACMESubdomains checks that domains with match_subdomains which would get certificates over ACME can use a
+// wildcard certificate, since certificates are not obtained for individual subdomains.
+func (c *Config) validateACMESubdomains() []string {
+	if len(c.ACME.DNS01PresentCommand) > 0 && len(c.ACME.DNS01CleanupCommand) > 0 {
+		return nil
+	}
+
+	var problems []string
+	for origin, domain := range c.Domains {
+		if !domain.MatchSubdomains || domain.DisableACME || domain.TLSCertificate != nil {
+			continue
+		}
+		if certFile, _, ok := c.CertificateFiles(origin, domain); ok {
+			if _, err := os.Stat(certFile); err == nil {
+				continue
+			}
+		}
+		problems = append(problems, fmt.Sprintf("Invalid acme configuration for domain %s. Domains with match_subdomains can only get certificates over acme if dns_01_present_command and dns_01_cleanup_command are set; otherwise set tls_certificate or disable_acme.", origin))
+	}
+	return problems
+}
+
+// validateRedirect checks the parts of a redirect which do not depend on how its destination is computed.
+// The location should describe where the redirect is defined, e.g. "domain example.com at index 0".
+func validateRedirect(location string, code int, destination string) []string {
+	var problems []string
+
+	problems = append(problems, validateRedirectCode(location, code)...)
+	problems = append(problems, validateDestination(location, destination)...)
+
+	return problems
+}
+
+func validateRedirectCode(location string, code int) []string {
+	if code < 300 || code > 399 {
+		return []string{fmt.Sprintf("Invalid redirect code for %s. Code must be between 300 and 399 inclusive.", location)}
+	}
+	return nil
+}
+
+func validateDestination(location string, destination string) []string {
+	if !strings.HasPrefix(destination, "http://") && !strings.HasPrefix(destination, "https://") {
+		return []string{fmt.Sprintf("Invalid replacement for %s. Destination must begin with 'http://' or 'https://'.", location)}
+	}
+	return nil
+}
+
+// CertificateFiles returns the certificate and key files which should be used for TLS connections to origin.
+// The domain's own tls_certificate takes precedence over tls_certificate_dir. If neither is set, ok is false.
+// The files are not guaranteed to exist.
+func (c *Config) CertificateFiles(origin string, domain Domain) (certFile string, keyFile string, ok bool) {
+	if domain.TLSCertificate != nil {
+		return domain.TLSCertificate.CertFile, domain.TLSCertificate.KeyFile, true
+	}
+
+	if c.TLSCertificateDir != "" {
+		return filepath.Join(c.TLSCertificateDir, origin+".crt"), filepath.Join(c.TLSCertificateDir, origin+".key"), true
+	}
+
+	return "", "", false
+}
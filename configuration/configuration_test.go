@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestLoadConfigOK(t *testing.T) {
@@ -367,8 +368,181 @@ func TestValidateRule(t *testing.T) {
 	rewriteRule.Replacement = "http://example.com/${name}"
 	rewriteRule.Regexp = regexp.MustCompile(`one (?P<name>subpattern) to speak of`)
 	problems = validateRule(origin, index, rewriteRule)
-	if len(problems) != 1 {
-		t.Errorf("Expected 1 problem, but got %d problems: %v", len(problems), problems)
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestValidateRuleNamedReplacements(t *testing.T) {
+	rewriteRule := Rule{
+		Code:   301,
+		Regexp: regexp.MustCompile(`^/(?P<section>[a-z]+)/(?P<slug>[a-z0-9-]+)(/.*)?$`),
+	}
+
+	testCases := []struct {
+		replacement string
+		problems    int
+	}{
+		{"https://example.com/${section}/${slug}", 0},
+		{"https://example.com/$section/${slug}$3", 0},
+		{"https://example.com/${slug}/${1}/$2", 0},
+		{"https://example.com/$1/$2", 0},
+		{"https://example.com/$$slug/$${missing}", 0},
+		{"https://example.com/$$${slug}", 0},
+		{"https://example.com/${missing}", 1},
+		{"https://example.com/$slugs", 1},
+		{"https://example.com/$1x", 1},
+		{"https://example.com/${4}", 1},
+		{"https://example.com/${slug", 1},
+		{"https://example.com/${sl-ug}", 1},
+		{"https://example.com/$/${slug}", 1},
+		{"https://${subdomain}.example.com/${host}/$host/$subdomain", 0},
+		{"https://example.com/${hostname}", 1},
+	}
+
+	for _, testCase := range testCases {
+		rewriteRule.Replacement = testCase.replacement
+		if problems := validateRule("example.com", 0, rewriteRule); len(problems) != testCase.problems {
+			t.Errorf("Expected %d problems for replacement '%s', but got %d problems: %v", testCase.problems, testCase.replacement, len(problems), problems)
+		}
+	}
+}
+
+func TestValidateProxyRule(t *testing.T) {
+	origin := "example.com"
+	index := 0
+	rewriteRule := Rule{
+		Action:      ActionProxy,
+		Replacement: "http://upstream.example.com",
+		Regexp:      regexp.MustCompile("pattern"),
+	}
+
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Proxy = &ProxyOptions{Timeout: Duration(time.Second)}
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Proxy.Timeout = Duration(-time.Second)
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (negative timeout), but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Proxy = nil
+	rewriteRule.Code = 301
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (code set on proxy rule), but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Code = 0
+	rewriteRule.Replacement = "upstream.example.com"
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (invalid destination), but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Action = ActionRedirect
+	rewriteRule.Code = 301
+	rewriteRule.Replacement = "http://www.example.com"
+	rewriteRule.Proxy = &ProxyOptions{}
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (proxy options on redirect rule), but got %d problems: %v", len(problems), problems)
+	}
+
+	rewriteRule.Action = "rewrite"
+	rewriteRule.Proxy = nil
+	if problems := validateRule(origin, index, rewriteRule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (unknown action), but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestLoadConfigTLS(t *testing.T) {
+	jsonData := []byte(`{
+		"tls_listen_address": ":8443",
+		"tls_certificate_dir": "/does/not/exist",
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"tls_certificate": {"cert_file": "/does/not/exist.crt", "key_file": "/does/not/exist.key"}
+			},
+			"example.net": {
+				"tls_certificate": {"cert_file": "/does/not/exist.crt"}
+			}
+		}
+	}`)
+
+	config := &Config{}
+	if problems := LoadConfig(bytes.NewReader(jsonData), config); len(problems) != 3 {
+		t.Errorf("Expected 3 problems (missing directory, missing certificate, missing key_file), but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestValidateACME(t *testing.T) {
+	acme := &ACME{AcceptTOS: true, CacheDir: "/var/cache/redirector"}
+	if problems := validateACME(acme); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	acme.DirectoryURL = "http://localhost:14000/dir"
+	if problems := validateACME(acme); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (directory_url not https), but got %d problems: %v", len(problems), problems)
+	}
+
+	acme.DirectoryURL = ""
+	acme.DNS01PresentCommand = []string{"/usr/local/bin/add-txt-record"}
+	if problems := validateACME(acme); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (no cleanup command), but got %d problems: %v", len(problems), problems)
+	}
+
+	acme.DNS01CleanupCommand = []string{"/usr/local/bin/remove-txt-record"}
+	if problems := validateACME(acme); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	if problems := validateACME(&ACME{CARootFile: "/does/not/exist.pem", RenewBefore: Duration(-time.Hour)}); len(problems) != 4 {
+		t.Errorf("Expected 4 problems (accept_tos not set, no cache_dir, missing ca_root_file, negative renew_before), but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestValidateACMESubdomains(t *testing.T) {
+	config := &Config{
+		ACME: &ACME{AcceptTOS: true, CacheDir: "/var/cache/redirector"},
+		Domains: map[string]Domain{
+			"example.com":      {MatchSubdomains: true},
+			"example.net":      {},
+			"example.org":      {MatchSubdomains: true, DisableACME: true},
+			"internal.example": {MatchSubdomains: true, TLSCertificate: &TLSCertificate{CertFile: "own.crt", KeyFile: "own.key"}},
+		},
+	}
+
+	problems := config.validateACMESubdomains()
+	if len(problems) != 1 || !bytes.Contains([]byte(problems[0]), []byte("domain example.com.")) {
+		t.Errorf("Expected 1 problem (match_subdomains for example.com without DNS-01), but got %d problems: %v", len(problems), problems)
+	}
+
+	config.ACME.DNS01PresentCommand = []string{"/usr/local/bin/add-txt-record"}
+	config.ACME.DNS01CleanupCommand = []string{"/usr/local/bin/remove-txt-record"}
+	if problems := config.validateACMESubdomains(); len(problems) != 0 {
+		t.Errorf("Expected no problems with DNS-01 commands set, but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestCertificateFiles(t *testing.T) {
+	config := &Config{}
+	if _, _, ok := config.CertificateFiles("example.com", Domain{}); ok {
+		t.Errorf("Expected no certificate files when none configured")
+	}
+
+	config.TLSCertificateDir = "/certs"
+	if certFile, keyFile, ok := config.CertificateFiles("example.com", Domain{}); !ok || certFile != "/certs/example.com.crt" || keyFile != "/certs/example.com.key" {
+		t.Errorf("Expected certificate files from tls_certificate_dir, but got %s and %s (ok = %t)", certFile, keyFile, ok)
+	}
+
+	domain := Domain{TLSCertificate: &TLSCertificate{CertFile: "own.crt", KeyFile: "own.key"}}
+	if certFile, keyFile, ok := config.CertificateFiles("example.com", domain); !ok || certFile != "own.crt" || keyFile != "own.key" {
+		t.Errorf("Expected domain's own certificate files, but got %s and %s (ok = %t)", certFile, keyFile, ok)
 	}
 }
 
@@ -395,3 +569,56 @@ func TestRuleTypeMatchesRuleWithPrimitiveValuesForUnmarshalling(t *testing.T) {
 	}
 
 }
+
+func TestUnmarshalDuration(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalJSON([]byte(`"1m30s"`)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if time.Duration(d) != 90*time.Second {
+		t.Errorf("Expected duration to be %s, but got %s", 90*time.Second, time.Duration(d))
+	}
+
+	if err := d.UnmarshalJSON([]byte(`"ninety seconds"`)); err == nil {
+		t.Errorf("Expected error parsing invalid duration but got none")
+	}
+
+	if err := d.UnmarshalJSON([]byte(`90`)); err == nil {
+		t.Errorf("Expected error parsing non-string duration but got none")
+	}
+}
+
+func TestLoadConfigServerSettings(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(bytes.NewReader([]byte(`{
+		"default_response": {"code": 421},
+		"domains": {},
+		"read_timeout": "30s",
+		"read_header_timeout": "5s",
+		"write_timeout": "1m",
+		"idle_timeout": "90s",
+		"max_header_bytes": 8192,
+		"shutdown_timeout": "20s"
+	}`)), config)
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	if time.Duration(config.ReadHeaderTimeout) != 5*time.Second || config.MaxHeaderBytes != 8192 || time.Duration(config.ShutdownTimeout) != 20*time.Second {
+		t.Errorf("Expected server settings to be loaded, but got %+v", config)
+	}
+
+	config = &Config{}
+	problems = LoadConfig(bytes.NewReader([]byte(`{
+		"default_response": {"code": 421},
+		"domains": {},
+		"read_timeout": "-1s",
+		"read_header_timeout": "-1s",
+		"write_timeout": "-1s",
+		"idle_timeout": "-1s",
+		"max_header_bytes": -1,
+		"shutdown_timeout": "-1s"
+	}`)), config)
+	if len(problems) != 6 {
+		t.Errorf("Expected 6 problems, but got %d problems: %v", len(problems), problems)
+	}
+}
@@ -0,0 +1,100 @@
+package configuration
+
+import "strings"
+
+// hostIndex maps a Host header to the origin of the Domain it matches, without iterating over every domain.
+// Exact matches are found in a map, and match_subdomains domains are found by walking a trie of reversed labels
+// (e.g. "www.example.com" is looked up as "com", "example", "www").
+type hostIndex struct {
+	exact    map[string]string
+	suffixes *hostIndexNode
+}
+
+type hostIndexNode struct {
+	children map[string]*hostIndexNode
+	// origin is set if a domain with match_subdomains ends at this node
+	origin string
+}
+
+func newHostIndex(domains map[string]Domain) *hostIndex {
+	index := &hostIndex{
+		exact:    make(map[string]string, len(domains)),
+		suffixes: &hostIndexNode{},
+	}
+
+	for origin, domain := range domains {
+		key := strings.ToLower(origin)
+		index.exact[key] = origin
+
+		if !domain.MatchSubdomains {
+			continue
+		}
+
+		node := index.suffixes
+		for rest := key; rest != ""; {
+			var label string
+			if dot := strings.LastIndexByte(rest, '.'); dot >= 0 {
+				label, rest = rest[dot+1:], rest[:dot]
+			} else {
+				label, rest = rest, ""
+			}
+
+			if node.children == nil {
+				node.children = map[string]*hostIndexNode{}
+			}
+			if node.children[label] == nil {
+				node.children[label] = &hostIndexNode{}
+			}
+			node = node.children[label]
+		}
+		node.origin = origin
+	}
+
+	return index
+}
+
+// lookup returns the origin matching host. An exact match always takes precedence; otherwise the longest
+// match_subdomains domain of which host is a subdomain is used.
+func (i *hostIndex) lookup(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if origin, ok := i.exact[host]; ok {
+		return origin, true
+	}
+
+	matched := ""
+	node := i.suffixes
+	rest := host
+	for node != nil {
+		dot := strings.LastIndexByte(rest, '.')
+		if dot < 0 {
+			// Only one label remains, so any domain ending at the next node would be an exact match, not a subdomain
+			break
+		}
+
+		node = node.children[rest[dot+1:]]
+		rest = rest[:dot]
+		if node != nil && node.origin != "" {
+			matched = node.origin
+		}
+	}
+
+	return matched, matched != ""
+}
+
+// MatchDomain finds the Domain which should handle requests for host. An exact match always takes precedence;
+// otherwise the longest domain with match_subdomains set of which host is a subdomain is used.
+//
+// LoadConfig() builds an index for efficient lookups. If config was not created by LoadConfig(), a temporary index
+// is built on every call, which gives the same results but much more slowly.
+func (c *Config) MatchDomain(host string) (string, Domain, bool) {
+	index := c.hosts
+	if index == nil {
+		index = newHostIndex(c.Domains)
+	}
+
+	origin, ok := index.lookup(host)
+	if !ok {
+		return "", Domain{}, false
+	}
+	return origin, c.Domains[origin], true
+}
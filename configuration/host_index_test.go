@@ -0,0 +1,121 @@
+package configuration
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMatchDomain(t *testing.T) {
+	config := &Config{
+		Domains: map[string]Domain{
+			"example.com":            {MatchSubdomains: true},
+			"example.net":            {},
+			"deep.example.org":       {MatchSubdomains: true},
+			"example.org":            {MatchSubdomains: true},
+			"exact.deep.example.org": {},
+			"example.com:8080":       {MatchSubdomains: true},
+		},
+	}
+
+	testCases := []struct {
+		host   string
+		origin string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"a.b.example.com", "example.com"},
+		{"notexample.com", ""},
+		{"com", ""},
+		{"example.net", "example.net"},
+		{"www.example.net", ""},
+		{"example.org", "example.org"},
+		{"www.example.org", "example.org"},
+		{"deep.example.org", "deep.example.org"},
+		{"www.deep.example.org", "deep.example.org"},
+		{"exact.deep.example.org", "exact.deep.example.org"},
+		{"www.exact.deep.example.org", "deep.example.org"},
+		{"example.com:8080", "example.com:8080"},
+		{"www.example.com:8080", "example.com:8080"},
+		{"www.example.com:8081", ""},
+		{"", ""},
+	}
+
+	// Check both the index built by LoadConfig() and the fallback for configs which were built by hand
+	indexed := &Config{Domains: config.Domains, hosts: newHostIndex(config.Domains)}
+
+	for _, c := range []*Config{config, indexed} {
+		for _, testCase := range testCases {
+			origin, _, ok := c.MatchDomain(testCase.host)
+			if origin != testCase.origin || ok != (testCase.origin != "") {
+				t.Errorf("Expected host '%s' to match origin '%s', but got '%s' (ok = %t)", testCase.host, testCase.origin, origin, ok)
+			}
+		}
+	}
+}
+
+func TestMatchDomainReturnsDomain(t *testing.T) {
+	config := &Config{
+		Domains: map[string]Domain{
+			"example.com": {MatchSubdomains: true, DefaultResponse: &DefaultResponse{Code: 410}},
+		},
+	}
+
+	if _, domain, ok := config.MatchDomain("www.example.com"); !ok || domain.DefaultResponse == nil || domain.DefaultResponse.Code != 410 {
+		t.Errorf("Expected to match domain example.com, but got %v (ok = %t)", domain, ok)
+	}
+}
+
+func makeBenchmarkDomains(count int) map[string]Domain {
+	domains := make(map[string]Domain, count)
+	for i := 0; i < count; i++ {
+		domains[fmt.Sprintf("domain-%d.example.com", i)] = Domain{MatchSubdomains: i%2 == 0}
+	}
+	return domains
+}
+
+// linearMatchDomain is the approach used before hostIndex, kept for comparison in benchmarks
+func linearMatchDomain(domains map[string]Domain, host string) (string, bool) {
+	for origin, domain := range domains {
+		if strings.EqualFold(host, origin) || (domain.MatchSubdomains && strings.HasSuffix(strings.ToLower(host), "."+origin)) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func benchmarkHosts(count int) []string {
+	return []string{
+		fmt.Sprintf("domain-%d.example.com", count/2),
+		fmt.Sprintf("www.domain-%d.example.com", count/2),
+		"not-configured.example.net",
+	}
+}
+
+func BenchmarkMatchDomainIndexed(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		domains := makeBenchmarkDomains(count)
+		config := &Config{Domains: domains, hosts: newHostIndex(domains)}
+		hosts := benchmarkHosts(count)
+
+		b.Run(fmt.Sprintf("domains=%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				config.MatchDomain(hosts[i%len(hosts)])
+			}
+		})
+	}
+}
+
+func BenchmarkMatchDomainLinear(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		domains := makeBenchmarkDomains(count)
+		hosts := benchmarkHosts(count)
+
+		b.Run(fmt.Sprintf("domains=%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearMatchDomain(domains, hosts[i%len(hosts)])
+			}
+		})
+	}
+}
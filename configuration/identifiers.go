@@ -0,0 +1,127 @@
+package configuration
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// reservedIDs are used by redirector itself as rule_index values, so may not be used as ids.
+var reservedIDs = map[string]bool{
+	"default":      true,
+	"redirect_map": true,
+	"blocked":      true,
+	"rate_limited": true,
+}
+
+var (
+	idRegex        = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]*$`)
+	labelNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Label returns the rule's id, or its index if it has no id.
+func (r *Rule) Label(index int) string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return strconv.Itoa(index)
+}
+
+// Label returns the response's id, or fallback (e.g. "default") if it has no id.
+func (d *DefaultResponse) Label(fallback string) string {
+	if d != nil && d.ID != "" {
+		return d.ID
+	}
+	return fallback
+}
+
+// identified is anything which may have an id and labels, and where it is in the config.
+type identified struct {
+	location string
+	id       string
+	labels   map[string]string
+}
+
+// validateIDs checks that ids and labels are valid, and that each id is used only once in each domain. Ids of the
+// global responses must not be used by any domain, since those responses may be sent for requests to any domain.
+func (c *Config) validateIDs() []string {
+	var problems []string
+
+	var global []identified
+	if c.DefaultResponse != nil {
+		global = append(global, identified{"default_response", c.DefaultResponse.ID, c.DefaultResponse.Labels})
+	}
+	if c.BlockedResponse != nil {
+		global = append(global, identified{"blocked_response", c.BlockedResponse.ID, c.BlockedResponse.Labels})
+	}
+	if c.RateLimit != nil && c.RateLimit.Response != nil {
+		global = append(global, identified{"response of global rate_limit", c.RateLimit.Response.ID, c.RateLimit.Response.Labels})
+	}
+	problems = append(problems, checkIdentified(global, nil)...)
+
+	origins := make([]string, 0, len(c.Domains))
+	for origin := range c.Domains {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	for _, origin := range origins {
+		domain := c.Domains[origin]
+
+		var items []identified
+		for index, rule := range domain.RewriteRules {
+			items = append(items, identified{fmt.Sprintf("rule for domain %s at index %d", origin, index), rule.ID, rule.Labels})
+		}
+		if domain.DefaultResponse != nil {
+			items = append(items, identified{fmt.Sprintf("default_response of domain %s", origin), domain.DefaultResponse.ID, domain.DefaultResponse.Labels})
+		}
+		if domain.BlockedResponse != nil {
+			items = append(items, identified{fmt.Sprintf("blocked_response of domain %s", origin), domain.BlockedResponse.ID, domain.BlockedResponse.Labels})
+		}
+		if domain.RateLimit != nil && domain.RateLimit.Response != nil {
+			items = append(items, identified{fmt.Sprintf("response of rate_limit of domain %s", origin), domain.RateLimit.Response.ID, domain.RateLimit.Response.Labels})
+		}
+		problems = append(problems, checkIdentified(items, global)...)
+	}
+
+	return problems
+}
+
+// checkIdentified validates each of items, and checks that no id is used twice in items, or is used in items and
+// already.
+func checkIdentified(items []identified, already []identified) []string {
+	var problems []string
+
+	seen := map[string]string{}
+	for _, item := range already {
+		if _, ok := seen[item.id]; item.id != "" && !ok {
+			seen[item.id] = item.location
+		}
+	}
+
+	for _, item := range items {
+		for name := range item.labels {
+			if !labelNameRegex.MatchString(name) {
+				problems = append(problems, fmt.Sprintf("Invalid label name '%s' for %s. Label names must start with a letter or underscore, and contain only letters, digits and underscores.", name, item.location))
+			}
+		}
+
+		if item.id == "" {
+			continue
+		}
+		if !idRegex.MatchString(item.id) {
+			problems = append(problems, fmt.Sprintf("Invalid id '%s' for %s. Ids must start with a letter or digit, and contain only letters, digits and the characters _.:/-.", item.id, item.location))
+		} else if _, err := strconv.Atoi(item.id); err == nil || reservedIDs[item.id] {
+			problems = append(problems, fmt.Sprintf("Invalid id '%s' for %s. Ids must not be a number, 'default', 'redirect_map', 'blocked' or 'rate_limited'.", item.id, item.location))
+		}
+
+		if other, ok := seen[item.id]; ok {
+			problems = append(problems, fmt.Sprintf("Duplicate id '%s' for %s. It is already used by %s.", item.id, item.location, other))
+		} else {
+			seen[item.id] = item.location
+		}
+	}
+
+	return problems
+}
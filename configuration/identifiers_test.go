@@ -0,0 +1,117 @@
+package configuration
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const identifiersTestConfig = `{
+	"default_response": {"code": 421, "id": "unknown-host"},
+	"domains": {
+		"example.com": {
+			"rewrites": [
+				{"regexp": "^/old(.*)$", "replacement": "https://example.com/new$1", "code": 301, "id": "old-pages", "labels": {"team": "web"}},
+				{"regexp": "^/blog(.*)$", "replacement": "https://blog.example.com$1", "code": 302}
+			],
+			"default_response": {"code": 404, "id": "not-found", "labels": {"team": "web"}}
+		},
+		"example.net": {
+			"rewrites": [
+				{"regexp": "^(.*)$", "replacement": "https://example.com$1", "code": 301, "id": "old-pages"}
+			]
+		}
+	}
+}`
+
+func TestRuleLabelWithIDs(t *testing.T) {
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(identifiersTestConfig), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url    string
+		label  string
+		labels map[string]string
+	}{
+		{"https://example.com/old/page", "old-pages", map[string]string{"team": "web"}},
+		{"https://example.com/blog/post", "1", nil},
+		{"https://example.com/other", "not-found", map[string]string{"team": "web"}},
+		{"https://example.net/", "old-pages", nil},
+		{"https://example.org/", "unknown-host", nil},
+	}
+
+	for _, testCase := range testCases {
+		resolution := config.Resolve(httptest.NewRequest("", testCase.url, nil))
+		if label := resolution.RuleLabel(); label != testCase.label {
+			t.Errorf("Expected %s to have rule label '%s', but got '%s'", testCase.url, testCase.label, label)
+		}
+		if labels := resolution.Labels(); len(labels) != len(testCase.labels) || labels["team"] != testCase.labels["team"] {
+			t.Errorf("Expected %s to have labels %v, but got %v", testCase.url, testCase.labels, labels)
+		}
+	}
+}
+
+func TestLoadConfigIDs(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421, "id": "fallback"},
+		"blocked_response": {"code": 403, "id": "fallback"},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{"regexp": "^/a", "replacement": "https://example.net/a", "code": 301, "id": "same"},
+					{"regexp": "^/b", "replacement": "https://example.net/b", "code": 301, "id": "same"},
+					{"regexp": "^/c", "replacement": "https://example.net/c", "code": 301, "id": "3"},
+					{"regexp": "^/d", "replacement": "https://example.net/d", "code": 301, "id": "default"},
+					{"regexp": "^/e", "replacement": "https://example.net/e", "code": 301, "id": "has space", "labels": {"not-valid": "x"}}
+				],
+				"default_response": {"code": 404, "id": "fallback"}
+			}
+		}
+	}`), config)
+
+	expected := []string{
+		"Duplicate id 'fallback' for blocked_response. It is already used by default_response.",
+		"Duplicate id 'same' for rule for domain example.com at index 1. It is already used by rule for domain example.com at index 0.",
+		"Invalid id '3' for rule for domain example.com at index 2.",
+		"Invalid id 'default' for rule for domain example.com at index 3.",
+		"Invalid id 'has space' for rule for domain example.com at index 4.",
+		"Invalid label name 'not-valid' for rule for domain example.com at index 4.",
+		"Duplicate id 'fallback' for default_response of domain example.com. It is already used by default_response.",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %d problems: %v", len(expected), len(problems), problems)
+	}
+	for _, substring := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem, substring) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a problem containing '%s', but got %v", substring, problems)
+		}
+	}
+}
+
+func TestRuleIDRoundTrip(t *testing.T) {
+	var rule Rule
+	if err := json.Unmarshal([]byte(`{"regexp": "^/", "replacement": "https://example.com/", "code": 301, "id": "home", "labels": {"team": "web"}}`), &rule); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if rule.ID != "home" || rule.Labels["team"] != "web" {
+		t.Errorf("Expected id and labels to be unmarshalled, but got id '%s' and labels %v", rule.ID, rule.Labels)
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !strings.Contains(string(data), `"id":"home"`) || !strings.Contains(string(data), `"labels":{"team":"web"}`) {
+		t.Errorf("Expected id and labels to be marshalled, but got %s", data)
+	}
+}
@@ -0,0 +1,177 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// MatchConditions restricts a Rule to requests with particular properties besides the request URI. All conditions
+// which are set must match.
+type MatchConditions struct {
+	Methods []string                  `json:"methods,omitempty" note:"The request method must be one of these"`
+	Headers map[string]*regexp.Regexp `json:"headers,omitempty" note:"The header must be present, and one of its values must match the regexp"`
+	Cookies map[string]*regexp.Regexp `json:"cookies,omitempty" note:"The cookie must be present, and its value must match the regexp (which may be empty to match any value)"`
+	Scheme  string                    `json:"scheme,omitempty" note:"Either \"http\" or \"https\"; taken from X-Forwarded-Proto if present and sent by one of trusted_proxies"`
+}
+
+// matchConditionsWithPrimitiveValuesForUnmarshalling is used to (un)marshal MatchConditions, in the same way as
+// ruleWithPrimitiveValuesForUnmarshalling. It must precisely match the structure of MatchConditions, except that
+// regexps are strings.
+type matchConditionsWithPrimitiveValuesForUnmarshalling struct {
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Cookies map[string]string `json:"cookies,omitempty"`
+	Scheme  string            `json:"scheme,omitempty"`
+}
+
+func (m *MatchConditions) UnmarshalJSON(data []byte) error {
+	var temp matchConditionsWithPrimitiveValuesForUnmarshalling
+
+	err := json.Unmarshal(data, &temp)
+	if err != nil {
+		return err
+	}
+
+	if m.Headers, err = compileRegexpMap("header", temp.Headers); err != nil {
+		return err
+	}
+	if m.Cookies, err = compileRegexpMap("cookie", temp.Cookies); err != nil {
+		return err
+	}
+
+	m.Methods = temp.Methods
+	m.Scheme = temp.Scheme
+
+	return nil
+}
+
+func (m MatchConditions) MarshalJSON() ([]byte, error) {
+	temp := matchConditionsWithPrimitiveValuesForUnmarshalling{
+		Methods: m.Methods,
+		Headers: regexpMapStrings(m.Headers),
+		Cookies: regexpMapStrings(m.Cookies),
+		Scheme:  m.Scheme,
+	}
+
+	return json.Marshal(temp)
+}
+
+func compileRegexpMap(kind string, patterns map[string]string) (map[string]*regexp.Regexp, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+
+	compiled := make(map[string]*regexp.Regexp, len(patterns))
+	for name, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp for %s %s: %w", kind, name, err)
+		}
+		compiled[name] = re
+	}
+	return compiled, nil
+}
+
+func regexpMapStrings(compiled map[string]*regexp.Regexp) map[string]string {
+	if compiled == nil {
+		return nil
+	}
+
+	patterns := make(map[string]string, len(compiled))
+	for name, re := range compiled {
+		patterns[name] = re.String()
+	}
+	return patterns
+}
+
+func validateMatchConditions(location string, match *MatchConditions) []string {
+	var problems []string
+
+	methodRegex := regexp.MustCompile("^[A-Za-z]+$")
+	for _, method := range match.Methods {
+		if !methodRegex.MatchString(method) {
+			problems = append(problems, fmt.Sprintf("Invalid match method '%s' for %s.", method, location))
+		}
+	}
+
+	for header := range match.Headers {
+		if header == "" {
+			problems = append(problems, fmt.Sprintf("Invalid match header for %s. Header names must not be empty.", location))
+		}
+	}
+
+	for cookie := range match.Cookies {
+		if cookie == "" {
+			problems = append(problems, fmt.Sprintf("Invalid match cookie for %s. Cookie names must not be empty.", location))
+		}
+	}
+
+	if match.Scheme != "" && match.Scheme != "http" && match.Scheme != "https" {
+		problems = append(problems, fmt.Sprintf("Invalid match scheme '%s' for %s. Scheme must be 'http' or 'https'.", match.Scheme, location))
+	}
+
+	return problems
+}
+
+// Matches reports whether req meets all the conditions in m.
+func (m *MatchConditions) Matches(req *http.Request) bool {
+	if len(m.Methods) > 0 {
+		found := false
+		for _, method := range m.Methods {
+			if strings.EqualFold(method, req.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for header, re := range m.Headers {
+		found := false
+		for _, value := range req.Header.Values(header) {
+			if re.MatchString(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for name, re := range m.Cookies {
+		cookie, err := req.Cookie(name)
+		if err != nil || !re.MatchString(cookie.Value) {
+			return false
+		}
+	}
+
+	if m.Scheme != "" && !strings.EqualFold(m.Scheme, requestScheme(req)) {
+		return false
+	}
+
+	return true
+}
+
+// requestScheme returns the scheme from the first X-Forwarded-Proto header if present, or otherwise "https" if the
+// request was made over TLS. The server removes X-Forwarded-Proto from requests which were not sent by one of
+// trusted_proxies, so it can be believed here. Requests which were not received by a server (e.g. from `redirector
+// test`) use the scheme of their URL.
+func requestScheme(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+		scheme, _, _ := strings.Cut(forwarded, ",")
+		return strings.ToLower(strings.TrimSpace(scheme))
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	return "http"
+}
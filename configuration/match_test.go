@@ -0,0 +1,175 @@
+package configuration
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMatchConditionsTypeMatchesMatchConditionsWithPrimitiveValuesForUnmarshalling(t *testing.T) {
+	simple := reflect.TypeOf(matchConditionsWithPrimitiveValuesForUnmarshalling{})
+	actual := reflect.TypeOf(MatchConditions{})
+
+	if actual.NumField() != simple.NumField() {
+		t.Errorf("MatchConditions has %d fields, but matchConditionsWithPrimitiveValuesForUnmarshalling has %d fields; they should precisely match", actual.NumField(), simple.NumField())
+		return
+	}
+
+	for idx := 0; idx < actual.NumField(); idx++ {
+		field := actual.Field(idx)
+		if field.Name != simple.Field(idx).Name {
+			t.Errorf("Field at index %d of matchConditionsWithPrimitiveValuesForUnmarshalling has name %s, but should have name %s to match MatchConditions", idx, simple.Field(idx).Name, field.Name)
+		} else if field.Type == reflect.TypeOf(map[string]*regexp.Regexp{}) {
+			if simple.Field(idx).Type != reflect.TypeOf(map[string]string{}) {
+				t.Errorf("Field %s of matchConditionsWithPrimitiveValuesForUnmarshalling has type %s, but should be a map[string]string to match MatchConditions' map[string]*regexp.Regexp", simple.Field(idx).Name, simple.Field(idx).Type)
+			}
+		} else if field.Type != simple.Field(idx).Type {
+			t.Errorf("Field %s of matchConditionsWithPrimitiveValuesForUnmarshalling has type %s, but should have type %s to match MatchConditions", simple.Field(idx).Name, simple.Field(idx).Type, field.Type)
+		}
+	}
+}
+
+func TestUnmarshalMatchConditions(t *testing.T) {
+	match := &MatchConditions{}
+	err := json.Unmarshal([]byte(`{"methods": ["GET", "head"], "headers": {"User-Agent": "(?i)mobile"}, "cookies": {"beta": ""}, "scheme": "https"}`), match)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal match conditions: %v", err)
+	}
+
+	if len(match.Methods) != 2 || match.Headers["User-Agent"].String() != "(?i)mobile" || match.Cookies["beta"].String() != "" || match.Scheme != "https" {
+		t.Errorf("Expected match conditions to be unmarshalled, but got %+v", match)
+	}
+
+	data, err := json.Marshal(match)
+	if err != nil || string(data) != `{"methods":["GET","head"],"headers":{"User-Agent":"(?i)mobile"},"cookies":{"beta":""},"scheme":"https"}` {
+		t.Errorf("Expected match conditions to be marshalled back to the original, but got %s (error: %v)", data, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"headers": {"User-Agent": "(unterminated"}}`), &MatchConditions{}); err == nil {
+		t.Errorf("Expected error for invalid header regexp, but got none")
+	}
+
+	if err := json.Unmarshal([]byte(`{"cookies": {"beta": "(unterminated"}}`), &MatchConditions{}); err == nil {
+		t.Errorf("Expected error for invalid cookie regexp, but got none")
+	}
+}
+
+func TestValidateMatchConditions(t *testing.T) {
+	valid := &MatchConditions{
+		Methods: []string{"GET", "post"},
+		Headers: map[string]*regexp.Regexp{"Accept-Language": regexp.MustCompile("^fr")},
+		Cookies: map[string]*regexp.Regexp{"beta": regexp.MustCompile("")},
+		Scheme:  "http",
+	}
+	if problems := validateMatchConditions("domain example.com at index 0", valid); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	invalid := &MatchConditions{
+		Methods: []string{"GET POST"},
+		Headers: map[string]*regexp.Regexp{"": regexp.MustCompile("")},
+		Cookies: map[string]*regexp.Regexp{"": regexp.MustCompile("")},
+		Scheme:  "ftp",
+	}
+	if problems := validateMatchConditions("domain example.com at index 0", invalid); len(problems) != 4 {
+		t.Errorf("Expected 4 problems (method, header, cookie, scheme), but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestMatchConditionsMatches(t *testing.T) {
+	match := &MatchConditions{}
+	if err := json.Unmarshal([]byte(`{"methods": ["GET", "head"], "headers": {"User-Agent": "(?i)mobile"}, "cookies": {"beta": "^(1|yes)$"}, "scheme": "https"}`), match); err != nil {
+		t.Fatalf("Unable to unmarshal match conditions: %v", err)
+	}
+
+	makeRequest := func(method string, userAgent string, cookie string, forwardedProto string) *http.Request {
+		req := httptest.NewRequest(method, "http://example.com/", nil)
+		req.TLS = &tls.ConnectionState{}
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		if forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", forwardedProto)
+		}
+		return req
+	}
+
+	testCases := []struct {
+		description string
+		req         *http.Request
+		expected    bool
+	}{
+		{"all conditions met", makeRequest("GET", "Some Mobile Browser", "beta=1", ""), true},
+		{"method case insensitive", makeRequest("HEAD", "Some Mobile Browser", "a=b; beta=yes", ""), true},
+		{"wrong method", makeRequest("POST", "Some Mobile Browser", "beta=1", ""), false},
+		{"header does not match", makeRequest("GET", "Desktop Browser", "beta=1", ""), false},
+		{"header missing", makeRequest("GET", "", "beta=1", ""), false},
+		{"cookie does not match", makeRequest("GET", "Some Mobile Browser", "beta=0", ""), false},
+		{"cookie missing", makeRequest("GET", "Some Mobile Browser", "alpha=1", ""), false},
+		{"forwarded proto https", makeRequest("GET", "Some Mobile Browser", "beta=1", "HTTPS, http"), true},
+		{"forwarded proto http", makeRequest("GET", "Some Mobile Browser", "beta=1", "http"), false},
+	}
+
+	for _, testCase := range testCases {
+		if result := match.Matches(testCase.req); result != testCase.expected {
+			t.Errorf("Expected match for %s to be %t, but got %t", testCase.description, testCase.expected, result)
+		}
+	}
+
+	plainHTTP := makeRequest("GET", "Some Mobile Browser", "beta=1", "")
+	plainHTTP.TLS = nil
+	if match.Matches(plainHTTP) {
+		t.Errorf("Expected request without TLS or X-Forwarded-Proto not to match scheme https")
+	}
+}
+
+func TestResolveMatchConditions(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{"regexp": "^/(.*)$", "replacement": "https://m.example.com/$1", "code": 302, "match": {"headers": {"User-Agent": "(?i)mobile"}}},
+					{"regexp": "^/(.*)$", "replacement": "https://example.com/fr/$1", "code": 302, "match": {"headers": {"Accept-Language": "^fr"}, "methods": ["GET"]}},
+					{"regexp": "^/(.*)$", "replacement": "https://example.com/$1", "code": 301, "match": {"scheme": "http"}}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		method      string
+		url         string
+		headers     map[string]string
+		destination string
+	}{
+		{"GET", "http://example.com/a", map[string]string{"User-Agent": "Mobile Safari"}, "https://m.example.com/a"},
+		{"GET", "http://example.com/a", map[string]string{"Accept-Language": "fr-CA"}, "https://example.com/fr/a"},
+		{"POST", "http://example.com/a", map[string]string{"Accept-Language": "fr-CA"}, "https://example.com/a"},
+		{"GET", "http://example.com/a", map[string]string{"Accept-Language": "en"}, "https://example.com/a"},
+		{"GET", "https://example.com/a", map[string]string{"X-Forwarded-Proto": "https"}, ""},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, testCase.url, nil)
+		for name, value := range testCase.headers {
+			req.Header.Set(name, value)
+		}
+		if resolution := config.Resolve(req); resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s %s with headers %v to have destination '%s', but got '%s'", testCase.method, testCase.url, testCase.headers, testCase.destination, resolution.Destination)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package configuration
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogPrivacy controls how much of the client's address and referer reach the logs.
+type LogPrivacy struct {
+	ClientIP          string   `json:"client_ip,omitempty" note:"\"full\", \"truncate\" (to /24 for IPv4 and /48 for IPv6), \"hash\" or \"drop\"; defaults to \"full\""`
+	HashKeyRotation   Duration `json:"hash_key_rotation,omitempty" note:"How often the key used to hash client IPs is replaced; defaults to 24h"`
+	StripRefererQuery bool     `json:"strip_referer_query,omitempty" note:"Remove the query string and fragment from referers"`
+}
+
+const (
+	LogClientIPFull     = "full"
+	LogClientIPTruncate = "truncate"
+	LogClientIPHash     = "hash"
+	LogClientIPDrop     = "drop"
+
+	DefaultLogHashKeyRotation = 24 * time.Hour
+)
+
+func validateLogPrivacy(privacy *LogPrivacy) []string {
+	var problems []string
+
+	switch privacy.ClientIP {
+	case "", LogClientIPFull, LogClientIPTruncate, LogClientIPHash, LogClientIPDrop:
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid log_privacy client_ip '%s'. client_ip must be '%s', '%s', '%s' or '%s'.", privacy.ClientIP, LogClientIPFull, LogClientIPTruncate, LogClientIPHash, LogClientIPDrop))
+	}
+
+	if privacy.HashKeyRotation != 0 && privacy.ClientIP != LogClientIPHash {
+		problems = append(problems, fmt.Sprintf("Invalid log_privacy configuration. hash_key_rotation may only be set if client_ip is '%s'.", LogClientIPHash))
+	}
+	if privacy.HashKeyRotation < 0 || (privacy.HashKeyRotation > 0 && time.Duration(privacy.HashKeyRotation) < time.Minute) {
+		problems = append(problems, fmt.Sprintf("Invalid log_privacy hash_key_rotation %s. Rotation must be at least 1m.", time.Duration(privacy.HashKeyRotation)))
+	}
+
+	return problems
+}
+
+// ClientAddr returns addr (a host and port, or just an IP address) as it should be logged. A nil LogPrivacy logs the
+// full address. Truncated and hashed addresses do not include the port. An address which is not an IP address is
+// dropped if it would be truncated, and hashed as it is if it would be hashed.
+func (p *LogPrivacy) ClientAddr(addr string) string {
+	if p == nil {
+		return addr
+	}
+
+	switch p.ClientIP {
+	case LogClientIPTruncate:
+		ip, ok := parseLoggedAddr(addr)
+		if !ok {
+			return ""
+		}
+		bits := 48
+		if ip.Is4() {
+			bits = 24
+		}
+		prefix, _ := ip.Prefix(bits)
+		return prefix.Addr().String()
+	case LogClientIPHash:
+		if ip, ok := parseLoggedAddr(addr); ok {
+			addr = ip.String()
+		}
+		return logHashKey.hash(addr, p.hashKeyRotation())
+	case LogClientIPDrop:
+		return ""
+	default:
+		return addr
+	}
+}
+
+// Referer returns referer as it should be logged.
+func (p *LogPrivacy) Referer(referer string) string {
+	if p == nil || !p.StripRefererQuery {
+		return referer
+	}
+	if index := strings.IndexAny(referer, "?#"); index >= 0 {
+		return referer[:index]
+	}
+	return referer
+}
+
+func (p *LogPrivacy) hashKeyRotation() time.Duration {
+	if p.HashKeyRotation > 0 {
+		return time.Duration(p.HashKeyRotation)
+	}
+	return DefaultLogHashKeyRotation
+}
+
+// parseLoggedAddr parses addr with or without a port, unmapping IPv4-mapped IPv6 addresses so that they are truncated
+// and hashed in the same way as the IPv4 address.
+func parseLoggedAddr(addr string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// logHashKey is shared by every config, so that hashes stay the same when the configuration is reloaded. The key is
+// never written anywhere, so hashes cannot be linked to addresses, or to hashes made with other keys, once it has
+// been replaced.
+var logHashKey = &rotatingKey{now: time.Now}
+
+type rotatingKey struct {
+	mutex   sync.Mutex
+	now     func() time.Time
+	key     []byte
+	created time.Time
+}
+
+// hash returns the HMAC-SHA256 of value, truncated to 128 bits, using a random key which is replaced once it is older
+// than rotation.
+func (k *rotatingKey) hash(value string, rotation time.Duration) string {
+	k.mutex.Lock()
+	now := k.now()
+	if k.key == nil || now.Sub(k.created) >= rotation {
+		k.key = make([]byte, sha256.Size)
+		if _, err := rand.Read(k.key); err != nil {
+			panic(fmt.Sprintf("unable to generate log hash key: %v", err))
+		}
+		k.created = now
+	}
+	mac := hmac.New(sha256.New, k.key)
+	k.mutex.Unlock()
+
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
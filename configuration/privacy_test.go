@@ -0,0 +1,104 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogPrivacyClientAddr(t *testing.T) {
+	testCases := []struct {
+		clientIP string
+		addr     string
+		expected string
+	}{
+		{"", "192.0.2.123:1234", "192.0.2.123:1234"},
+		{LogClientIPFull, "192.0.2.123:1234", "192.0.2.123:1234"},
+		{LogClientIPTruncate, "192.0.2.123:1234", "192.0.2.0"},
+		{LogClientIPTruncate, "192.0.2.123", "192.0.2.0"},
+		{LogClientIPTruncate, "[::ffff:192.0.2.123]:1234", "192.0.2.0"},
+		{LogClientIPTruncate, "[2001:db8:1234:5678::1]:1234", "2001:db8:1234::"},
+		{LogClientIPTruncate, "not an address", ""},
+		{LogClientIPDrop, "192.0.2.123:1234", ""},
+	}
+
+	for _, testCase := range testCases {
+		if addr := (&LogPrivacy{ClientIP: testCase.clientIP}).ClientAddr(testCase.addr); addr != testCase.expected {
+			t.Errorf("Expected %s with client_ip '%s' to be logged as '%s', but got '%s'", testCase.addr, testCase.clientIP, testCase.expected, addr)
+		}
+	}
+
+	if addr := (*LogPrivacy)(nil).ClientAddr("192.0.2.123:1234"); addr != "192.0.2.123:1234" {
+		t.Errorf("Expected full address to be logged without log_privacy, but got '%s'", addr)
+	}
+}
+
+func TestLogPrivacyHash(t *testing.T) {
+	previousKey := logHashKey
+	defer func() { logHashKey = previousKey }()
+	now := time.Date(2024, time.March, 5, 6, 7, 8, 0, time.UTC)
+	logHashKey = &rotatingKey{now: func() time.Time { return now }}
+
+	privacy := &LogPrivacy{ClientIP: LogClientIPHash, HashKeyRotation: Duration(time.Hour)}
+	first := privacy.ClientAddr("192.0.2.123:1234")
+	if len(first) != 32 || strings.Contains(first, "192.0.2") {
+		t.Errorf("Expected a 32 character hash, but got '%s'", first)
+	}
+	if again := privacy.ClientAddr("[::ffff:192.0.2.123]:5678"); again != first {
+		t.Errorf("Expected the same address with another port to have the same hash '%s', but got '%s'", first, again)
+	}
+	if other := privacy.ClientAddr("192.0.2.124:1234"); other == first {
+		t.Errorf("Expected a different address to have a different hash, but got '%s' for both", first)
+	}
+
+	now = now.Add(59 * time.Minute)
+	if again := privacy.ClientAddr("192.0.2.123:1234"); again != first {
+		t.Errorf("Expected hash to be unchanged before the key is rotated, but got '%s' then '%s'", first, again)
+	}
+	now = now.Add(time.Minute)
+	if rotated := privacy.ClientAddr("192.0.2.123:1234"); rotated == first {
+		t.Errorf("Expected hash to change when the key is rotated, but got '%s' for both", first)
+	}
+}
+
+func TestLogPrivacyReferer(t *testing.T) {
+	privacy := &LogPrivacy{StripRefererQuery: true}
+	testCases := map[string]string{
+		"https://example.com/search?q=secret#results": "https://example.com/search",
+		"https://example.com/page#section":            "https://example.com/page",
+		"https://example.com/":                        "https://example.com/",
+		"":                                            "",
+	}
+	for referer, expected := range testCases {
+		if logged := privacy.Referer(referer); logged != expected {
+			t.Errorf("Expected referer '%s' to be logged as '%s', but got '%s'", referer, expected, logged)
+		}
+	}
+
+	if logged := (&LogPrivacy{}).Referer("https://example.com/?q=1"); logged != "https://example.com/?q=1" {
+		t.Errorf("Expected referer to be logged in full without strip_referer_query, but got '%s'", logged)
+	}
+}
+
+func TestLoadConfigLogPrivacy(t *testing.T) {
+	invalid := []struct {
+		logPrivacy string
+		problem    string
+	}{
+		{`{"client_ip": "mask"}`, "client_ip 'mask'"},
+		{`{"client_ip": "truncate", "hash_key_rotation": "1h"}`, "may only be set if client_ip is 'hash'"},
+		{`{"client_ip": "hash", "hash_key_rotation": "1s"}`, "at least 1m"},
+	}
+	for _, testCase := range invalid {
+		config := &Config{}
+		problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "log_privacy": `+testCase.logPrivacy+`}`), config)
+		if len(problems) != 1 || !strings.Contains(problems[0], testCase.problem) {
+			t.Errorf("Expected 1 problem containing '%s' with log_privacy %s, but got %d problems: %v", testCase.problem, testCase.logPrivacy, len(problems), problems)
+		}
+	}
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "log_privacy": {"client_ip": "hash", "hash_key_rotation": "12h", "strip_referer_query": true}}`), config); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+}
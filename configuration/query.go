@@ -0,0 +1,66 @@
+package configuration
+
+import (
+	"net/url"
+	"strings"
+)
+
+// applyQueryMode adds the request's query string to destination according to mode. If mode is "" or QueryDrop,
+// destination is returned unchanged.
+//
+// If both destination and the request have query strings, QueryPreserve keeps both, with the destination's parameters
+// first; and QueryMerge keeps the destination's parameters, followed by any of the request's parameters with names
+// which do not appear in the destination. Parameters are otherwise kept in their original order and encoding. Any
+// fragment in destination remains at the end.
+func applyQueryMode(destination string, mode string, rawQuery string) string {
+	if rawQuery == "" || (mode != QueryPreserve && mode != QueryMerge) {
+		return destination
+	}
+
+	fragment := ""
+	if hash := strings.IndexByte(destination, '#'); hash >= 0 {
+		destination, fragment = destination[:hash], destination[hash:]
+	}
+
+	base, destinationQuery, _ := strings.Cut(destination, "?")
+
+	params := splitQuery(destinationQuery)
+	if mode == QueryMerge {
+		names := map[string]bool{}
+		for _, param := range params {
+			names[queryParamName(param)] = true
+		}
+		for _, param := range splitQuery(rawQuery) {
+			if !names[queryParamName(param)] {
+				params = append(params, param)
+			}
+		}
+	} else {
+		params = append(params, splitQuery(rawQuery)...)
+	}
+
+	if len(params) == 0 {
+		return base + fragment
+	}
+	return base + "?" + strings.Join(params, "&") + fragment
+}
+
+// splitQuery splits an encoded query string into its parameters, e.g. "a=1&b" becomes ["a=1", "b"].
+func splitQuery(rawQuery string) []string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// queryParamName returns the decoded name of an encoded query parameter, e.g. "a%20b" for "a+b=1".
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
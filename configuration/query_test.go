@@ -0,0 +1,107 @@
+package configuration
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestApplyQueryMode(t *testing.T) {
+	testCases := []struct {
+		destination string
+		mode        string
+		rawQuery    string
+		expected    string
+	}{
+		{"https://example.com/a", "", "x=1", "https://example.com/a"},
+		{"https://example.com/a", QueryDrop, "x=1", "https://example.com/a"},
+		{"https://example.com/a?y=2", QueryDrop, "x=1", "https://example.com/a?y=2"},
+		{"https://example.com/a", QueryPreserve, "", "https://example.com/a"},
+		{"https://example.com/a", QueryPreserve, "x=1&y=a%20b", "https://example.com/a?x=1&y=a%20b"},
+		{"https://example.com/a?y=2", QueryPreserve, "x=1&y=3", "https://example.com/a?y=2&x=1&y=3"},
+		{"https://example.com/a?", QueryPreserve, "x=1", "https://example.com/a?x=1"},
+		{"https://example.com/a#top", QueryPreserve, "x=1", "https://example.com/a?x=1#top"},
+		{"https://example.com/a?y=2#top", QueryPreserve, "x=1", "https://example.com/a?y=2&x=1#top"},
+		{"https://example.com/a", QueryMerge, "x=1&y=3", "https://example.com/a?x=1&y=3"},
+		{"https://example.com/a?y=2", QueryMerge, "x=1&y=3&y=4", "https://example.com/a?y=2&x=1"},
+		{"https://example.com/a?a+b=2&flag", QueryMerge, "a%20b=1&flag=on&z", "https://example.com/a?a+b=2&flag&z"},
+		{"https://example.com/a?y=2#top", QueryMerge, "y=3&z=4", "https://example.com/a?y=2&z=4#top"},
+		{"https://example.com/a?y=2", QueryMerge, "", "https://example.com/a?y=2"},
+	}
+
+	for _, testCase := range testCases {
+		if result := applyQueryMode(testCase.destination, testCase.mode, testCase.rawQuery); result != testCase.expected {
+			t.Errorf("Expected '%s' with query mode '%s' and query '%s' to give '%s', but got '%s'", testCase.destination, testCase.mode, testCase.rawQuery, testCase.expected, result)
+		}
+	}
+}
+
+func TestValidateRuleQueryMode(t *testing.T) {
+	rule := Rule{
+		Regexp:      regexp.MustCompile(`^/(.*)$`),
+		Replacement: "https://example.com/$1",
+		Code:        301,
+	}
+
+	for _, mode := range []string{"", QueryPreserve, QueryDrop, QueryMerge} {
+		rule.Query = mode
+		if problems := validateRule("example.com", 0, rule); len(problems) != 0 {
+			t.Errorf("Expected no problems for query mode '%s', but got %d problems: %v", mode, len(problems), problems)
+		}
+	}
+
+	rule.Query = "keep"
+	if problems := validateRule("example.com", 0, rule); len(problems) != 1 {
+		t.Errorf("Expected 1 problem for query mode 'keep', but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestResolveQueryModes(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{"regexp": "^/preserve/(.*)$", "replacement": "https://example.net/$1?ref=old", "code": 301, "query": "preserve"},
+					{"regexp": "^/drop/(.*)$", "replacement": "https://example.net/$1?ref=old", "code": 301, "query": "drop"},
+					{"regexp": "^/merge/(.*)$", "replacement": "https://example.net/$1?ref=old", "code": 301, "query": "merge"},
+					{"regexp": "^/path/(.*)$", "replacement": "https://example.net/$1", "code": 301, "match_path": true},
+					{"regexp": "^/exact$", "replacement": "https://example.net/exact", "code": 301, "match_path": true},
+					{"regexp": "^/uri/(.*)$", "replacement": "https://example.net/$1", "code": 301}
+				]
+			},
+			"example.org": {
+				"rewrites": [
+					{"regexp": "^example\\.org/(.*)$", "template": "https://example.net/{{index .Captures \"1\"}}", "code": 301, "match_host": true, "query": "merge"}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url         string
+		destination string
+	}{
+		{"http://example.com/preserve/a?x=1", "https://example.net/a?ref=old&x=1"},
+		{"http://example.com/preserve/a", "https://example.net/a?ref=old"},
+		{"http://example.com/drop/a?x=1", "https://example.net/a?ref=old"},
+		{"http://example.com/merge/a?x=1&ref=new", "https://example.net/a?ref=old&x=1"},
+		{"http://example.com/path/a%20b?x=1", "https://example.net/a%20b"},
+		{"http://example.com/exact?x=1", "https://example.net/exact"},
+		{"http://example.com/uri/a?x=1", "https://example.net/a?x=1"},
+		{"http://example.org/a?x=1", "https://example.net/a?x=1"},
+	}
+
+	for _, testCase := range testCases {
+		resolution := config.Resolve(httptest.NewRequest("GET", testCase.url, nil))
+		if resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s to have destination '%s', but got '%s'", testCase.url, testCase.destination, resolution.Destination)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package configuration
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// RateLimit limits how often each client IP address may make requests, using a token bucket: a client may make Burst
+// requests at once, and is then allowed Rate more requests per second.
+type RateLimit struct {
+	Rate       float64          `json:"rate" note:"Requests per second allowed from each client IP address"`
+	Burst      int              `json:"burst,omitempty" note:"Requests a client may make at once; defaults to rate rounded up"`
+	MaxClients int              `json:"max_clients,omitempty" note:"Client IP addresses to keep track of; the least recently seen are forgotten first. Defaults to 10000"`
+	Response   *DefaultResponse `json:"response,omitempty" note:"Sent to clients over the limit; defaults to 429 Too Many Requests"`
+}
+
+// DefaultRateLimitMaxClients is used if a RateLimit does not set MaxClients.
+const DefaultRateLimitMaxClients = 10000
+
+var defaultRateLimitResponse = &DefaultResponse{
+	Code: http.StatusTooManyRequests,
+	Headers: map[string]string{
+		"Content-Type": "text/plain",
+	},
+	Body: "429 Too Many Requests\n",
+}
+
+func validateRateLimit(location string, rateLimit *RateLimit) []string {
+	var problems []string
+
+	if rateLimit.Rate <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid rate %v for %s. Rate must be positive.", rateLimit.Rate, location))
+	}
+	if rateLimit.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid burst %d for %s. Burst must not be negative.", rateLimit.Burst, location))
+	}
+	if rateLimit.MaxClients < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid max_clients %d for %s. Max clients must not be negative.", rateLimit.MaxClients, location))
+	}
+	if rateLimit.Response != nil {
+		problems = append(problems, validateDefaultResponse(rateLimit.Response)...)
+	}
+
+	return problems
+}
+
+// BurstSize returns Burst, or if it is not set, Rate rounded up.
+func (r *RateLimit) BurstSize() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int(math.Max(1, math.Ceil(r.Rate)))
+}
+
+// ClientLimit returns MaxClients, or DefaultRateLimitMaxClients if it is not set.
+func (r *RateLimit) ClientLimit() int {
+	if r.MaxClients > 0 {
+		return r.MaxClients
+	}
+	return DefaultRateLimitMaxClients
+}
+
+// OverLimitResponse returns Response, or a 429 Too Many Requests response if it is not set.
+func (r *RateLimit) OverLimitResponse() *DefaultResponse {
+	if r.Response != nil {
+		return r.Response
+	}
+	return defaultRateLimitResponse
+}
@@ -0,0 +1,58 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRateLimit(t *testing.T) {
+	testCases := []struct {
+		rateLimit string
+		problems  int
+	}{
+		{`{"rate": 10}`, 0},
+		{`{"rate": 0.5, "burst": 5, "max_clients": 100, "response": {"code": 0}}`, 0},
+		{`{"rate": 0}`, 1},
+		{`{"rate": -1, "burst": -1, "max_clients": -1}`, 3},
+		{`{"rate": 1, "response": {"code": 999}}`, 1},
+	}
+
+	for _, testCase := range testCases {
+		for _, template := range []string{
+			`{"default_response": {"code": 421}, "domains": {}, "rate_limit": %s}`,
+			`{"default_response": {"code": 421}, "domains": {"example.com": {"rate_limit": %s}}}`,
+		} {
+			config := &Config{}
+			problems := LoadConfig(strings.NewReader(strings.Replace(template, "%s", testCase.rateLimit, 1)), config)
+			if len(problems) != testCase.problems {
+				t.Errorf("Expected %d problems for rate_limit %s, but got %d problems: %v", testCase.problems, testCase.rateLimit, len(problems), problems)
+			}
+		}
+	}
+}
+
+func TestRateLimitDefaults(t *testing.T) {
+	testCases := []struct {
+		rateLimit  RateLimit
+		burst      int
+		maxClients int
+		code       int
+	}{
+		{RateLimit{Rate: 10}, 10, DefaultRateLimitMaxClients, 429},
+		{RateLimit{Rate: 0.1}, 1, DefaultRateLimitMaxClients, 429},
+		{RateLimit{Rate: 2.5}, 3, DefaultRateLimitMaxClients, 429},
+		{RateLimit{Rate: 10, Burst: 20, MaxClients: 5, Response: &DefaultResponse{Code: 0}}, 20, 5, 0},
+	}
+
+	for _, testCase := range testCases {
+		if actual := testCase.rateLimit.BurstSize(); actual != testCase.burst {
+			t.Errorf("Expected burst size %d for %+v, but got %d", testCase.burst, testCase.rateLimit, actual)
+		}
+		if actual := testCase.rateLimit.ClientLimit(); actual != testCase.maxClients {
+			t.Errorf("Expected client limit %d for %+v, but got %d", testCase.maxClients, testCase.rateLimit, actual)
+		}
+		if actual := testCase.rateLimit.OverLimitResponse().Code; actual != testCase.code {
+			t.Errorf("Expected over-limit response code %d for %+v, but got %d", testCase.code, testCase.rateLimit, actual)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package configuration
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type RedirectMapEntry struct {
+	Destination string
+	Code        int
+	Line        int
+}
+
+// loadRedirectMapFile reads the redirect map at path for the domain origin. Files with names ending in ".tsv" are
+// read as tab separated values; anything else is read as comma separated values.
+func loadRedirectMapFile(origin string, path string) (map[string]RedirectMapEntry, []string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("Unable to open redirect_map for domain %s: %v", origin, err)}
+	}
+	defer file.Close()
+
+	separator := ','
+	if strings.HasSuffix(strings.ToLower(path), ".tsv") {
+		separator = '\t'
+	}
+
+	return readRedirectMap(origin, path, file, separator)
+}
+
+// readRedirectMap parses and validates a redirect map. Each record must have exactly three fields: the source path,
+// the destination URL and the redirect code. Lines beginning with '#' are ignored.
+func readRedirectMap(origin string, name string, file io.Reader, separator rune) (map[string]RedirectMapEntry, []string) {
+	var problems []string
+	redirectMap := map[string]RedirectMapEntry{}
+
+	reader := csv.NewReader(file)
+	reader.Comma = separator
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) && parseError.Err == csv.ErrFieldCount {
+			problems = append(problems, fmt.Sprintf("Invalid redirect_map %s for domain %s at line %d. Each line must have exactly three fields: source path, destination and code.", name, origin, parseError.Line))
+			continue
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("Error parsing redirect_map %s for domain %s: %v", name, origin, err))
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		location := fmt.Sprintf("domain %s in redirect_map %s at line %d", origin, name, line)
+		source := record[0]
+		entry := RedirectMapEntry{
+			Destination: record[1],
+			Line:        line,
+		}
+
+		if code, err := strconv.Atoi(record[2]); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid redirect code '%s' for %s: %v", record[2], location, err))
+		} else {
+			entry.Code = code
+			problems = append(problems, validateRedirect(location, entry.Code, entry.Destination)...)
+		}
+
+		if !strings.HasPrefix(source, "/") {
+			problems = append(problems, fmt.Sprintf("Invalid source path '%s' for %s. Source must begin with '/'.", source, location))
+		}
+
+		if existing, ok := redirectMap[source]; ok {
+			problems = append(problems, fmt.Sprintf("Duplicate source path '%s' for %s, previously defined at line %d", source, location, existing.Line))
+		}
+
+		redirectMap[source] = entry
+	}
+
+	return redirectMap, problems
+}
+
+// LookupRedirectMap finds the redirect map entry for requestURI, if any, and the source it matched.
+// An exact match on the request URI (including any query string) is preferred; if there is none, the path alone is tried.
+func (d *Domain) LookupRedirectMap(requestURI string) (string, RedirectMapEntry, bool) {
+	if entry, ok := d.RedirectMap[requestURI]; ok {
+		return requestURI, entry, true
+	}
+
+	if path, _, hasQuery := strings.Cut(requestURI, "?"); hasQuery {
+		if entry, ok := d.RedirectMap[path]; ok {
+			return path, entry, true
+		}
+	}
+
+	return "", RedirectMapEntry{}, false
+}
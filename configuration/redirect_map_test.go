@@ -0,0 +1,137 @@
+package configuration
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRedirectMap(t *testing.T) {
+	csvData := `# source, destination, code
+/old,https://example.com/new,301
+"/with,comma",https://example.com/comma,308
+/query?x=1,https://example.com/query,302
+`
+
+	redirectMap, problems := readRedirectMap("example.com", "test.csv", strings.NewReader(csvData), ',')
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	if len(redirectMap) != 3 {
+		t.Errorf("Expected 3 entries, but got %d entries: %v", len(redirectMap), redirectMap)
+	}
+
+	expected := RedirectMapEntry{Destination: "https://example.com/new", Code: 301, Line: 2}
+	if redirectMap["/old"] != expected {
+		t.Errorf("Expected entry for /old to be %v, but got %v", expected, redirectMap["/old"])
+	}
+
+	expected = RedirectMapEntry{Destination: "https://example.com/comma", Code: 308, Line: 3}
+	if redirectMap["/with,comma"] != expected {
+		t.Errorf("Expected entry for /with,comma to be %v, but got %v", expected, redirectMap["/with,comma"])
+	}
+}
+
+func TestReadRedirectMapTSV(t *testing.T) {
+	tsvData := "/old\thttps://example.com/new\t301\n/other\thttps://example.com/other\t302\n"
+
+	redirectMap, problems := readRedirectMap("example.com", "test.tsv", strings.NewReader(tsvData), '\t')
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	if redirectMap["/other"].Destination != "https://example.com/other" {
+		t.Errorf("Expected destination for /other to be %s, but got %v", "https://example.com/other", redirectMap["/other"])
+	}
+}
+
+func TestReadRedirectMapProblems(t *testing.T) {
+	testCases := []struct {
+		description string
+		data        string
+		problems    int
+	}{
+		{"invalid code", "/old,https://example.com/new,moved\n", 1},
+		{"code out of range", "/old,https://example.com/new,200\n", 1},
+		{"invalid destination", "/old,example.com/new,301\n", 1},
+		{"invalid source", "old,https://example.com/new,301\n", 1},
+		{"duplicate source", "/old,https://example.com/new,301\n/old,https://example.com/newer,301\n", 1},
+		{"wrong number of fields", "/old,https://example.com/new\n/other,https://example.com/other,301,extra\n", 2},
+		{"multiple problems on one line", "old,example.com/new,200\n", 3},
+	}
+
+	for _, testCase := range testCases {
+		if _, problems := readRedirectMap("example.com", "test.csv", strings.NewReader(testCase.data), ','); len(problems) != testCase.problems {
+			t.Errorf("Expected %d problems (%s), but got %d problems: %v", testCase.problems, testCase.description, len(problems), problems)
+		}
+	}
+}
+
+func TestLookupRedirectMap(t *testing.T) {
+	domain := Domain{
+		RedirectMap: map[string]RedirectMapEntry{
+			"/old":       {Destination: "https://example.com/new", Code: 301},
+			"/old?x=1":   {Destination: "https://example.com/x", Code: 302},
+			"/other?y=2": {Destination: "https://example.com/y", Code: 302},
+		},
+	}
+
+	testCases := []struct {
+		requestURI  string
+		source      string
+		destination string
+	}{
+		{"/old", "/old", "https://example.com/new"},
+		{"/old?x=1", "/old?x=1", "https://example.com/x"},
+		{"/old?x=2", "/old", "https://example.com/new"},
+		{"/other?y=2", "/other?y=2", "https://example.com/y"},
+		{"/other", "", ""},
+		{"/nothing", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		source, entry, ok := domain.LookupRedirectMap(testCase.requestURI)
+		if ok != (testCase.source != "") || source != testCase.source || entry.Destination != testCase.destination {
+			t.Errorf("Expected %s to match source '%s' with destination '%s', but got source '%s' with destination '%s' (ok = %t)", testCase.requestURI, testCase.source, testCase.destination, source, entry.Destination, ok)
+		}
+	}
+}
+
+func TestLoadConfigRedirectMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redirects.csv")
+	if err := os.WriteFile(path, []byte("/old,https://example.com/new,301\n"), 0o600); err != nil {
+		t.Fatalf("Unable to write redirect map: %v", err)
+	}
+
+	jsonData := []byte(fmt.Sprintf(`{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {"redirect_map": %q}
+		}
+	}`, path))
+
+	config := &Config{}
+	if problems := LoadConfig(bytes.NewReader(jsonData), config); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	if config.Domains["example.com"].RedirectMap["/old"].Destination != "https://example.com/new" {
+		t.Errorf("Expected redirect map to be loaded, but got %v", config.Domains["example.com"].RedirectMap)
+	}
+
+	jsonData = []byte(`{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {"redirect_map": "/does/not/exist.csv"}
+		}
+	}`)
+
+	config = &Config{}
+	if problems := LoadConfig(bytes.NewReader(jsonData), config); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (redirect map does not exist), but got %d problems: %v", len(problems), problems)
+	}
+}
@@ -0,0 +1,291 @@
+package configuration
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Resolution describes how a request should be answered, as decided by Config.Resolve.
+//
+// Exactly one of Blocked, RedirectMapEntry, Rule or DefaultResponse is set.
+type Resolution struct {
+	// Domain is the key in Config.Domains of the domain which matched the request's host, or "" if none matched.
+	Domain string
+
+	// Blocked is set if the client is refused by allow_cidrs or deny_cidrs, in which case Blocked.Response is sent.
+	Blocked *AccessDenial
+
+	// RedirectMapSource and RedirectMapEntry are set if the request matched an entry in the domain's redirect map.
+	RedirectMapSource string
+	RedirectMapEntry  *RedirectMapEntry
+
+	// RuleIndex and Rule are set if the request matched one of the domain's rewrite rules. RuleIndex is -1 otherwise.
+	RuleIndex int
+	Rule      *Rule
+
+	// DefaultResponse is set if no redirect map entry or rule matched. DefaultResponseSource is the domain the
+	// default response came from, or "default" for the global default response.
+	DefaultResponse       *DefaultResponse
+	DefaultResponseSource string
+
+	// Destination is the URL to redirect or proxy to. It is empty for default responses.
+	Destination string
+
+	// SplitDestination is the name (or index) of the destination chosen from the rule's Destinations, or "" if the
+	// rule does not have Destinations.
+	SplitDestination string
+
+	// RandomDestinations holds the URL each of the rule's Destinations would give, if SplitDestination was chosen at
+	// random (i.e. the rule is not sticky, or the sticky cookie was not sent), so another request could get any of them.
+	RandomDestinations []string
+
+	// Code is the status code to respond with. It is 0 for proxy rules, where the upstream server decides the status
+	// code, and for default responses which close the connection.
+	Code int
+
+	// Error is set if a rule matched but its destination could not be rendered from its template, in which case the
+	// default response is used instead.
+	Error error
+}
+
+// Action returns ActionRedirect or ActionProxy for redirect map entries and rules, "blocked", or "default_response".
+func (r *Resolution) Action() string {
+	switch {
+	case r.Blocked != nil:
+		return "blocked"
+	case r.Rule != nil && r.Rule.Action == ActionProxy:
+		return ActionProxy
+	case r.Rule != nil, r.RedirectMapEntry != nil:
+		return ActionRedirect
+	default:
+		return "default_response"
+	}
+}
+
+// RuleLabel identifies what matched: the rule's id or index, "redirect_map", the blocked response's id or "blocked", or
+// the default response's id or "default".
+func (r *Resolution) RuleLabel() string {
+	switch {
+	case r.Blocked != nil:
+		return r.Blocked.Response.Label("blocked")
+	case r.Rule != nil:
+		return r.Rule.Label(r.RuleIndex)
+	case r.RedirectMapEntry != nil:
+		return "redirect_map"
+	default:
+		return r.DefaultResponse.Label("default")
+	}
+}
+
+// Labels returns the labels of the rule, blocked response or default response which matched, if any.
+func (r *Resolution) Labels() map[string]string {
+	switch {
+	case r.Blocked != nil:
+		return r.Blocked.Response.Labels
+	case r.Rule != nil:
+		return r.Rule.Labels
+	case r.DefaultResponse != nil:
+		return r.DefaultResponse.Labels
+	default:
+		return nil
+	}
+}
+
+// DomainLabel is the domain which determined the response, or "default" if the global default response was used or
+// a client was blocked without a domain matching.
+func (r *Resolution) DomainLabel() string {
+	switch {
+	case r.DefaultResponse != nil:
+		return r.DefaultResponseSource
+	case r.Domain == "":
+		return "default"
+	default:
+		return r.Domain
+	}
+}
+
+// Resolve decides how to respond to req, without responding. The request's host selects a domain (ignoring domains
+// which are not active); if req.RemoteAddr is refused by the global or domain's allow_cidrs or deny_cidrs, the
+// blocked response is used; otherwise the domain's redirect map and active rewrite rules are tried in order; and if
+// nothing matches, the domain's default response (or if there is none, the global default response) is used. If a
+// rule with a template matches but the template cannot be rendered, no further rules are tried, and the default
+// response is used with Error set.
+//
+// req.RemoteAddr should be the client's address, as returned by ClientAddr(). Rate limits are not applied, since they
+// depend on earlier requests.
+func (c *Config) Resolve(req *http.Request) Resolution {
+	resolution := Resolution{
+		RuleIndex:             -1,
+		DefaultResponse:       c.DefaultResponse,
+		DefaultResponseSource: "default",
+	}
+	requestUri := req.URL.RequestURI()
+
+	now := c.now()
+	origin, domain, ok := c.MatchDomain(req.Host)
+	if ok && !domain.ActiveAt(now) {
+		ok = false
+	}
+	if ok {
+		resolution.Domain = origin
+	}
+
+	if denial := c.CheckAccess(resolution.Domain, req.RemoteAddr); denial != nil {
+		resolution.Blocked = denial
+		resolution.DefaultResponse = nil
+		resolution.DefaultResponseSource = ""
+		resolution.Code = denial.Response.Code
+		return resolution
+	}
+
+	if !ok {
+		if resolution.DefaultResponse != nil {
+			resolution.Code = resolution.DefaultResponse.Code
+		}
+		return resolution
+	}
+
+	if source, entry, ok := domain.LookupRedirectMap(requestUri); ok {
+		resolution.RedirectMapSource = source
+		resolution.RedirectMapEntry = &entry
+		resolution.DefaultResponse = nil
+		resolution.DefaultResponseSource = ""
+		resolution.Destination = entry.Destination
+		resolution.Code = entry.Code
+		return resolution
+	}
+
+	host := requestHostname(req.Host)
+	requestPath := req.URL.EscapedPath()
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	variables := map[string]string{
+		"host":      host,
+		"subdomain": strings.TrimSuffix(strings.TrimSuffix(host, requestHostname(origin)), "."),
+	}
+
+	for index := range domain.RewriteRules {
+		rule := &domain.RewriteRules[index]
+		if !rule.ActiveAt(now) || (rule.Match != nil && !rule.Match.Matches(req)) {
+			continue
+		}
+
+		subject := requestUri
+		if rule.MatchPath || rule.Query != "" {
+			subject = requestPath
+		}
+		if rule.MatchHost {
+			subject = host + subject
+		}
+		match := rule.Regexp.FindStringSubmatch(subject)
+		if match == nil {
+			continue
+		}
+
+		destination := ""
+		if rule.Template != nil {
+			var err error
+			destination, err = rule.Template.Render(newTemplateData(req, rule.Regexp, match, host, variables["subdomain"]))
+			if err == nil && validateDestination("", destination) != nil {
+				err = fmt.Errorf("destination '%s' does not begin with 'http://' or 'https://'", destination)
+			}
+			if err != nil {
+				resolution.Error = fmt.Errorf("unable to render template for domain %s at index %d: %w", origin, index, err)
+				break
+			}
+		} else {
+			replacement := rule.Replacement
+			if len(rule.Destinations) > 0 {
+				chosen := rule.chooseDestination(req)
+				replacement = rule.Destinations[chosen].Replacement
+				resolution.SplitDestination = rule.Destinations[chosen].label(chosen)
+				if _, sticky := rule.stickyKey(req); !sticky {
+					for _, candidate := range rule.Destinations {
+						candidateDestination := rule.Regexp.ReplaceAllString(subject, expandHostVariables(rule.Regexp, candidate.Replacement, variables))
+						resolution.RandomDestinations = append(resolution.RandomDestinations, applyQueryMode(candidateDestination, rule.Query, req.URL.RawQuery))
+					}
+				}
+			}
+			destination = rule.Regexp.ReplaceAllString(subject, expandHostVariables(rule.Regexp, replacement, variables))
+		}
+
+		resolution.RuleIndex = index
+		resolution.Rule = rule
+		resolution.DefaultResponse = nil
+		resolution.DefaultResponseSource = ""
+		resolution.Destination = applyQueryMode(destination, rule.Query, req.URL.RawQuery)
+		resolution.Code = rule.Code
+		return resolution
+	}
+
+	if domain.DefaultResponse != nil {
+		resolution.DefaultResponse = domain.DefaultResponse
+		resolution.DefaultResponseSource = origin
+	}
+	if resolution.DefaultResponse != nil {
+		resolution.Code = resolution.DefaultResponse.Code
+	}
+	return resolution
+}
+
+// requestHostname returns host in lower case, without any port.
+func requestHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(host)
+}
+
+func isHostVariable(name string) bool {
+	return name == "host" || name == "subdomain"
+}
+
+// expandHostVariables replaces ${host} and ${subdomain} (or $host and $subdomain) in replacement with their values,
+// so that the result can be passed to Regexp.ReplaceAllString(). Sub-patterns in re with the same names take
+// precedence, and "$$" is left alone.
+func expandHostVariables(re *regexp.Regexp, replacement string, variables map[string]string) string {
+	if !strings.Contains(replacement, "$") {
+		return replacement
+	}
+
+	var result strings.Builder
+	for {
+		dollar := strings.IndexByte(replacement, '$')
+		if dollar < 0 || dollar == len(replacement)-1 {
+			result.WriteString(replacement)
+			return result.String()
+		}
+		result.WriteString(replacement[:dollar])
+		replacement = replacement[dollar:]
+
+		// Find the name in the same way as regexp.Expand()
+		name, length := "", 1
+		if replacement[1] == '$' {
+			length = 2
+		} else if replacement[1] == '{' {
+			if end := strings.IndexByte(replacement, '}'); end > 0 {
+				name, length = replacement[2:end], end+1
+			}
+		} else {
+			for length < len(replacement) && isNameByte(replacement[length]) {
+				length++
+			}
+			name = replacement[1:length]
+		}
+
+		if value, ok := variables[name]; ok && re.SubexpIndex(name) < 0 {
+			result.WriteString(strings.ReplaceAll(value, "$", "$$"))
+		} else {
+			result.WriteString(replacement[:length])
+		}
+		replacement = replacement[length:]
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
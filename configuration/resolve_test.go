@@ -0,0 +1,228 @@
+package configuration
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const resolveTestConfig = `{
+	"default_response": {"code": 421},
+	"domains": {
+		"example.com": {
+			"match_subdomains": true,
+			"rewrites": [
+				{"regexp": "^/old/(.*)$", "replacement": "https://example.com/new/$1", "code": 301},
+				{"regexp": "^/api/(.*)$", "replacement": "http://127.0.0.1:8000/$1", "action": "proxy"},
+				{"regexp": "^/(.*)$", "replacement": "https://www.example.com/$1", "code": 302}
+			]
+		},
+		"example.net": {
+			"rewrites": [
+				{"regexp": "^/only$", "replacement": "https://example.org/", "code": 308}
+			],
+			"default_response": {"code": 0}
+		}
+	}
+}`
+
+func TestResolve(t *testing.T) {
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(resolveTestConfig), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url         string
+		domain      string
+		ruleLabel   string
+		action      string
+		destination string
+		code        int
+		source      string
+	}{
+		{"http://example.com/old/page?x=1", "example.com", "0", ActionRedirect, "https://example.com/new/page?x=1", 301, ""},
+		{"http://www.example.com/api/status", "example.com", "1", ActionProxy, "http://127.0.0.1:8000/status", 0, ""},
+		{"http://example.com/", "example.com", "2", ActionRedirect, "https://www.example.com/", 302, ""},
+		{"http://example.net/only", "example.net", "0", ActionRedirect, "https://example.org/", 308, ""},
+		{"http://example.net/other", "example.net", "default", "default_response", "", 0, "example.net"},
+		{"http://www.example.net/only", "", "default", "default_response", "", 421, "default"},
+		{"http://example.org/", "", "default", "default_response", "", 421, "default"},
+	}
+
+	for _, testCase := range testCases {
+		resolution := config.Resolve(httptest.NewRequest("GET", testCase.url, nil))
+
+		if resolution.Domain != testCase.domain {
+			t.Errorf("Expected %s to match domain '%s', but got '%s'", testCase.url, testCase.domain, resolution.Domain)
+		}
+		if resolution.RuleLabel() != testCase.ruleLabel {
+			t.Errorf("Expected %s to match rule '%s', but got '%s'", testCase.url, testCase.ruleLabel, resolution.RuleLabel())
+		}
+		if resolution.Action() != testCase.action {
+			t.Errorf("Expected %s to have action '%s', but got '%s'", testCase.url, testCase.action, resolution.Action())
+		}
+		if resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s to have destination '%s', but got '%s'", testCase.url, testCase.destination, resolution.Destination)
+		}
+		if resolution.Code != testCase.code {
+			t.Errorf("Expected %s to have code %d, but got %d", testCase.url, testCase.code, resolution.Code)
+		}
+		if resolution.DefaultResponseSource != testCase.source {
+			t.Errorf("Expected %s to have default response source '%s', but got '%s'", testCase.url, testCase.source, resolution.DefaultResponseSource)
+		}
+	}
+}
+
+func TestResolveBlocked(t *testing.T) {
+	config := &Config{}
+	problems := LoadConfig(strings.NewReader(`{
+		"default_response": {"code": 421},
+		"deny_cidrs": ["203.0.113.0/24"],
+		"domains": {
+			"example.com": {
+				"allow_cidrs": ["10.0.0.0/8"],
+				"blocked_response": {"code": 404, "id": "hidden"},
+				"rewrites": [{"regexp": "^(.*)$", "replacement": "https://www.example.com$1", "code": 301}]
+			}
+		}
+	}`), config)
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url        string
+		remoteAddr string
+		list       string
+		reason     string
+		ruleLabel  string
+		code       int
+	}{
+		{"http://example.com/", "10.1.2.3:1234", "", "", "0", 301},
+		{"http://example.com/", "192.0.2.1:1234", "example.com", AccessDeniedByAllowList, "hidden", 404},
+		{"http://example.com/", "", "example.com", AccessDeniedByAllowList, "hidden", 404},
+		{"http://example.com/", "203.0.113.1:1234", "global", AccessDeniedByDenyList, "blocked", 403},
+		{"http://example.org/", "203.0.113.1:1234", "global", AccessDeniedByDenyList, "blocked", 403},
+		{"http://example.org/", "192.0.2.1:1234", "", "", "default", 421},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", testCase.url, nil)
+		req.RemoteAddr = testCase.remoteAddr
+		resolution := config.Resolve(req)
+
+		if testCase.list == "" {
+			if resolution.Blocked != nil {
+				t.Errorf("Expected %s from '%s' not to be blocked, but got %+v", testCase.url, testCase.remoteAddr, resolution.Blocked)
+			}
+		} else if resolution.Blocked == nil || resolution.Blocked.List != testCase.list || resolution.Blocked.Reason != testCase.reason {
+			t.Errorf("Expected %s from '%s' to be blocked by %s %s, but got %+v", testCase.url, testCase.remoteAddr, testCase.list, testCase.reason, resolution.Blocked)
+		} else if resolution.Action() != "blocked" || resolution.Rule != nil || resolution.DefaultResponse != nil {
+			t.Errorf("Expected only the blocked response for %s from '%s', but got action %s", testCase.url, testCase.remoteAddr, resolution.Action())
+		}
+		if resolution.RuleLabel() != testCase.ruleLabel || resolution.Code != testCase.code {
+			t.Errorf("Expected %s from '%s' to get %s with code %d, but got %s with code %d", testCase.url, testCase.remoteAddr, testCase.ruleLabel, testCase.code, resolution.RuleLabel(), resolution.Code)
+		}
+	}
+}
+
+func TestResolveRedirectMap(t *testing.T) {
+	config := &Config{
+		DefaultResponse: &DefaultResponse{Code: 421},
+		Domains: map[string]Domain{
+			"example.com": {
+				RedirectMap: map[string]RedirectMapEntry{
+					"/a": {Destination: "https://example.com/b", Code: 301, Line: 3},
+				},
+			},
+		},
+	}
+
+	resolution := config.Resolve(httptest.NewRequest("GET", "http://example.com/a?utm=1", nil))
+	if resolution.RedirectMapEntry == nil || resolution.RedirectMapSource != "/a" || resolution.RuleLabel() != "redirect_map" {
+		t.Fatalf("Expected redirect map entry for /a, but got %+v", resolution)
+	}
+	if resolution.Destination != "https://example.com/b" || resolution.Code != 301 || resolution.RuleIndex != -1 {
+		t.Errorf("Expected 301 redirect to https://example.com/b, but got %d redirect to %s", resolution.Code, resolution.Destination)
+	}
+}
+
+func TestResolveNamedReplacements(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{"regexp": "^/(?P<year>\\d{4})/(?P<slug>[a-z-]+)$", "replacement": "https://blog.example.com/${slug}?year=${year}&cost=$$5", "code": 301}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	resolution := config.Resolve(httptest.NewRequest("GET", "http://example.com/2024/hello-world", nil))
+	if expected := "https://blog.example.com/hello-world?year=2024&cost=$5"; resolution.Destination != expected {
+		t.Errorf("Expected destination '%s', but got '%s'", expected, resolution.Destination)
+	}
+}
+
+func TestResolveHostVariables(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.net": {
+				"match_subdomains": true,
+				"rewrites": [
+					{"regexp": "^/host(/.*)$", "replacement": "https://${host}$1", "code": 308},
+					{"regexp": "^/(?P<host>[a-z]+)/(.*)$", "replacement": "https://example.com/${host}/$2", "code": 302},
+					{"regexp": "^(.*)$", "replacement": "https://example.com/$subdomain$1?cost=$$host", "code": 301}
+				]
+			},
+			"example.com:8080": {
+				"match_subdomains": true,
+				"rewrites": [
+					{"regexp": "^(.*)$", "replacement": "https://${subdomain}.example.com$1", "code": 301}
+				]
+			},
+			"example.org": {
+				"match_subdomains": true,
+				"rewrites": [
+					{"regexp": "^(?:www\\.)?example\\.org/(.*)$", "replacement": "https://example.com/$1", "code": 301, "match_host": true},
+					{"regexp": "^([a-z]+)\\.example\\.org/(.*)$", "replacement": "https://example.com/$1/$2", "code": 302, "match_host": true}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url         string
+		destination string
+	}{
+		{"http://foo.example.net/x", "https://example.com/foo/x?cost=$host"},
+		{"http://a.b.EXAMPLE.net/x", "https://example.com/a.b/x?cost=$host"},
+		{"http://example.net/x", "https://example.com//x?cost=$host"},
+		{"http://foo.example.net/host/x", "https://foo.example.net/x"},
+		{"http://foo.example.com:8080/x", "https://foo.example.com/x"},
+		{"http://foo.example.net/group/x", "https://example.com/group/x"},
+		{"http://www.example.org/x?y=1", "https://example.com/x?y=1"},
+		{"http://example.org/x", "https://example.com/x"},
+		{"http://blog.example.org/x", "https://example.com/blog/x"},
+	}
+
+	for _, testCase := range testCases {
+		resolution := config.Resolve(httptest.NewRequest("GET", testCase.url, nil))
+		if resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s to have destination '%s', but got '%s'", testCase.url, testCase.destination, resolution.Destination)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package configuration
+
+import (
+	"fmt"
+	"time"
+)
+
+// now returns the current time according to c.Clock.
+func (c *Config) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+// activeAt reports whether now is within the window given by notBefore (inclusive) and notAfter (exclusive), either
+// of which may be nil to leave that end of the window open.
+func activeAt(now time.Time, notBefore *time.Time, notAfter *time.Time) bool {
+	return (notBefore == nil || !now.Before(*notBefore)) && (notAfter == nil || now.Before(*notAfter))
+}
+
+// ActiveAt reports whether the rule should be used at now.
+func (r *Rule) ActiveAt(now time.Time) bool {
+	return activeAt(now, r.NotBefore, r.NotAfter)
+}
+
+// ActiveAt reports whether the domain should be used at now.
+func (d *Domain) ActiveAt(now time.Time) bool {
+	return activeAt(now, d.NotBefore, d.NotAfter)
+}
+
+// ActiveRules returns the number of rewrite rules which are currently active, in domains which are also active.
+func (c *Config) ActiveRules() int {
+	now := c.now()
+	count := 0
+	for _, domain := range c.Domains {
+		if !domain.ActiveAt(now) {
+			continue
+		}
+		for index := range domain.RewriteRules {
+			if domain.RewriteRules[index].ActiveAt(now) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func validateSchedule(location string, notBefore *time.Time, notAfter *time.Time) []string {
+	if notBefore != nil && notAfter != nil && !notAfter.After(*notBefore) {
+		return []string{fmt.Sprintf("Invalid not_after for %s. It must be later than not_before.", location)}
+	}
+	return nil
+}
+
+// scheduleWarnings returns a warning for each domain and rule which has already expired, and so will never be used.
+func (c *Config) scheduleWarnings() []string {
+	var warnings []string
+	now := c.now()
+
+	for origin, domain := range c.Domains {
+		if domain.NotAfter != nil && !now.Before(*domain.NotAfter) {
+			warnings = append(warnings, fmt.Sprintf("Domain %s expired at %s and will not be used", origin, domain.NotAfter.Format(time.RFC3339)))
+			continue
+		}
+		for index, rule := range domain.RewriteRules {
+			if rule.NotAfter != nil && !now.Before(*rule.NotAfter) {
+				warnings = append(warnings, fmt.Sprintf("Rule for domain %s at index %d expired at %s and will not be used", origin, index, rule.NotAfter.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,127 @@
+package configuration
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const scheduleTestConfig = `{
+	"default_response": {"code": 421},
+	"domains": {
+		"example.com": {
+			"rewrites": [
+				{"regexp": "^/sale$", "replacement": "https://example.com/summer-sale", "code": 302, "not_before": "2024-06-01T00:00:00Z", "not_after": "2024-09-01T00:00:00Z"},
+				{"regexp": "^/old$", "replacement": "https://example.com/new", "code": 302, "not_after": "2024-01-01T00:00:00+10:00"},
+				{"regexp": "^(.*)$", "replacement": "https://www.example.com$1", "code": 301}
+			]
+		},
+		"campaign.example.com": {
+			"not_before": "2024-06-01T00:00:00Z",
+			"rewrites": [
+				{"regexp": "^(.*)$", "replacement": "https://example.com/campaign$1", "code": 302}
+			]
+		}
+	}
+}`
+
+func loadScheduleTestConfig(t *testing.T, now time.Time) *Config {
+	t.Helper()
+
+	config := &Config{Clock: func() time.Time { return now }}
+	if problems := LoadConfig(strings.NewReader(scheduleTestConfig), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	return config
+}
+
+func TestResolveSchedule(t *testing.T) {
+	testCases := []struct {
+		now         string
+		url         string
+		destination string
+	}{
+		{"2024-05-31T23:59:59Z", "http://example.com/sale", "https://www.example.com/sale"},
+		{"2024-06-01T00:00:00Z", "http://example.com/sale", "https://example.com/summer-sale"},
+		{"2024-08-31T23:59:59Z", "http://example.com/sale", "https://example.com/summer-sale"},
+		{"2024-09-01T00:00:00Z", "http://example.com/sale", "https://www.example.com/sale"},
+		{"2023-12-31T13:59:59Z", "http://example.com/old", "https://example.com/new"},
+		{"2023-12-31T14:00:00Z", "http://example.com/old", "https://www.example.com/old"},
+		{"2024-05-31T23:59:59Z", "http://campaign.example.com/x", ""},
+		{"2024-06-01T00:00:00Z", "http://campaign.example.com/x", "https://example.com/campaign/x"},
+	}
+
+	for _, testCase := range testCases {
+		now, _ := time.Parse(time.RFC3339, testCase.now)
+		config := loadScheduleTestConfig(t, now)
+
+		resolution := config.Resolve(httptest.NewRequest("GET", testCase.url, nil))
+		if resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s at %s to have destination '%s', but got '%s'", testCase.url, testCase.now, testCase.destination, resolution.Destination)
+		}
+	}
+}
+
+func TestActiveRules(t *testing.T) {
+	testCases := []struct {
+		now    string
+		active int
+	}{
+		{"2023-06-01T00:00:00Z", 2},
+		{"2024-02-01T00:00:00Z", 1},
+		{"2024-07-01T00:00:00Z", 3},
+		{"2025-01-01T00:00:00Z", 2},
+	}
+
+	for _, testCase := range testCases {
+		now, _ := time.Parse(time.RFC3339, testCase.now)
+		if active := loadScheduleTestConfig(t, now).ActiveRules(); active != testCase.active {
+			t.Errorf("Expected %d active rules at %s, but got %d", testCase.active, testCase.now, active)
+		}
+	}
+}
+
+func TestLoadConfigScheduleWarnings(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2023-06-01T00:00:00Z")
+	if warnings := loadScheduleTestConfig(t, now).Warnings; len(warnings) != 0 {
+		t.Errorf("Expected no warnings, but got %d warnings: %v", len(warnings), warnings)
+	}
+
+	now, _ = time.Parse(time.RFC3339, "2024-10-01T00:00:00Z")
+	warnings := loadScheduleTestConfig(t, now).Warnings
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings (two expired rules), but got %d warnings: %v", len(warnings), warnings)
+	}
+	for _, expected := range []string{
+		"Rule for domain example.com at index 0 expired at 2024-09-01T00:00:00Z and will not be used",
+		"Rule for domain example.com at index 1 expired at 2024-01-01T00:00:00+10:00 and will not be used",
+	} {
+		if warnings[0] != expected && warnings[1] != expected {
+			t.Errorf("Expected warning '%s', but got %v", expected, warnings)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"not_before": "2024-06-01T00:00:00Z",
+				"not_after": "2024-06-01T00:00:00Z",
+				"rewrites": [
+					{"regexp": "^(.*)$", "replacement": "https://www.example.com$1", "code": 301, "not_before": "2024-06-02T00:00:00Z", "not_after": "2024-06-01T00:00:00Z"}
+				]
+			}
+		}
+	}`
+
+	if problems := LoadConfig(strings.NewReader(jsonData), &Config{}); len(problems) != 2 {
+		t.Errorf("Expected 2 problems (domain and rule not_after before not_before), but got %d problems: %v", len(problems), problems)
+	}
+
+	if problems := LoadConfig(strings.NewReader(`{"domains": {"example.com": {"not_before": "tomorrow"}}}`), &Config{}); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (invalid time), but got %d problems: %v", len(problems), problems)
+	}
+}
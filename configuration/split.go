@@ -0,0 +1,112 @@
+package configuration
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WeightedDestination is one of a Rule's Destinations, which is chosen for a proportion of requests given by its
+// weight relative to the total of all the rule's weights.
+type WeightedDestination struct {
+	Name        string `json:"name,omitempty" note:"Identifies the destination in metrics and logs; defaults to its index"`
+	Replacement string `json:"replacement"`
+	Weight      int    `json:"weight"`
+}
+
+const (
+	StickyClientIP     = "client_ip"
+	StickyCookiePrefix = "cookie:"
+)
+
+// randomIntn is used to choose destinations for rules which are not sticky. It is a variable so tests can replace it.
+var randomIntn = rand.Intn
+
+func validateWeightedDestinations(location string, rule Rule) []string {
+	var problems []string
+
+	if rule.Replacement != "" {
+		problems = append(problems, fmt.Sprintf("Invalid replacement for %s. Replacement must not be set if destinations is set.", location))
+	}
+
+	if rule.Template != nil {
+		problems = append(problems, fmt.Sprintf("Invalid template for %s. Template must not be set if destinations is set.", location))
+	}
+
+	names := map[string]bool{}
+	for index, destination := range rule.Destinations {
+		if destination.Weight <= 0 {
+			problems = append(problems, fmt.Sprintf("Invalid weight %d for destination %d of %s. Weight must be positive.", destination.Weight, index, location))
+		}
+
+		name := destination.label(index)
+		if names[name] {
+			problems = append(problems, fmt.Sprintf("Invalid name '%s' for destination %d of %s. Names must be unique.", name, index, location))
+		}
+		names[name] = true
+	}
+
+	if rule.Sticky != "" && rule.Sticky != StickyClientIP && (!strings.HasPrefix(rule.Sticky, StickyCookiePrefix) || rule.Sticky == StickyCookiePrefix) {
+		problems = append(problems, fmt.Sprintf("Invalid sticky '%s' for %s. Sticky must be '%s' or '%s<name>'.", rule.Sticky, location, StickyClientIP, StickyCookiePrefix))
+	}
+
+	return problems
+}
+
+// label returns the destination's name, or its index if it has no name.
+func (d *WeightedDestination) label(index int) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// chooseDestination returns the index of the destination to use for req. If the rule is sticky, the choice is based on
+// a hash of the client IP or cookie value, so the same client consistently gets the same destination (as long as the
+// destinations and weights do not change). Otherwise, or if the cookie is not present, the choice is random.
+func (r *Rule) chooseDestination(req *http.Request) int {
+	total := 0
+	for _, destination := range r.Destinations {
+		total += destination.Weight
+	}
+
+	key, sticky := r.stickyKey(req)
+
+	var point int
+	if sticky {
+		hash := sha256.Sum256([]byte(key))
+		point = int(binary.BigEndian.Uint64(hash[:8]) % uint64(total))
+	} else {
+		point = randomIntn(total)
+	}
+
+	for index, destination := range r.Destinations {
+		if point < destination.Weight {
+			return index
+		}
+		point -= destination.Weight
+	}
+	return len(r.Destinations) - 1
+}
+
+// stickyKey returns the client IP or cookie value which the choice of destination for req is based on, or false if
+// the choice is random.
+func (r *Rule) stickyKey(req *http.Request) (string, bool) {
+	if r.Sticky == StickyClientIP {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			return host, true
+		}
+		return req.RemoteAddr, true
+	}
+	if name, found := strings.CutPrefix(r.Sticky, StickyCookiePrefix); found {
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,189 @@
+package configuration
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateWeightedDestinations(t *testing.T) {
+	valid := Rule{
+		Regexp: regexp.MustCompile(`^/(?P<page>.*)$`),
+		Code:   302,
+		Destinations: []WeightedDestination{
+			{Name: "old", Replacement: "https://old.example.com/$1", Weight: 90},
+			{Replacement: "https://new.example.com/${page}", Weight: 10},
+		},
+		Sticky: "cookie:session",
+	}
+	if problems := validateRule("example.com", 0, valid); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		description string
+		change      func(rule *Rule)
+		problems    int
+	}{
+		{"zero weight", func(rule *Rule) { rule.Destinations[1].Weight = 0 }, 1},
+		{"negative weight", func(rule *Rule) { rule.Destinations[0].Weight = -5 }, 1},
+		{"replacement also set", func(rule *Rule) { rule.Replacement = "https://example.com/" }, 1},
+		{"duplicate name", func(rule *Rule) { rule.Destinations[0].Name = "1" }, 1},
+		{"invalid destination", func(rule *Rule) { rule.Destinations[1].Replacement = "/relative" }, 1},
+		{"invalid replacement group", func(rule *Rule) { rule.Destinations[0].Replacement = "https://example.com/$2" }, 1},
+		{"sticky client IP", func(rule *Rule) { rule.Sticky = StickyClientIP }, 0},
+		{"sticky random", func(rule *Rule) { rule.Sticky = "" }, 0},
+		{"sticky cookie without name", func(rule *Rule) { rule.Sticky = "cookie:" }, 1},
+		{"sticky unknown", func(rule *Rule) { rule.Sticky = "header:X-User" }, 1},
+		{"sticky without destinations", func(rule *Rule) { rule.Destinations = nil; rule.Replacement = "https://example.com/" }, 1},
+	}
+
+	for _, testCase := range testCases {
+		rule := valid
+		rule.Destinations = append([]WeightedDestination{}, valid.Destinations...)
+		testCase.change(&rule)
+		if problems := validateRule("example.com", 0, rule); len(problems) != testCase.problems {
+			t.Errorf("Expected %d problems for %s, but got %d problems: %v", testCase.problems, testCase.description, len(problems), problems)
+		}
+	}
+}
+
+func TestChooseDestinationRandom(t *testing.T) {
+	previousRandomIntn := randomIntn
+	defer func() { randomIntn = previousRandomIntn }()
+
+	rule := &Rule{
+		Destinations: []WeightedDestination{
+			{Replacement: "https://a.example.com/", Weight: 3},
+			{Replacement: "https://b.example.com/", Weight: 1},
+			{Replacement: "https://c.example.com/", Weight: 6},
+		},
+	}
+
+	counts := make([]int, len(rule.Destinations))
+	for point := 0; point < 10; point++ {
+		randomIntn = func(n int) int {
+			if n != 10 {
+				t.Errorf("Expected random number to be chosen from total weight 10, but got %d", n)
+			}
+			return point
+		}
+		counts[rule.chooseDestination(httptest.NewRequest("GET", "http://example.com/", nil))]++
+	}
+
+	for index, destination := range rule.Destinations {
+		if counts[index] != destination.Weight {
+			t.Errorf("Expected destination %d to be chosen %d times in 10, but got %d", index, destination.Weight, counts[index])
+		}
+	}
+}
+
+func TestChooseDestinationSticky(t *testing.T) {
+	previousRandomIntn := randomIntn
+	defer func() { randomIntn = previousRandomIntn }()
+	randomIntn = func(n int) int {
+		t.Errorf("Expected sticky destination not to be chosen randomly")
+		return 0
+	}
+
+	rule := &Rule{
+		Destinations: []WeightedDestination{
+			{Replacement: "https://a.example.com/", Weight: 1},
+			{Replacement: "https://b.example.com/", Weight: 1},
+		},
+		Sticky: StickyClientIP,
+	}
+
+	for i := 0; i < 12; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2." + strings.Repeat("1", 1+i%3) + ":" + strings.Repeat("9", 1+i%4)
+		first := rule.chooseDestination(req)
+		if second := rule.chooseDestination(req); first != second {
+			t.Errorf("Expected the same destination for client IP %s, but got %d then %d", req.RemoteAddr, first, second)
+		}
+	}
+
+	// Different ports from the same address must give the same destination
+	for _, port := range []string{"1", "65535"} {
+		a := httptest.NewRequest("GET", "http://example.com/", nil)
+		a.RemoteAddr = "198.51.100.7:" + port
+		b := httptest.NewRequest("GET", "http://example.com/", nil)
+		b.RemoteAddr = "198.51.100.7:12345"
+		if rule.chooseDestination(a) != rule.chooseDestination(b) {
+			t.Errorf("Expected the same destination for the same client IP with different ports")
+		}
+	}
+
+	rule.Sticky = "cookie:session"
+	distinct := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Cookie", "session=user"+strings.Repeat("x", i))
+		first := rule.chooseDestination(req)
+		if second := rule.chooseDestination(req); first != second {
+			t.Errorf("Expected the same destination for the same cookie, but got %d then %d", first, second)
+		}
+		distinct[first] = true
+	}
+	if len(distinct) != 2 {
+		t.Errorf("Expected both destinations to be chosen for different cookies, but got %v", distinct)
+	}
+
+	// Without the cookie, the choice is random
+	called := false
+	randomIntn = func(n int) int {
+		called = true
+		return 1
+	}
+	if chosen := rule.chooseDestination(httptest.NewRequest("GET", "http://example.com/", nil)); !called || chosen != 1 {
+		t.Errorf("Expected random choice of destination 1 without cookie, but got %d (random called = %t)", chosen, called)
+	}
+}
+
+func TestResolveWeightedDestinations(t *testing.T) {
+	previousRandomIntn := randomIntn
+	defer func() { randomIntn = previousRandomIntn }()
+
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{
+						"regexp": "^/(.*)$",
+						"destinations": [
+							{"name": "old", "replacement": "https://old.example.com/$1", "weight": 75},
+							{"replacement": "https://new.example.com/$1", "weight": 25}
+						],
+						"code": 302
+					}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		point       int
+		destination string
+		split       string
+	}{
+		{0, "https://old.example.com/page", "old"},
+		{74, "https://old.example.com/page", "old"},
+		{75, "https://new.example.com/page", "1"},
+		{99, "https://new.example.com/page", "1"},
+	}
+
+	for _, testCase := range testCases {
+		randomIntn = func(n int) int { return testCase.point }
+		resolution := config.Resolve(httptest.NewRequest("GET", "http://example.com/page", nil))
+		if resolution.Destination != testCase.destination || resolution.SplitDestination != testCase.split {
+			t.Errorf("Expected destination '%s' (%s) for random point %d, but got '%s' (%s)", testCase.destination, testCase.split, testCase.point, resolution.Destination, resolution.SplitDestination)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds the Config currently in use, and allows it to be atomically replaced at runtime.
+// Readers should call Current() once per unit of work (e.g. once per request) and use that value throughout,
+// so that a reload part way through does not result in a mix of old and new configuration.
+type Store struct {
+	path    string
+	current atomic.Pointer[Config]
+	// reloadMutex ensures only one reload is in progress at a time, and protects loaded
+	reloadMutex sync.Mutex
+	// loaded holds the version of the configuration file, and of each redirect map file it refers to, which was most
+	// recently loaded, keyed by path
+	loaded map[string]fileVersion
+	// unsaved is true if the current Config includes changes made by Update() which were not written to the file
+	unsaved bool
+}
+
+// fileVersion identifies a version of a file by its modification time and size. It is zero for files which do not
+// exist.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFileVersion(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+// NewStore creates a Store which loads configuration from the file at path.
+// The Store is empty until Reload() succeeds or a config is explicitly set with Replace().
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path returns the path of the configuration file backing this Store.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Current returns the Config currently in use. It is safe to call from multiple goroutines.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Replace swaps in config as the current Config, without validating it.
+func (s *Store) Replace(config *Config) {
+	s.current.Store(config)
+}
+
+// Reload reads and validates the configuration file. If there are no problems, the new Config is swapped in;
+// otherwise the current Config is left in place and the problems are returned.
+func (s *Store) Reload() []string {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return []string{fmt.Sprintf("Unable to open configuration file %s: %v", s.path, err)}
+	}
+	defer file.Close()
+
+	var version fileVersion
+	if info, err := file.Stat(); err == nil {
+		version = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	// Record the version of the files we attempted to load even if they turn out to be invalid, so Watch()
+	// does not repeatedly try to reload files which have not changed.
+	config := &Config{}
+	problems := LoadConfig(file, config)
+	s.recordLoaded(version, config)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if s.unsaved {
+		slog.Default().Warn("Discarding configuration changes which were not written to the configuration file", "file", s.path)
+		s.unsaved = false
+	}
+	s.current.Store(config)
+	return nil
+}
+
+// Update applies change to a copy of the current Config and, if the result has no problems, swaps it in as the
+// current Config. If change returns an error, that error is returned and nothing is changed. If persist is true,
+// the new Config is also written to the configuration file, so the change survives a restart.
+func (s *Store) Update(change func(config *Config) error, persist bool) ([]string, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	// Round trip through JSON to get a deep copy, which also ensures the result can be written to the file
+	data, err := json.Marshal(s.current.Load())
+	if err != nil {
+		return nil, err
+	}
+
+	candidate := &Config{}
+	if err := json.Unmarshal(data, candidate); err != nil {
+		return nil, err
+	}
+
+	if err := change(candidate); err != nil {
+		return nil, err
+	}
+
+	if data, err = json.MarshalIndent(candidate, "", "\t"); err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if problems := LoadConfig(bytes.NewReader(data), config); len(problems) > 0 {
+		return problems, nil
+	}
+
+	if persist {
+		if err := s.writeFile(append(data, '\n')); err != nil {
+			return nil, err
+		}
+	}
+
+	// The redirect map files were read again by LoadConfig(), so we have the current version of each loaded
+	s.recordLoaded(s.loaded[s.path], config)
+	s.unsaved = !persist
+	s.current.Store(config)
+	return nil, nil
+}
+
+// recordLoaded records configFile as the loaded version of the configuration file, and the current version of each
+// redirect map file config refers to, so that Watch() reloads when any of them change. The caller must hold
+// reloadMutex.
+func (s *Store) recordLoaded(configFile fileVersion, config *Config) {
+	s.loaded = map[string]fileVersion{s.path: configFile}
+	for _, domain := range config.Domains {
+		if domain.RedirectMapFile != "" {
+			s.loaded[domain.RedirectMapFile] = statFileVersion(domain.RedirectMapFile)
+		}
+	}
+}
+
+// writeFile atomically replaces the configuration file with data. The caller must hold reloadMutex.
+func (s *Store) writeFile(data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(s.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Chmod(mode); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// We already have this version loaded, so Watch() should not reload it
+	if s.loaded == nil {
+		s.loaded = map[string]fileVersion{}
+	}
+	s.loaded[s.path] = statFileVersion(s.path)
+	return nil
+}
+
+// Watch polls the configuration file and the redirect map files it refers to every interval, and calls Reload()
+// whenever the modification time or size of any of them differs from the version most recently loaded. After each
+// reload attempt, onReload is called with any problems found. Watch blocks until stop is closed.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}, onReload func(problems []string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if s.fileChanged() {
+				onReload(s.Reload())
+			}
+		}
+	}
+}
+
+func (s *Store) fileChanged() bool {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	loadedVersions := s.loaded
+	if loadedVersions == nil {
+		// Nothing has been loaded yet
+		loadedVersions = map[string]fileVersion{s.path: {}}
+	}
+
+	for path, loaded := range loadedVersions {
+		info, err := os.Stat(path)
+		if err != nil {
+			// The file may be part way through being replaced, so wait until it reappears
+			continue
+		}
+		if !info.ModTime().Equal(loaded.modTime) || info.Size() != loaded.size {
+			return true
+		}
+	}
+	return false
+}
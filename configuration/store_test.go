@@ -0,0 +1,197 @@
+package configuration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const storeTestValidConfig = `{
+	"listen_address": ":8080",
+	"default_response": {"code": 421},
+	"domains": {
+		"example.com": {
+			"rewrites": [
+				{
+					"regexp": "^(.*)$",
+					"replacement": "https://www.example.com$1",
+					"code": 301
+				}
+			]
+		}
+	}
+}`
+
+func TestStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	store := NewStore(path)
+
+	if store.Current() != nil {
+		t.Errorf("Expected empty store before first reload, but got %v", store.Current())
+	}
+
+	if problems := store.Reload(); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (file does not exist), but got %d problems: %v", len(problems), problems)
+	}
+
+	if err := os.WriteFile(path, []byte(storeTestValidConfig), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	if problems := store.Reload(); len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	original := store.Current()
+	if original == nil || original.ListenAddress != ":8080" {
+		t.Fatalf("Expected config to be loaded, but got %v", original)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"domains": {"Not A Domain": {}}}`), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	if problems := store.Reload(); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (invalid domain), but got %d problems: %v", len(problems), problems)
+	}
+
+	if store.Current() != original {
+		t.Errorf("Expected original config to remain in place after failed reload, but got %v", store.Current())
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(storeTestValidConfig), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	store := NewStore(path)
+	if problems := store.Reload(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	stop := make(chan struct{})
+	reloads := make(chan []string)
+	go store.Watch(time.Millisecond, stop, func(problems []string) { reloads <- problems })
+	defer close(stop)
+
+	// Change the size so the change is detected even on filesystems with coarse modification times
+	if err := os.WriteFile(path, []byte(storeTestValidConfig+"\n"), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	select {
+	case problems := <-reloads:
+		if len(problems) != 0 {
+			t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected config to be reloaded after file changed, but it was not")
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(storeTestValidConfig), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	store := NewStore(path)
+	if problems := store.Reload(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	original := store.Current()
+
+	problems, err := store.Update(func(config *Config) error {
+		config.Domains["example.com"].RewriteRules[0].Code = 200
+		return nil
+	}, false)
+	if err != nil || len(problems) != 1 {
+		t.Errorf("Expected 1 problem (invalid rule code), but got %d problems: %v (error: %v)", len(problems), problems, err)
+	}
+	if store.Current() != original || original.Domains["example.com"].RewriteRules[0].Code != 301 {
+		t.Errorf("Expected original config to be unchanged after failed update, but got %v", store.Current())
+	}
+
+	problems, err = store.Update(func(config *Config) error {
+		config.DefaultResponse.Code = 404
+		return nil
+	}, false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected no problems, but got %d problems: %v (error: %v)", len(problems), problems, err)
+	}
+	if store.Current().DefaultResponse.Code != 404 || original.DefaultResponse.Code != 421 {
+		t.Errorf("Expected only the new config to be changed, but got %d (new) and %d (original)", store.Current().DefaultResponse.Code, original.DefaultResponse.Code)
+	}
+
+	// Without persist, the file is unchanged and is not treated as changed
+	if store.fileChanged() {
+		t.Errorf("Expected config file to be unchanged")
+	}
+	if !store.unsaved {
+		t.Errorf("Expected config to be recorded as having unsaved changes")
+	}
+
+	if _, err := store.Update(func(config *Config) error {
+		config.DefaultResponse.Code = 410
+		return nil
+	}, true); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if store.fileChanged() {
+		t.Errorf("Expected written config file to be recorded as the loaded version")
+	}
+	if store.unsaved {
+		t.Errorf("Expected config not to be recorded as having unsaved changes after it was written")
+	}
+
+	reloaded := NewStore(path)
+	if problems := reloaded.Reload(); len(problems) != 0 || reloaded.Current().DefaultResponse.Code != 410 {
+		t.Errorf("Expected written config to load with code 410, but got %v (problems: %v)", reloaded.Current(), problems)
+	}
+}
+
+func TestStoreWatchRedirectMap(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "config.json")
+	redirectMapPath := filepath.Join(directory, "redirects.csv")
+	if err := os.WriteFile(redirectMapPath, []byte("/old,https://example.com/new,301\n"), 0o600); err != nil {
+		t.Fatalf("Unable to write redirect map: %v", err)
+	}
+	config := fmt.Sprintf(`{"default_response": {"code": 421}, "domains": {"example.com": {"redirect_map": %q}}}`, redirectMapPath)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+
+	store := NewStore(path)
+	if problems := store.Reload(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+	if store.fileChanged() {
+		t.Errorf("Expected files to be unchanged after reload")
+	}
+
+	stop := make(chan struct{})
+	reloads := make(chan []string)
+	go store.Watch(time.Millisecond, stop, func(problems []string) { reloads <- problems })
+	defer close(stop)
+
+	if err := os.WriteFile(redirectMapPath, []byte("/old,https://example.com/newer,301\n"), 0o600); err != nil {
+		t.Fatalf("Unable to write redirect map: %v", err)
+	}
+
+	select {
+	case problems := <-reloads:
+		if len(problems) != 0 {
+			t.Errorf("Expected no problems, but got %d problems: %v", len(problems), problems)
+		}
+		if destination := store.Current().Domains["example.com"].RedirectMap["/old"].Destination; destination != "https://example.com/newer" {
+			t.Errorf("Expected reloaded redirect map destination %s, but got %s", "https://example.com/newer", destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected config to be reloaded after redirect map changed, but it was not")
+	}
+}
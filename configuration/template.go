@@ -0,0 +1,228 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Template is a text/template which renders a Rule's destination. It is represented in JSON as the template text.
+type Template struct {
+	text     string
+	template *template.Template
+}
+
+// TemplateData is available to a Template as ".".
+type TemplateData struct {
+	// Captures contains the sub-patterns matched by the rule's regexp, keyed by both index ("0" is the whole match)
+	// and name (for named sub-patterns).
+	Captures map[string]string
+
+	// Host is in lower case, without any port, and Subdomain is the part of Host before the domain which matched
+	Host      string
+	Subdomain string
+
+	Method string
+
+	// Path is decoded (e.g. "/a b"), RawQuery is encoded and does not include the "?", and RequestURI is the encoded
+	// path and query (e.g. "/a%20b?c=d")
+	Path       string
+	RawQuery   string
+	Query      url.Values
+	RequestURI string
+
+	// Headers is keyed by canonical header name (e.g. "Accept-Language"), and only includes the first value of each
+	Headers map[string]string
+
+	ClientIP string
+}
+
+var templateFuncs = template.FuncMap{
+	"lower":       strings.ToLower,
+	"upper":       strings.ToUpper,
+	"trimPrefix":  func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix":  func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":     func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+	"pathEscape":  url.PathEscape,
+	"queryEscape": url.QueryEscape,
+	"setQuery":    setQueryParam,
+	"stripQuery":  stripQueryParams,
+}
+
+func parseTemplate(text string) (*Template, error) {
+	parsed, err := template.New("template").Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{text: text, template: parsed}, nil
+}
+
+func (t *Template) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(text)
+	if err != nil {
+		return err
+	}
+	*t = *parsed
+	return nil
+}
+
+func (t *Template) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.text)
+}
+
+func (t *Template) String() string {
+	return t.text
+}
+
+// Render executes the template with data, returning the destination.
+func (t *Template) Render(data *TemplateData) (string, error) {
+	var result strings.Builder
+	if err := t.template.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// literalPrefix returns the text before the first action in the template.
+func (t *Template) literalPrefix() string {
+	if t.template.Tree == nil || t.template.Tree.Root == nil || len(t.template.Tree.Root.Nodes) == 0 {
+		return ""
+	}
+	if text, ok := t.template.Tree.Root.Nodes[0].(*parse.TextNode); ok {
+		return string(text.Text)
+	}
+	return ""
+}
+
+// setQueryParam sets key to value in the query string of rawURL. Its argument order allows it to be used at the end of
+// a pipeline, e.g. {{"https://example.com/" | setQuery "key" "value"}}.
+func setQueryParam(key string, value string, rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Set(key, value)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// stripQueryParams removes the given keys from the query string of the URL in its last argument, or the whole query
+// string if only a URL is given, e.g. {{.RequestURI | stripQuery "utm_source" "utm_medium"}}.
+func stripQueryParams(args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("stripQuery requires a URL")
+	}
+	keys, rawURL := args[:len(args)-1], args[len(args)-1]
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		parsed.RawQuery = ""
+	} else {
+		query := parsed.Query()
+		for _, key := range keys {
+			query.Del(key)
+		}
+		parsed.RawQuery = query.Encode()
+	}
+	parsed.ForceQuery = false
+	return parsed.String(), nil
+}
+
+// validateTemplate renders t with placeholder values for every capture and request field, to catch errors which
+// text/template only reports when the template is executed. It also checks that any text at the start of the
+// template is consistent with an http or https destination. Destinations are checked again when they are rendered.
+func validateTemplate(location string, re *regexp.Regexp, t *Template) []string {
+	var problems []string
+
+	data := &TemplateData{
+		Captures:   map[string]string{},
+		Host:       "www.example.com",
+		Subdomain:  "www",
+		Method:     "GET",
+		Path:       "/",
+		Query:      url.Values{},
+		RequestURI: "/",
+		Headers:    map[string]string{},
+		ClientIP:   "192.0.2.1",
+	}
+	if re != nil {
+		for index, name := range re.SubexpNames() {
+			data.Captures[strconv.Itoa(index)] = ""
+			if name != "" {
+				data.Captures[name] = ""
+			}
+		}
+	}
+
+	if _, err := t.Render(data); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid template for %s: %v", location, err))
+	}
+
+	prefix := t.literalPrefix()
+	if !isDestinationPrefix(prefix) {
+		problems = append(problems, fmt.Sprintf("Invalid template for %s. Destination must begin with 'http://' or 'https://'.", location))
+	}
+
+	return problems
+}
+
+// isDestinationPrefix reports whether prefix could be the start of a destination which begins with http:// or https://
+func isDestinationPrefix(prefix string) bool {
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(prefix, scheme) || strings.HasPrefix(scheme, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTemplateData builds the data for a template from req, where match is the result of re.FindStringSubmatch().
+func newTemplateData(req *http.Request, re *regexp.Regexp, match []string, host string, subdomain string) *TemplateData {
+	data := &TemplateData{
+		Captures:   map[string]string{},
+		Host:       host,
+		Subdomain:  subdomain,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		RawQuery:   req.URL.RawQuery,
+		Query:      req.URL.Query(),
+		RequestURI: req.URL.RequestURI(),
+		Headers:    map[string]string{},
+		ClientIP:   req.RemoteAddr,
+	}
+
+	for index, name := range re.SubexpNames() {
+		data.Captures[strconv.Itoa(index)] = match[index]
+		if name != "" {
+			data.Captures[name] = match[index]
+		}
+	}
+
+	for name, values := range req.Header {
+		if len(values) > 0 {
+			data.Headers[name] = values[0]
+		}
+	}
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		data.ClientIP = clientIP
+	}
+
+	return data
+}
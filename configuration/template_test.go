@@ -0,0 +1,168 @@
+package configuration
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{`{{"Hello" | lower}}`, "hello"},
+		{`{{"Hello" | upper}}`, "HELLO"},
+		{`{{"/path/" | trimSuffix "/"}}`, "/path"},
+		{`{{"/path/" | trimPrefix "/"}}`, "path/"},
+		{`{{"a-b-c" | replace "-" "_"}}`, "a_b_c"},
+		{`{{"a b&c" | urlquery}}`, "a+b%26c"},
+		{`{{"a b&c" | queryEscape}}`, "a+b%26c"},
+		{`{{"a b/c" | pathEscape}}`, "a%20b%2Fc"},
+		{`{{"https://example.com/?a=1" | setQuery "b" "x y"}}`, "https://example.com/?a=1&b=x+y"},
+		{`{{"https://example.com/?a=1" | setQuery "a" "2"}}`, "https://example.com/?a=2"},
+		{`{{"https://example.com/p?a=1&utm_source=x&utm_medium=y" | stripQuery "utm_source" "utm_medium"}}`, "https://example.com/p?a=1"},
+		{`{{"https://example.com/p?a=1&b=2" | stripQuery}}`, "https://example.com/p"},
+		{`{{"https://example.com/p?utm_source=x" | stripQuery "utm_source"}}`, "https://example.com/p"},
+	}
+
+	for _, testCase := range testCases {
+		parsed, err := parseTemplate(testCase.template)
+		if err != nil {
+			t.Errorf("Unable to parse template %s: %v", testCase.template, err)
+			continue
+		}
+		if result, err := parsed.Render(&TemplateData{}); err != nil || result != testCase.expected {
+			t.Errorf("Expected template %s to render '%s', but got '%s' (error: %v)", testCase.template, testCase.expected, result, err)
+		}
+	}
+}
+
+func TestTemplateJSON(t *testing.T) {
+	rule := Rule{}
+	if err := json.Unmarshal([]byte(`{"regexp": "^/(.*)$", "template": "https://example.com/{{index .Captures \"1\"}}", "code": 301}`), &rule); err != nil {
+		t.Fatalf("Unable to unmarshal rule: %v", err)
+	}
+	if rule.Template == nil || rule.Template.String() != `https://example.com/{{index .Captures "1"}}` {
+		t.Errorf("Expected template to be parsed, but got %v", rule.Template)
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil || !strings.Contains(string(data), `"template":"https://example.com/{{index .Captures \"1\"}}"`) {
+		t.Errorf("Expected template in marshalled rule, but got %s (error: %v)", data, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"regexp": "^/(.*)$", "template": "https://example.com/{{.Path", "code": 301}`), &rule); err == nil {
+		t.Errorf("Expected error unmarshalling invalid template, but got none")
+	}
+}
+
+func TestValidateTemplateRule(t *testing.T) {
+	testCases := []struct {
+		template    string
+		replacement string
+		action      string
+		problems    int
+	}{
+		{`https://example.com{{.Path}}`, "", "", 0},
+		{`{{if eq .Host "www.example.com"}}https://example.com/{{else}}https://example.org/{{end}}`, "", "", 0},
+		{`http{{if .Headers.Https}}s{{end}}://example.com/`, "", "", 0},
+		{`http://127.0.0.1:8000/{{.Captures.slug}}`, "", ActionProxy, 0},
+		{`https://example.com/{{.Captures.missing}}`, "", "", 0},
+		{`https://example.com/{{.Missing}}`, "", "", 1},
+		{`https://example.com/{{index .Query.tag 3}}`, "", "", 1},
+		{`/relative/{{.Path}}`, "", "", 1},
+		{`{{.Path}}`, "", "", 0},
+		{`https://example.com/`, "https://example.com/", "", 1},
+	}
+
+	for _, testCase := range testCases {
+		parsed, err := parseTemplate(testCase.template)
+		if err != nil {
+			t.Errorf("Unable to parse template %s: %v", testCase.template, err)
+			continue
+		}
+		rule := Rule{
+			Regexp:      regexp.MustCompile(`^/(?P<slug>.*)$`),
+			Replacement: testCase.replacement,
+			Template:    parsed,
+			Action:      testCase.action,
+			Code:        301,
+		}
+		if testCase.action == ActionProxy {
+			rule.Code = 0
+		}
+
+		if problems := validateRule("example.com", 0, rule); len(problems) != testCase.problems {
+			t.Errorf("Expected %d problems for template %s, but got %d problems: %v", testCase.problems, testCase.template, len(problems), problems)
+		}
+	}
+}
+
+func TestResolveTemplate(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.net": {
+				"match_subdomains": true,
+				"rewrites": [
+					{
+						"regexp": "^/docs/(?P<page>[^?]*)",
+						"template": "https://docs.example.com/{{with index .Headers \"Accept-Language\"}}{{lower .}}/{{end}}{{.Captures.page | trimSuffix \"/\"}}{{with .Query.Get \"q\"}}?search={{urlquery .}}{{end}}",
+						"code": 302
+					},
+					{
+						"regexp": "^/go",
+						"template": "{{.Query.Get \"to\"}}",
+						"code": 302
+					},
+					{
+						"regexp": "^/who",
+						"template": "{{\"https://example.com/\" | setQuery \"ip\" .ClientIP | setQuery \"sub\" .Subdomain}}",
+						"code": 302
+					},
+					{
+						"regexp": "^/clean",
+						"template": "{{printf \"https://%s%s\" .Host .RequestURI | stripQuery \"utm_source\"}}",
+						"code": 301
+					}
+				]
+			}
+		}
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 0 {
+		t.Fatalf("Expected no problems, but got %d problems: %v", len(problems), problems)
+	}
+
+	testCases := []struct {
+		url         string
+		destination string
+		error       bool
+	}{
+		{"http://example.net/docs/intro/?q=a+b", "https://docs.example.com/en/intro?search=a+b", false},
+		{"http://example.net/go?to=https://example.org/x", "https://example.org/x", false},
+		{"http://example.net/go?to=/relative", "", true},
+		{"http://example.net/go", "", true},
+		{"http://foo.example.net/who", "https://example.com/?ip=192.0.2.1&sub=foo", false},
+		{"http://example.net/clean/x?utm_source=mail&id=3", "https://example.net/clean/x?id=3", false},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", testCase.url, nil)
+		req.Header.Set("Accept-Language", "EN")
+		resolution := config.Resolve(req)
+		if resolution.Destination != testCase.destination {
+			t.Errorf("Expected %s to have destination '%s', but got '%s'", testCase.url, testCase.destination, resolution.Destination)
+		}
+		if (resolution.Error != nil) != testCase.error {
+			t.Errorf("Expected %s to have error = %t, but got %v", testCase.url, testCase.error, resolution.Error)
+		}
+		if testCase.error && (resolution.DefaultResponse == nil || resolution.Code != 421) {
+			t.Errorf("Expected %s to use the default response after a template error, but got %+v", testCase.url, resolution)
+		}
+	}
+}
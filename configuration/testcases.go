@@ -0,0 +1,100 @@
+package configuration
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TestCase is a request and its expected response, given in the tests array of the config file. Tests are checked
+// by LoadConfig(), so that a change to the config which breaks an existing redirect is reported as a problem.
+type TestCase struct {
+	URL        string            `json:"url"`
+	Method     string            `json:"method,omitempty" note:"Defaults to GET"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty" note:"The client's address, e.g. 192.0.2.1, checked against allow_cidrs and deny_cidrs"`
+	Code       int               `json:"code" note:"Expected status code; 0 for a default response which closes the connection, or for a proxy rule"`
+	Location   string            `json:"location,omitempty" note:"Expected Location header, or destination for a proxy rule; not checked if empty"`
+}
+
+// runTests checks each of the config's tests against Resolve(), returning a problem for each which fails.
+func (c *Config) runTests() []string {
+	var problems []string
+
+	for index, test := range c.Tests {
+		method := test.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		location := fmt.Sprintf("test at index %d (%s %s)", index, method, test.URL)
+
+		req, err := http.NewRequest(method, test.URL, nil)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid %s: %v", location, err))
+			continue
+		}
+		for name, value := range test.Headers {
+			req.Header.Set(name, value)
+		}
+		req.RemoteAddr = test.RemoteAddr
+
+		resolution := c.Resolve(req)
+		if resolution.Error != nil {
+			problems = append(problems, fmt.Sprintf("Failed %s: %v", location, resolution.Error))
+			continue
+		}
+		if resolution.Blocked == nil && resolution.RedirectMapEntry == nil && resolution.Rule == nil && resolution.DefaultResponse == nil {
+			problems = append(problems, fmt.Sprintf("Failed %s: no rule matched and there is no default_response", location))
+			continue
+		}
+
+		if resolution.Code != test.Code {
+			problems = append(problems, fmt.Sprintf("Failed %s: expected code %d, but got %d from %s", location, test.Code, resolution.Code, describeResolution(resolution)))
+		}
+
+		if test.Location != "" && !slices.Contains(resolution.RandomDestinations, test.Location) {
+			if actual := resolvedLocation(resolution); actual != test.Location {
+				problems = append(problems, fmt.Sprintf("Failed %s: expected location %s, but got '%s' from %s", location, test.Location, actual, describeResolution(resolution)))
+			}
+		}
+	}
+
+	return problems
+}
+
+// resolvedLocation returns the Location header which would be sent for resolution, or the destination for proxy rules.
+func resolvedLocation(resolution Resolution) string {
+	response := resolution.DefaultResponse
+	if resolution.Blocked != nil {
+		response = resolution.Blocked.Response
+	}
+	if response == nil {
+		return resolution.Destination
+	}
+
+	for header, value := range response.Headers {
+		if strings.EqualFold(header, "Location") {
+			return value
+		}
+	}
+	return ""
+}
+
+func describeResolution(resolution Resolution) string {
+	switch {
+	case resolution.Blocked != nil:
+		return fmt.Sprintf("blocked_response from %s (client refused by %s)", resolution.Blocked.List, resolution.Blocked.Reason)
+	case resolution.RedirectMapEntry != nil:
+		return fmt.Sprintf("redirect_map entry %s for domain %s", resolution.RedirectMapSource, resolution.Domain)
+	case resolution.Rule != nil:
+		if resolution.Rule.ID != "" {
+			return fmt.Sprintf("rule %s at index %d for domain %s", resolution.Rule.ID, resolution.RuleIndex, resolution.Domain)
+		}
+		return fmt.Sprintf("rule at index %d for domain %s", resolution.RuleIndex, resolution.Domain)
+	case resolution.DefaultResponse != nil && resolution.DefaultResponse.ID != "":
+		return fmt.Sprintf("default_response %s from %s", resolution.DefaultResponse.ID, resolution.DefaultResponseSource)
+	default:
+		return fmt.Sprintf("default_response from %s", resolution.DefaultResponseSource)
+	}
+}
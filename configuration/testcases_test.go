@@ -0,0 +1,141 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigTests(t *testing.T) {
+	jsonData := `{
+		"listen_address": ":8080",
+		"default_response": {"code": 421},
+		"deny_cidrs": ["203.0.113.0/24"],
+		"domains": {
+			"example.com": {
+				"match_subdomains": true,
+				"rewrites": [
+					{"regexp": "^/old/(.*)$", "replacement": "https://example.com/new/$1", "code": 301},
+					{"regexp": "^/api/(.*)$", "replacement": "http://127.0.0.1:8000/$1", "action": "proxy"}
+				]
+			},
+			"example.net": {
+				"default_response": {"code": 302, "headers": {"location": "https://example.com/"}}
+			}
+		},
+		"tests": [
+			%s
+		]
+	}`
+
+	testCases := []struct {
+		tests    string
+		problems []string
+	}{
+		{
+			`{"url": "https://www.example.com/old/page?x=1", "code": 301, "location": "https://example.com/new/page?x=1"},
+			{"url": "https://example.com/api/status", "method": "POST", "headers": {"Accept": "application/json"}, "code": 0, "location": "http://127.0.0.1:8000/status"},
+			{"url": "https://example.net/anything", "code": 302, "location": "https://example.com/"},
+			{"url": "https://example.org/", "code": 421}`,
+			nil,
+		},
+		{
+			`{"url": "https://example.com/old/page", "code": 308, "location": "https://example.com/new/other"}`,
+			[]string{
+				"Failed test at index 0 (GET https://example.com/old/page): expected code 308, but got 301 from rule at index 0 for domain example.com",
+				"Failed test at index 0 (GET https://example.com/old/page): expected location https://example.com/new/other, but got 'https://example.com/new/page' from rule at index 0 for domain example.com",
+			},
+		},
+		{
+			`{"url": "https://example.com/elsewhere", "code": 301, "location": "https://example.com/"}`,
+			[]string{
+				"Failed test at index 0 (GET https://example.com/elsewhere): expected code 301, but got 421 from default_response from default",
+				"Failed test at index 0 (GET https://example.com/elsewhere): expected location https://example.com/, but got '' from default_response from default",
+			},
+		},
+		{
+			`{"url": "https://example.com/old/page", "remote_addr": "203.0.113.7", "code": 403},
+			{"url": "https://example.com/old/page", "remote_addr": "192.0.2.1:1234", "code": 301}`,
+			nil,
+		},
+		{
+			`{"url": "https://example.com/old/page", "remote_addr": "203.0.113.7", "code": 301}`,
+			[]string{"Failed test at index 0 (GET https://example.com/old/page): expected code 301, but got 403 from blocked_response from global (client refused by deny_cidrs)"},
+		},
+		{
+			`{"url": "https://example.com/%zz", "code": 301}`,
+			[]string{`Invalid test at index 0 (GET https://example.com/%zz): parse "https://example.com/%zz": invalid URL escape "%zz"`},
+		},
+	}
+
+	for _, testCase := range testCases {
+		config := &Config{}
+		problems := LoadConfig(strings.NewReader(strings.Replace(jsonData, "%s", testCase.tests, 1)), config)
+		if len(problems) != len(testCase.problems) {
+			t.Errorf("Expected %d problems, but got %d problems: %v", len(testCase.problems), len(problems), problems)
+			continue
+		}
+		for i := range problems {
+			if problems[i] != testCase.problems[i] {
+				t.Errorf("Expected problem '%s', but got '%s'", testCase.problems[i], problems[i])
+			}
+		}
+	}
+}
+
+func TestLoadConfigTestsNotRunWithOtherProblems(t *testing.T) {
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [{"regexp": "^(.*)$", "replacement": "https://example.com$2", "code": 301}]
+			}
+		},
+		"tests": [{"url": "https://example.com/", "code": 200}]
+	}`
+
+	config := &Config{}
+	if problems := LoadConfig(strings.NewReader(jsonData), config); len(problems) != 1 {
+		t.Errorf("Expected 1 problem (invalid replacement), but got %d problems: %v", len(problems), problems)
+	}
+}
+
+func TestLoadConfigTestsRandomDestinations(t *testing.T) {
+	previousRandomIntn := randomIntn
+	defer func() { randomIntn = previousRandomIntn }()
+
+	jsonData := `{
+		"default_response": {"code": 421},
+		"domains": {
+			"example.com": {
+				"rewrites": [
+					{
+						"regexp": "^(.*)$",
+						"destinations": [
+							{"replacement": "https://a.example.com$1", "weight": 1},
+							{"replacement": "https://b.example.com$1", "weight": 1}
+						],
+						"code": 302
+					}
+				]
+			}
+		},
+		"tests": [%s]
+	}`
+
+	for point := 0; point < 2; point++ {
+		randomIntn = func(n int) int { return point }
+
+		config := &Config{}
+		tests := `{"url": "https://example.com/x", "code": 302, "location": "https://a.example.com/x"},
+			{"url": "https://example.com/x", "code": 302, "location": "https://b.example.com/x"}`
+		if problems := LoadConfig(strings.NewReader(strings.Replace(jsonData, "%s", tests, 1)), config); len(problems) != 0 {
+			t.Errorf("Expected no problems when destination %d is chosen, but got %d problems: %v", point, len(problems), problems)
+		}
+
+		config = &Config{}
+		tests = `{"url": "https://example.com/x", "code": 302, "location": "https://c.example.com/x"}`
+		if problems := LoadConfig(strings.NewReader(strings.Replace(jsonData, "%s", tests, 1)), config); len(problems) != 1 {
+			t.Errorf("Expected 1 problem (location matches no destination), but got %d problems: %v", len(problems), problems)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package configuration
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tracing configures export of OpenTelemetry traces over OTLP.
+type Tracing struct {
+	Endpoint    string            `json:"endpoint" note:"Host and port of the OTLP collector, e.g. \"localhost:4318\""`
+	Protocol    string            `json:"protocol,omitempty" note:"\"http/protobuf\" or \"grpc\"; defaults to \"http/protobuf\""`
+	Insecure    bool              `json:"insecure,omitempty" note:"Connect to the collector without TLS"`
+	URLPath     string            `json:"url_path,omitempty" note:"Path to send traces to, for protocol \"http/protobuf\"; defaults to \"/v1/traces\""`
+	Headers     map[string]string `json:"headers,omitempty" note:"Headers (e.g. for authentication) sent with each export"`
+	Timeout     Duration          `json:"timeout,omitempty" note:"Timeout for each export; defaults to 10s"`
+	ServiceName string            `json:"service_name,omitempty" note:"Defaults to \"redirector\""`
+	SampleRatio *float64          `json:"sample_ratio,omitempty" note:"Proportion of traces to sample, between 0 and 1, unless the incoming traceparent says otherwise; defaults to 1"`
+}
+
+const (
+	TracingProtocolHTTP = "http/protobuf"
+	TracingProtocolGRPC = "grpc"
+)
+
+func validateTracing(tracing *Tracing) []string {
+	var problems []string
+
+	if tracing.Endpoint == "" {
+		problems = append(problems, "Invalid tracing configuration. endpoint must be set.")
+	}
+
+	switch tracing.Protocol {
+	case "", TracingProtocolHTTP:
+	case TracingProtocolGRPC:
+		if tracing.URLPath != "" {
+			problems = append(problems, fmt.Sprintf("Invalid tracing configuration. url_path may only be set if protocol is '%s'.", TracingProtocolHTTP))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid tracing protocol '%s'. Protocol must be '%s' or '%s'.", tracing.Protocol, TracingProtocolHTTP, TracingProtocolGRPC))
+	}
+
+	if tracing.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid tracing timeout %s. Timeout must not be negative.", time.Duration(tracing.Timeout)))
+	}
+
+	if tracing.SampleRatio != nil && (*tracing.SampleRatio < 0 || *tracing.SampleRatio > 1) {
+		problems = append(problems, fmt.Sprintf("Invalid tracing sample_ratio %g. Ratio must be between 0 and 1.", *tracing.SampleRatio))
+	}
+
+	return problems
+}
@@ -0,0 +1,37 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigTracing(t *testing.T) {
+	valid := []string{
+		`{"endpoint": "localhost:4318"}`,
+		`{"endpoint": "otel.example.com:4317", "protocol": "grpc", "headers": {"Authorization": "Bearer token"}, "timeout": "5s", "service_name": "redirects", "sample_ratio": 0.25}`,
+	}
+	for _, tracing := range valid {
+		config := &Config{}
+		if problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "tracing": `+tracing+`}`), config); len(problems) != 0 {
+			t.Errorf("Expected no problems with tracing %s, but got %d problems: %v", tracing, len(problems), problems)
+		}
+	}
+
+	invalid := []struct {
+		tracing string
+		problem string
+	}{
+		{`{}`, "endpoint must be set"},
+		{`{"endpoint": "localhost:4318", "protocol": "http/json"}`, "protocol 'http/json'"},
+		{`{"endpoint": "localhost:4317", "protocol": "grpc", "url_path": "/v1/traces"}`, "url_path may only be set"},
+		{`{"endpoint": "localhost:4318", "timeout": "-1s"}`, "must not be negative"},
+		{`{"endpoint": "localhost:4318", "sample_ratio": 1.5}`, "sample_ratio 1.5"},
+	}
+	for _, testCase := range invalid {
+		config := &Config{}
+		problems := LoadConfig(strings.NewReader(`{"default_response": {"code": 421}, "tracing": `+testCase.tracing+`}`), config)
+		if len(problems) != 1 || !strings.Contains(problems[0], testCase.problem) {
+			t.Errorf("Expected 1 problem containing '%s' with tracing %s, but got %d problems: %v", testCase.problem, testCase.tracing, len(problems), problems)
+		}
+	}
+}
@@ -1,19 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
 
 	"log/slog"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	"github.com/mjec/redirector/admin"
+	"github.com/mjec/redirector/certificates"
 	"github.com/mjec/redirector/configuration"
 	"github.com/mjec/redirector/server"
+	"github.com/mjec/redirector/tracing"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runTest(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
@@ -23,51 +41,220 @@ func main() {
 	}
 
 	logger.Info("Loading config", "file", configFilePath)
-	file, err := os.Open(configFilePath)
-	if err != nil {
-		logger.Error("Unable to open configuration file", "file", configFilePath, "error", err)
-		os.Exit(1)
-	}
-	defer file.Close()
-
-	config := &configuration.Config{}
-	if problems := configuration.LoadConfig(file, config); len(problems) > 0 {
+	store := configuration.NewStore(configFilePath)
+	if problems := store.Reload(); len(problems) > 0 {
 		logger.Error("Unable to start due to errors in configuration", "error_count", len(problems))
 		for _, problem := range problems {
 			logger.Error("Configuration error", "error", problem)
 		}
 		os.Exit(1)
 	}
+	config := store.Current()
+	logWarnings(logger, config)
+
+	var tracerProvider *sdktrace.TracerProvider
+	if config.Tracing != nil {
+		var err error
+		tracerProvider, err = tracing.NewProvider(context.Background(), config.Tracing)
+		if err != nil {
+			logger.Error("Unable to set up tracing", "error", err)
+			os.Exit(1)
+		}
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			logger.Warn("Error exporting traces", "error", err)
+		}))
+		logger.Info("Exporting traces", "endpoint", config.Tracing.Endpoint, "protocol", config.Tracing.Protocol)
+	}
 
 	metrics := &server.Metrics{
-		InFlightRequests: prometheus.NewGauge(prometheus.GaugeOpts{Name: "in_flight_requests", Help: "A gauge of requests currently being served"}),
-		TotalRequests:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "A counter for requests"}, []string{"domain", "rule_index", "method", "code"}),
-		HandlerDuration:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "request_duration_seconds", Help: "A histogram of latencies for requests"}, []string{"domain", "rule_index", "method", "code"}),
+		InFlightRequests:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "in_flight_requests", Help: "A gauge of requests currently being served"}),
+		TotalRequests:       prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "A counter for requests"}, []string{"domain", "rule_index", "split_destination", "method", "code"}),
+		HandlerDuration:     prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "request_duration_seconds", Help: "A histogram of latencies for requests"}, []string{"domain", "rule_index", "split_destination", "method", "code"}),
+		RateLimitedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rate_limited_requests_total", Help: "A counter for requests refused by a rate limit"}, []string{"limit"}),
+		BlockedRequests:     prometheus.NewCounterVec(prometheus.CounterOpts{Name: "blocked_requests_total", Help: "A counter for requests refused by allow_cidrs or deny_cidrs"}, []string{"list", "reason"}),
 	}
 
+	// Servers which accept requests from clients are shut down first, and the rest once those have finished, so that
+	// metrics (including in_flight_requests) can still be collected while requests are drained.
+	var frontServers, backServers []*http.Server
+	serveErrors := make(chan error, 4)
+
 	if config.MetricsAddress != "" {
-		if config.MetricsPath == "" {
-			config.MetricsPath = "/metrics"
-		}
+		metricsPath := metricsPathOrDefault(config)
 
 		prometheus.MustRegister(metrics.InFlightRequests)
 		prometheus.MustRegister(metrics.TotalRequests)
 		prometheus.MustRegister(metrics.HandlerDuration)
+		prometheus.MustRegister(metrics.RateLimitedRequests)
+		prometheus.MustRegister(metrics.BlockedRequests)
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "active_rules", Help: "A gauge of rewrite rules which are currently active"},
+			func() float64 { return float64(store.Current().ActiveRules()) },
+		))
+
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle(metricsPath, promhttp.Handler())
+		metricsServer := server.NewHTTPServer(config, config.MetricsAddress, metricsMux)
+		backServers = append(backServers, metricsServer)
 
 		go func() {
-			http.Handle(config.MetricsPath, promhttp.Handler())
-			http.ListenAndServe(config.MetricsAddress, nil)
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- fmt.Errorf("metrics server: %w", err)
+			}
 		}()
-		logger.Info("Listening for prometheus connections", "address", config.MetricsAddress, "path", config.MetricsPath)
+		logger.Info("Listening for prometheus connections", "address", config.MetricsAddress, "path", metricsPath)
 	} else {
 		logger.Info("Metrics collection disabled because metrics_address is not set or set to an empty string or null")
 	}
 
-	http.HandleFunc("/", http.HandlerFunc(server.MakeHandler(config, metrics)))
-	logger.Info("Listening for remote connections", "address", config.ListenAddress)
-	err = http.ListenAndServe(config.ListenAddress, nil)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			logger.Info("Reloading config on SIGHUP", "file", configFilePath)
+			logReloadResult(logger, config, store, store.Reload())
+		}
+	}()
+
+	if config.ConfigWatchInterval > 0 {
+		go store.Watch(time.Duration(config.ConfigWatchInterval), nil, func(problems []string) {
+			logger.Info("Reloaded config after file changed", "file", configFilePath)
+			logReloadResult(logger, config, store, problems)
+		})
+		logger.Info("Watching config file for changes", "file", configFilePath, "interval", time.Duration(config.ConfigWatchInterval))
+	}
+
+	if config.AdminAddress != "" {
+		adminServer := server.NewHTTPServer(config, config.AdminAddress, http.HandlerFunc(admin.MakeHandler(store)))
+		backServers = append(backServers, adminServer)
+
+		go func() {
+			if err := adminServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- fmt.Errorf("admin server: %w", err)
+			}
+		}()
+		logger.Info("Listening for admin API connections", "address", config.AdminAddress, "write_config", config.AdminWriteConfig)
+	}
+
+	handler := http.HandlerFunc(server.MakeReloadableHandler(store, metrics))
+
+	certificateManager := certificates.NewManager(store.Current)
+	if config.TLSListenAddress != "" {
+		if config.ACME != nil {
+			if err := certificateManager.EnableACME(config.ACME); err != nil {
+				logger.Error("Unable to set up ACME", "error", err)
+				os.Exit(1)
+			}
+			go certificateManager.PrefetchACME()
+			logger.Info("Obtaining certificates over ACME", "cache_dir", config.ACME.CacheDir)
+		}
+
+		tlsServer := server.NewHTTPServer(config, config.TLSListenAddress, handler)
+		tlsServer.TLSConfig = certificateManager.TLSConfig()
+		frontServers = append(frontServers, tlsServer)
+
+		go func() {
+			if err := tlsServer.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- fmt.Errorf("TLS server: %w", err)
+			}
+		}()
+		logger.Info("Listening for remote TLS connections", "address", config.TLSListenAddress)
+	}
+
+	listener, err := net.Listen("tcp", config.ListenAddress)
 	if err != nil {
+		logger.Error("Unable to listen", "address", config.ListenAddress, "error", err)
+		os.Exit(1)
+	}
+	if len(config.ProxyProtocol) > 0 {
+		listener = server.NewProxyProtocolListener(listener, config.IsProxyProtocolSource)
+		logger.Info("Accepting PROXY protocol headers", "sources", config.ProxyProtocol)
+	}
+
+	httpServer := server.NewHTTPServer(config, config.ListenAddress, certificateManager.HTTPHandler(handler))
+	frontServers = append(frontServers, httpServer)
+
+	go func() {
+		if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			serveErrors <- fmt.Errorf("server: %w", err)
+		}
+	}()
+	logger.Info("Listening for remote connections", "address", config.ListenAddress)
+
+	shutdownSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serveErrors:
 		logger.Error("Server shut down", "error", err)
 		os.Exit(1)
+	case received := <-shutdownSignals:
+		timeout := server.ShutdownTimeout(store.Current())
+		logger.Info("Shutting down; waiting for in-flight requests to finish", "signal", received.String(), "timeout", timeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := server.Shutdown(ctx, frontServers...); err != nil {
+			logger.Warn("In-flight requests did not finish before shutdown_timeout; connections closed", "error", err)
+		}
+		server.Shutdown(ctx, backServers...)
+		cancel()
+
+		if tracerProvider != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				logger.Warn("Unable to export remaining traces", "error", err)
+			}
+			cancel()
+		}
+		logger.Info("Shut down")
+	}
+}
+
+// logReloadResult logs the outcome of a config reload. initial is the config loaded at startup, which is used to warn
+// about changes to settings which are only read once.
+func logReloadResult(logger *slog.Logger, initial *configuration.Config, store *configuration.Store, problems []string) {
+	if len(problems) > 0 {
+		logger.Error("Not reloading config due to errors; continuing with previous configuration", "error_count", len(problems))
+		for _, problem := range problems {
+			logger.Error("Configuration error", "error", problem)
+		}
+		return
+	}
+
+	current := store.Current()
+	if current.ListenAddress != initial.ListenAddress ||
+		current.MetricsAddress != initial.MetricsAddress ||
+		metricsPathOrDefault(current) != metricsPathOrDefault(initial) ||
+		current.ConfigWatchInterval != initial.ConfigWatchInterval ||
+		current.TLSListenAddress != initial.TLSListenAddress ||
+		!reflect.DeepEqual(current.ACME, initial.ACME) ||
+		current.AdminAddress != initial.AdminAddress ||
+		!reflect.DeepEqual(current.ProxyProtocol, initial.ProxyProtocol) ||
+		current.ReadTimeout != initial.ReadTimeout ||
+		current.ReadHeaderTimeout != initial.ReadHeaderTimeout ||
+		current.WriteTimeout != initial.WriteTimeout ||
+		current.IdleTimeout != initial.IdleTimeout ||
+		current.MaxHeaderBytes != initial.MaxHeaderBytes ||
+		!reflect.DeepEqual(current.Tracing, initial.Tracing) {
+		logger.Warn("Changes to listen_address, metrics_address, metrics_path, config_watch_interval, tls_listen_address, acme, admin_address, proxy_protocol, read_timeout, read_header_timeout, write_timeout, idle_timeout, max_header_bytes and tracing only take effect on restart")
+	}
+	logWarnings(logger, current)
+	logger.Info("Config reloaded")
+}
+
+// metricsPathOrDefault returns the path metrics are served on. The default is applied here rather than to config, so
+// that it is not written to the configuration file by the admin API.
+func metricsPathOrDefault(config *configuration.Config) string {
+	if config.MetricsPath == "" {
+		return "/metrics"
+	}
+	return config.MetricsPath
+}
+
+func logWarnings(logger *slog.Logger, config *configuration.Config) {
+	for _, warning := range config.Warnings {
+		logger.Warn("Configuration warning", "warning", warning)
 	}
 }
@@ -1 +1,116 @@
 package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCommandConfig = `{
+	"default_response": {"code": 421},
+	"domains": {
+		"example.net": {
+			"match_subdomains": true,
+			"not_before": "2020-01-01T00:00:00Z",
+			"rewrites": [
+				{"regexp": "^/bar(.*)$", "replacement": "https://www.example.com/baz$1", "code": 301},
+				{"regexp": "^/docs(.*)$", "replacement": "https://docs.example.com$1", "code": 302, "id": "docs", "labels": {"team": "docs", "owner": "web"}}
+			]
+		},
+		"health-check.internal": {
+			"default_response": {"code": 200}
+		},
+		"internal.example.com": {
+			"allow_cidrs": ["10.0.0.0/8"],
+			"default_response": {"code": 200}
+		}
+	}
+}`
+
+func writeTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+	return path
+}
+
+func TestRunTest(t *testing.T) {
+	path := writeTestConfig(t, testCommandConfig)
+
+	testCases := []struct {
+		args     []string
+		expected []string
+	}{
+		{
+			[]string{"--config", path, "https://foo.example.net/bar?x=1"},
+			[]string{"domain:      example.net", "matched:     rule 0 (regexp ^/bar(.*)$)", "action:      redirect", "destination: https://www.example.com/baz?x=1", "code:        301"},
+		},
+		{
+			[]string{"--config", path, "https://example.net/docs/intro"},
+			[]string{"matched:     rule docs at index 1 (regexp ^/docs(.*)$)", "labels:      owner=web, team=docs", "destination: https://docs.example.com/intro"},
+		},
+		{
+			[]string{"https://health-check.internal/", "--config", path, "--method", "HEAD", "--header", "User-Agent: test"},
+			[]string{"HEAD https://health-check.internal/", "domain:      health-check.internal", "matched:     default_response from health-check.internal", "code:        200"},
+		},
+		{
+			[]string{"--config", path, "--at", "2019-12-31T23:59:59Z", "https://foo.example.net/bar"},
+			[]string{"matched:     default_response from default", "code:        421"},
+		},
+		{
+			[]string{"--config=" + path, "http://example.org/"},
+			[]string{"domain:      (none)", "matched:     default_response from default", "action:      default_response", "code:        421"},
+		},
+		{
+			[]string{"--config", path, "--remote-addr", "10.1.2.3", "https://internal.example.com/"},
+			[]string{"matched:     default_response from internal.example.com", "code:        200"},
+		},
+		{
+			[]string{"--config", path, "--remote-addr", "192.0.2.1:1234", "https://internal.example.com/"},
+			[]string{"matched:     blocked_response from internal.example.com (client refused by allow_cidrs)", "action:      blocked", "code:        403"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		if status := runTest(testCase.args, stdout, stderr); status != 0 {
+			t.Errorf("Expected exit status 0 for %v, but got %d: %s", testCase.args, status, stderr)
+		}
+		for _, line := range testCase.expected {
+			if !strings.Contains(stdout.String(), line) {
+				t.Errorf("Expected output for %v to contain '%s', but got:\n%s", testCase.args, line, stdout)
+			}
+		}
+	}
+}
+
+func TestRunTestErrors(t *testing.T) {
+	valid := writeTestConfig(t, testCommandConfig)
+	invalid := writeTestConfig(t, `{"domains": {"Not A Domain": {}}}`)
+
+	testCases := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"--config", valid}, 2},
+		{[]string{"--config", valid, "--header", "no colon", "http://example.net/"}, 2},
+		{[]string{"--config", valid, "--unknown", "http://example.net/"}, 2},
+		{[]string{"--config", invalid, "http://example.net/"}, 1},
+		{[]string{"--config", valid, "--at", "tomorrow", "http://example.net/"}, 2},
+		{[]string{"--config", valid, "http://example.net/%zz"}, 1},
+	}
+
+	for _, testCase := range testCases {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		if status := runTest(testCase.args, stdout, stderr); status != testCase.status {
+			t.Errorf("Expected exit status %d for %v, but got %d", testCase.status, testCase.args, status)
+		}
+		if stderr.Len() == 0 {
+			t.Errorf("Expected error output for %v, but got none", testCase.args)
+		}
+	}
+}
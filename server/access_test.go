@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/mjec/redirector/configuration"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerAccessLists(t *testing.T) {
+	resetConfigAndMetrics()
+	config.DenyCIDRs = []string{"203.0.113.0/24"}
+	config.BlockedResponse = &configuration.DefaultResponse{Code: 0}
+	config.Domains["internal.example.com"] = configuration.Domain{
+		RewriteRules: []configuration.Rule{
+			{Regexp: regexp.MustCompile("^(.*)$"), Replacement: "https://intranet.example.com$1", Code: http.StatusFound},
+		},
+		AllowCIDRs:      []string{"10.0.0.0/8"},
+		BlockedResponse: &configuration.DefaultResponse{Code: http.StatusNotFound, Body: "not found\n"},
+	}
+	config.Domains["listed.example.com"] = configuration.Domain{AllowCIDRs: []string{"10.0.0.0/8"}}
+
+	handler := MakeHandler(config, metrics)
+	request := func(url string, remoteAddr string) *hijackableResponse {
+		req := httptest.NewRequest("", url, nil)
+		req.RemoteAddr = remoteAddr
+		rr := &hijackableResponse{httptest.NewRecorder(), false}
+		handler(rr, req)
+		return rr
+	}
+
+	if rr := request("http://internal.example.com/", "10.1.2.3:1234"); rr.wasClosed || rr.recorder.Code != http.StatusFound {
+		t.Errorf("Expected request from allowed client to be redirected, but got code %d (closed: %v)", rr.recorder.Code, rr.wasClosed)
+	}
+	if rr := request("http://internal.example.com/", "198.51.100.1:1234"); rr.wasClosed || rr.recorder.Code != http.StatusNotFound || rr.recorder.Body.String() != "not found\n" {
+		t.Errorf("Expected request from client not in allow_cidrs to get the domain's blocked_response, but got code %d and body %q (closed: %v)", rr.recorder.Code, rr.recorder.Body.String(), rr.wasClosed)
+	}
+	if rr := request("http://internal.example.com/", "203.0.113.1:1234"); !rr.wasClosed {
+		t.Errorf("Expected connection from client in global deny_cidrs to be closed, but got code %d", rr.recorder.Code)
+	}
+	if rr := request("http://example.com/", "203.0.113.1:1234"); !rr.wasClosed {
+		t.Errorf("Expected connection from client in global deny_cidrs to be closed for unknown domain, but got code %d", rr.recorder.Code)
+	}
+	if rr := request("http://listed.example.com/", "198.51.100.1:1234"); !rr.wasClosed {
+		t.Errorf("Expected connection from client not in allow_cidrs to get the global blocked_response, but got code %d", rr.recorder.Code)
+	}
+	if rr := request("http://example.com/", "198.51.100.1:1234"); rr.wasClosed || rr.recorder.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected request for unknown domain to get the default response, but got code %d (closed: %v)", rr.recorder.Code, rr.wasClosed)
+	}
+
+	expectCounterValue(t, metrics.BlockedRequests, prometheus.Labels{"list": "internal.example.com", "reason": configuration.AccessDeniedByAllowList}, 1)
+	expectCounterValue(t, metrics.BlockedRequests, prometheus.Labels{"list": "global", "reason": configuration.AccessDeniedByDenyList}, 2)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "internal.example.com", "rule_index": "blocked", "split_destination": "", "method": "GET", "code": "404"}, 1)
+	expectCounterValue(t, metrics.BlockedRequests, prometheus.Labels{"list": "listed.example.com", "reason": configuration.AccessDeniedByAllowList}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "listed.example.com", "rule_index": "blocked", "split_destination": "", "method": "GET", "code": "0"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "blocked", "split_destination": "", "method": "GET", "code": "0"}, 1)
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerDefaultBlockedResponse(t *testing.T) {
+	resetConfigAndMetrics()
+	config.DenyCIDRs = []string{"203.0.113.0/24"}
+
+	req := httptest.NewRequest("", "http://example.com/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusForbidden || rr.Body.String() != "403 Forbidden\n" {
+		t.Errorf("Expected status code %d and body %q, but got %d and %q", http.StatusForbidden, "403 Forbidden\n", rr.Code, rr.Body.String())
+	}
+	if contentType := rr.Result().Header.Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("Expected Content-Type %s, but got %q", "text/plain", contentType)
+	}
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerBlockedRequestsAreNotRateLimited(t *testing.T) {
+	resetConfigAndMetrics()
+	config.DenyCIDRs = []string{"203.0.113.0/24"}
+	config.RateLimit = &configuration.RateLimit{Rate: 1, Burst: 1}
+
+	handler := MakeHandler(config, metrics)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("", "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+		handler(httptest.NewRecorder(), req)
+	}
+
+	expectCounterValue(t, metrics.BlockedRequests, prometheus.Labels{"list": "global", "reason": configuration.AccessDeniedByDenyList}, 3)
+	expectCounterValue(t, metrics.RateLimitedRequests, prometheus.Labels{"limit": "global"}, 0)
+
+	resetConfigAndMetrics()
+}
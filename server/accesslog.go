@@ -0,0 +1,59 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/mjec/redirector/accesslog"
+	"github.com/mjec/redirector/configuration"
+)
+
+// accessLogs keeps the access log described by the current config open, and reopens it when the config's access_log
+// changes, so that its output is not reopened for every request.
+type accessLogs struct {
+	mutex   sync.Mutex
+	options *configuration.AccessLog
+	logger  *accesslog.Logger
+}
+
+// current returns a Logger for options. If the output cannot be opened, the error is logged and requests are logged
+// with the application's logs until options change.
+func (a *accessLogs) current(options *configuration.AccessLog) *accesslog.Logger {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.logger != nil && reflect.DeepEqual(a.options, options) {
+		return a.logger
+	}
+
+	logger, err := accesslog.New(options)
+	if err != nil {
+		slog.Default().Error("Unable to open access log; logging requests with application logs instead", "error", err)
+		logger, _ = accesslog.New(nil)
+	}
+
+	if a.logger != nil {
+		a.logger.Close()
+	}
+	a.options, a.logger = options, logger
+	return logger
+}
+
+// responseRecorder counts the bytes written in the response body. It supports http.ResponseController (and so
+// hijacking and flushing) through Unwrap().
+type responseRecorder struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+func TestHandlerAccessLog(t *testing.T) {
+	resetConfigAndMetrics()
+	path := filepath.Join(t.TempDir(), "access.log")
+	config.AccessLog = &configuration.AccessLog{
+		Fields: []string{"remote_addr", "host", "request_uri", "code", "bytes", "latency", "domain", "rule", "action", "destination", "source"},
+		Output: configuration.AccessLogOutputFile,
+		File:   path,
+	}
+	config.DefaultResponse.LogHits = true
+	config.Domains["example.com"] = configuration.Domain{
+		RewriteRules: []configuration.Rule{
+			{Regexp: regexp.MustCompile("^/logged(.*)$"), Replacement: "https://example.net$1", Code: http.StatusMovedPermanently, LogHits: true},
+			{Regexp: regexp.MustCompile("^/quiet(.*)$"), Replacement: "https://example.net$1", Code: http.StatusMovedPermanently},
+		},
+	}
+
+	handler := MakeHandler(config, metrics)
+	for _, url := range []string{"http://example.com/logged/page", "http://example.com/quiet/page", "http://unknown.example.com/"} {
+		req := httptest.NewRequest("", url, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		handler(httptest.NewRecorder(), req)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error reading access log, but got %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines logged, but got %d lines logged: %v", len(lines), lines)
+	}
+
+	var redirect, defaultResponse map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &redirect); err != nil {
+		t.Fatalf("Expected access log line to be JSON, but got %v: %s", err, lines[0])
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &defaultResponse); err != nil {
+		t.Fatalf("Expected access log line to be JSON, but got %v: %s", err, lines[1])
+	}
+
+	expected := map[string]any{
+		"remote_addr": "192.0.2.1:1234",
+		"host":        "example.com",
+		"request_uri": "/logged/page",
+		"code":        float64(301),
+		"domain":      "example.com",
+		"rule":        "0",
+		"action":      "redirect",
+		"destination": "https://example.net/page",
+		"source":      "",
+	}
+	for key, value := range expected {
+		if redirect[key] != value {
+			t.Errorf("Expected %s to be %v, but got %v", key, value, redirect[key])
+		}
+	}
+	if bytes, _ := redirect["bytes"].(float64); bytes <= 0 {
+		t.Errorf("Expected bytes to be the size of the redirect body, but got %v", redirect["bytes"])
+	}
+	if _, ok := redirect["latency"].(float64); !ok {
+		t.Errorf("Expected latency to be a number, but got %v", redirect["latency"])
+	}
+
+	if defaultResponse["action"] != "default_response" || defaultResponse["rule"] != "default" || defaultResponse["source"] != "default" || defaultResponse["code"] != float64(421) {
+		t.Errorf("Expected global default response to be logged, but got %v", defaultResponse)
+	}
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerAccessLogHijackedConnection(t *testing.T) {
+	resetConfigAndMetrics()
+	path := filepath.Join(t.TempDir(), "access.log")
+	config.AccessLog = &configuration.AccessLog{Format: configuration.AccessLogFormatCLF, Output: configuration.AccessLogOutputFile, File: path}
+	config.DefaultResponse = &configuration.DefaultResponse{Code: 0, LogHits: true}
+
+	req := httptest.NewRequest("", "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr := &hijackableResponse{httptest.NewRecorder(), false}
+	MakeHandler(config, metrics)(rr, req)
+
+	if !rr.wasClosed {
+		t.Errorf("Expected connection to be closed through the access log's response wrapper, but got code %d", rr.recorder.Code)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error reading access log, but got %v", err)
+	}
+	if !strings.HasPrefix(string(contents), "192.0.2.1 - - [") || !strings.HasSuffix(string(contents), `"GET / HTTP/1.1" 0 - "" ""`+"\n") {
+		t.Errorf("Expected closed connection to be logged in Combined Log Format, but got %q", string(contents))
+	}
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerLogPrivacy(t *testing.T) {
+	previousLogger := slog.Default()
+	defer slog.SetDefault(previousLogger)
+	loggerSpy := &logSpy{}
+	slog.SetDefault(slog.New(loggerSpy))
+
+	resetConfigAndMetrics()
+	config.LogPrivacy = &configuration.LogPrivacy{ClientIP: configuration.LogClientIPTruncate, StripRefererQuery: true}
+	config.DefaultResponse.LogHits = true
+	config.DenyCIDRs = []string{"203.0.113.0/24"}
+	config.BlockedResponse = &configuration.DefaultResponse{Code: http.StatusForbidden, LogHits: true}
+	config.RateLimit = &configuration.RateLimit{Rate: 1, Burst: 1, Response: &configuration.DefaultResponse{Code: http.StatusTooManyRequests, LogHits: true}}
+
+	handler := MakeHandler(config, metrics)
+	for _, remoteAddr := range []string{"192.0.2.123:1234", "192.0.2.123:1234", "203.0.113.9:1234"} {
+		req := httptest.NewRequest("", "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Referer", "https://search.example.net/?q=private")
+		handler(httptest.NewRecorder(), req)
+	}
+
+	expected := []struct {
+		message    string
+		remoteAddr string
+	}{
+		{"Default response", "192.0.2.0"},
+		{"Rate limited", "192.0.2.0"},
+		{"Blocked", "203.0.113.0"},
+	}
+	if loggerSpy.lineCounter != len(expected) {
+		t.Fatalf("Expected %d lines logged, but got %d lines logged (%v)", len(expected), loggerSpy.lineCounter, loggerSpy.lines)
+	}
+	for index, line := range loggerSpy.lines {
+		if line.Message != expected[index].message {
+			t.Errorf("Expected line %d to be '%s', but got '%s'", index, expected[index].message, line.Message)
+		}
+		line.Attrs(func(a slog.Attr) bool {
+			switch a.Key {
+			case "remote_addr":
+				if a.Value.String() != expected[index].remoteAddr {
+					t.Errorf("Expected remote_addr of '%s' to be %s, but got %s", line.Message, expected[index].remoteAddr, a.Value)
+				}
+			case "referer":
+				if a.Value.String() != "https://search.example.net/" {
+					t.Errorf("Expected referer of '%s' to have its query string removed, but got %s", line.Message, a.Value)
+				}
+			}
+			return true
+		})
+	}
+
+	resetConfigAndMetrics()
+}
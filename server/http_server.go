@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+const (
+	defaultReadTimeout       = time.Minute
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+	defaultShutdownTimeout   = 5 * time.Second
+)
+
+// NewHTTPServer returns a server for handler on addr, with timeouts and limits from config.
+func NewHTTPServer(config *configuration.Config, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       durationOrDefault(config.ReadTimeout, defaultReadTimeout),
+		ReadHeaderTimeout: durationOrDefault(config.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       durationOrDefault(config.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    intOrDefault(config.MaxHeaderBytes, defaultMaxHeaderBytes),
+	}
+	if config.LogPrivacy != nil {
+		server.ErrorLog = log.New(&errorLogWriter{privacy: config.LogPrivacy, out: log.Writer()}, log.Prefix(), log.Flags())
+	}
+	return server
+}
+
+// errorLogClientAddr matches the client addresses which net/http includes in its error logs, such as
+// "http: TLS handshake error from 203.0.113.7:51234: EOF" and "http: panic serving [2001:db8::1]:51234: ...".
+var errorLogClientAddr = regexp.MustCompile(` (from|serving) ((?:\[[^\]]+\]|[0-9.]+):[0-9]+)`)
+
+// errorLogWriter writes net/http's error logs to out, with client addresses rewritten according to privacy. Addresses
+// which privacy drops are removed from the line altogether.
+type errorLogWriter struct {
+	privacy *configuration.LogPrivacy
+	out     io.Writer
+}
+
+func (w *errorLogWriter) Write(p []byte) (int, error) {
+	line := errorLogClientAddr.ReplaceAllStringFunc(string(p), func(match string) string {
+		submatches := errorLogClientAddr.FindStringSubmatch(match)
+		addr := w.privacy.ClientAddr(submatches[2])
+		if addr == "" {
+			return ""
+		}
+		return " " + submatches[1] + " " + addr
+	})
+	if _, err := io.WriteString(w.out, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ShutdownTimeout returns how long Shutdown() should wait for in-flight requests to finish.
+func ShutdownTimeout(config *configuration.Config) time.Duration {
+	return durationOrDefault(config.ShutdownTimeout, defaultShutdownTimeout)
+}
+
+// Shutdown gracefully shuts down all of servers at once, waiting for in-flight requests to finish until ctx is done,
+// at which point any remaining connections are closed. It returns an error if any server had to be closed.
+func Shutdown(ctx context.Context, servers ...*http.Server) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+
+	for index, server := range servers {
+		wg.Add(1)
+		go func(index int, server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				errs[index] = err
+			}
+		}(index, server)
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func durationOrDefault(duration configuration.Duration, fallback time.Duration) time.Duration {
+	if duration > 0 {
+		return time.Duration(duration)
+	}
+	return fallback
+}
+
+func intOrDefault(value int, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
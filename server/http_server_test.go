@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	server := NewHTTPServer(&configuration.Config{}, ":8080", http.NotFoundHandler())
+	if server.Addr != ":8080" || server.ReadTimeout != defaultReadTimeout || server.ReadHeaderTimeout != defaultReadHeaderTimeout || server.WriteTimeout != 0 || server.IdleTimeout != defaultIdleTimeout || server.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Errorf("Expected server with default settings, but got %+v", server)
+	}
+
+	server = NewHTTPServer(&configuration.Config{
+		ReadTimeout:       configuration.Duration(time.Second),
+		ReadHeaderTimeout: configuration.Duration(2 * time.Second),
+		WriteTimeout:      configuration.Duration(3 * time.Second),
+		IdleTimeout:       configuration.Duration(4 * time.Second),
+		MaxHeaderBytes:    5,
+	}, ":8080", http.NotFoundHandler())
+	if server.ReadTimeout != time.Second || server.ReadHeaderTimeout != 2*time.Second || server.WriteTimeout != 3*time.Second || server.IdleTimeout != 4*time.Second || server.MaxHeaderBytes != 5 {
+		t.Errorf("Expected server with configured settings, but got %+v", server)
+	}
+
+	if timeout := ShutdownTimeout(&configuration.Config{}); timeout != defaultShutdownTimeout {
+		t.Errorf("Expected default shutdown timeout %s, but got %s", defaultShutdownTimeout, timeout)
+	}
+	if timeout := ShutdownTimeout(&configuration.Config{ShutdownTimeout: configuration.Duration(time.Minute)}); timeout != time.Minute {
+		t.Errorf("Expected shutdown timeout %s, but got %s", time.Minute, timeout)
+	}
+}
+
+func TestNewHTTPServerErrorLogPrivacy(t *testing.T) {
+	var output bytes.Buffer
+	previousOutput, previousFlags := log.Writer(), log.Flags()
+	log.SetOutput(&output)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(previousOutput)
+		log.SetFlags(previousFlags)
+	}()
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config = NewHTTPServer(&configuration.Config{LogPrivacy: &configuration.LogPrivacy{ClientIP: configuration.LogClientIPTruncate}}, "", http.NotFoundHandler())
+	server.StartTLS()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected to connect to server, but got %v", err)
+	}
+	clientAddr := conn.LocalAddr().String()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	io.ReadAll(conn)
+	conn.Close()
+	server.Close()
+
+	if !strings.Contains(output.String(), "TLS handshake error from 127.0.0.0: ") {
+		t.Errorf("Expected TLS handshake error with truncated client address, but got %q", output.String())
+	}
+	if strings.Contains(output.String(), clientAddr) {
+		t.Errorf("Expected client address %s not to be logged, but got %q", clientAddr, output.String())
+	}
+
+	for _, tc := range []struct {
+		privacy  *configuration.LogPrivacy
+		line     string
+		expected string
+	}{
+		{&configuration.LogPrivacy{ClientIP: configuration.LogClientIPTruncate}, "http: panic serving [2001:db8::1]:1234: oops\n", "http: panic serving 2001:db8::: oops\n"},
+		{&configuration.LogPrivacy{ClientIP: configuration.LogClientIPDrop}, "http: TLS handshake error from 192.0.2.1:1234: EOF\n", "http: TLS handshake error: EOF\n"},
+		{&configuration.LogPrivacy{ClientIP: configuration.LogClientIPFull}, "http: TLS handshake error from 192.0.2.1:1234: EOF\n", "http: TLS handshake error from 192.0.2.1:1234: EOF\n"},
+		{&configuration.LogPrivacy{ClientIP: configuration.LogClientIPDrop}, "http: Accept error: too many open files\n", "http: Accept error: too many open files\n"},
+	} {
+		var output bytes.Buffer
+		writer := &errorLogWriter{privacy: tc.privacy, out: &output}
+		if n, err := writer.Write([]byte(tc.line)); n != len(tc.line) || err != nil {
+			t.Errorf("Expected to write %d bytes, but wrote %d with error %v", len(tc.line), n, err)
+		}
+		if output.String() != tc.expected {
+			t.Errorf("Expected %q to be logged as %q, but got %q", tc.line, tc.expected, output.String())
+		}
+	}
+}
+
+// startBlockingServer serves requests with handler, which blocks each request until release is closed.
+func startBlockingServer(t *testing.T, release chan struct{}) (*http.Server, string, chan struct{}) {
+	t.Helper()
+
+	resetConfigAndMetrics()
+	started := make(chan struct{}, 1)
+	handler := MakeHandler(config, metrics)
+	server := NewHTTPServer(config, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		handler(w, r)
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	go server.Serve(listener)
+
+	return server, "http://" + listener.Addr().String() + "/", started
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	server, url, started := startBlockingServer(t, release)
+
+	responses := make(chan int, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		responses <- response.StatusCode
+	}()
+	<-started
+
+	shutdownResult := make(chan error, 1)
+	go func() { shutdownResult <- Shutdown(context.Background(), server) }()
+
+	select {
+	case err := <-shutdownResult:
+		t.Fatalf("Expected Shutdown() to wait for the in-flight request, but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-shutdownResult; err != nil {
+		t.Errorf("Expected Shutdown() to succeed, but got %v", err)
+	}
+	if code := <-responses; code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected in-flight request to complete with code %d, but got %d", http.StatusMisdirectedRequest, code)
+	}
+
+	gauge := &io_prometheus_client.Metric{}
+	metrics.InFlightRequests.Write(gauge)
+	if gauge.GetGauge().GetValue() != 0 {
+		t.Errorf("Expected no requests in flight after shutdown, but got %f", gauge.GetGauge().GetValue())
+	}
+
+	resetConfigAndMetrics()
+}
+
+func TestShutdownClosesConnectionsAfterDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server, url, started := startBlockingServer(t, release)
+
+	go func() {
+		if response, err := http.Get(url); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx, server); err == nil {
+		t.Errorf("Expected Shutdown() to report that the deadline passed, but got no error")
+	}
+
+	resetConfigAndMetrics()
+}
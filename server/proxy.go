@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// proxyTransport is shared by all proxy rules without a timeout, so that connections to upstreams can be reused.
+var proxyTransport http.RoundTripper = http.DefaultTransport
+
+// proxyTransports holds a transport for each timeout used by a proxy rule, shared in the same way as proxyTransport.
+var proxyTransports = struct {
+	sync.Mutex
+	byTimeout map[time.Duration]*http.Transport
+}{byTimeout: map[time.Duration]*http.Transport{}}
+
+// transportWithTimeout returns a transport which gives up if connecting to the upstream, or waiting for its response
+// headers once the request has been sent, takes longer than timeout. The response body may take longer.
+func transportWithTimeout(timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return proxyTransport
+	}
+
+	proxyTransports.Lock()
+	defer proxyTransports.Unlock()
+
+	transport, ok := proxyTransports.byTimeout[timeout]
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.ResponseHeaderTimeout = timeout
+		proxyTransports.byTimeout[timeout] = transport
+	}
+	return transport
+}
+
+// serveProxy forwards r to destination according to options, and returns the status code sent to the client.
+func serveProxy(w http.ResponseWriter, r *http.Request, destination string, options *configuration.ProxyOptions) int {
+	if options == nil {
+		options = &configuration.ProxyOptions{}
+	}
+
+	target, err := url.Parse(destination)
+	if err != nil {
+		slog.Default().Error("Unable to parse proxy destination", "destination", destination, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(
+		r.Context(),
+		r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLFull(destination),
+			semconv.ServerAddress(target.Hostname()),
+		),
+	)
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	status := 0
+	proxy := &httputil.ReverseProxy{
+		Transport: transportWithTimeout(time.Duration(options.Timeout)),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			outURL := *target
+			pr.Out.URL = &outURL
+			if options.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			} else {
+				pr.Out.Host = ""
+			}
+
+			if options.XForwarded {
+				pr.SetXForwarded()
+			}
+
+			applyHeaders(pr.Out.Header, options.RequestHeaders)
+			otel.GetTextMapPropagator().Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			applyHeaders(resp.Header, options.ResponseHeaders)
+			status = resp.StatusCode
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status = http.StatusBadGateway
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				status = http.StatusGatewayTimeout
+			}
+			slog.Default().Warn("Error proxying request", "destination", destination, "error", err, "code", status)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			w.WriteHeader(status)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+	return status
+}
+
+// applyHeaders sets each of headers on h, removing any header whose value is empty.
+func applyHeaders(h http.Header, headers map[string]string) {
+	for header, value := range headers {
+		if value == "" {
+			h.Del(header)
+		} else {
+			h.Set(header, value)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolHeaderTimeout limits how long a trusted source has to send its PROXY protocol header.
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+// proxyProtocolV1MaxLength is the longest possible v1 header, including the trailing CRLF.
+const proxyProtocolV1MaxLength = 107
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted func(netip.Addr) bool
+}
+
+// NewProxyProtocolListener returns a listener which reads a PROXY protocol (v1 or v2) header from each connection
+// whose address trusted accepts, and uses the client address from the header as the connection's RemoteAddr().
+// Connections from trusted sources without a valid header are closed. Connections from other addresses are returned
+// unchanged, and any PROXY protocol header they send is treated as part of the request.
+//
+// The header is read on the first call to Read() or RemoteAddr(), so a slow client does not hold up Accept().
+func NewProxyProtocolListener(listener net.Listener, trusted func(netip.Addr) bool) net.Listener {
+	return &proxyProtocolListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || !l.trusted(peer.Addr().Unmap()) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header from r, and returns the source address it contains. The address is
+// nil if the header is valid but does not give a TCP source address (e.g. a health check from the proxy itself).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	// Every valid header is at least as long as the v2 signature
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(r)
+	}
+	return readProxyProtocolV1Header(r)
+}
+
+func readProxyProtocolV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	text, found := strings.CutSuffix(string(line), "\r\n")
+	if !found {
+		return nil, errors.New("v1 header is not terminated by CRLF within 107 bytes")
+	}
+
+	fields := strings.Split(text, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY signature")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("expected 6 fields in v1 header, but got %d", len(fields))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol %s", fields[1])
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %s", fields[4])
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readProxyProtocolV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the connection was made by the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	var addr netip.Addr
+	var port uint16
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("v2 address block too short for IPv4")
+		}
+		addr = netip.AddrFrom4([4]byte(body[0:4]))
+		port = binary.BigEndian.Uint16(body[8:10])
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("v2 address block too short for IPv6")
+		}
+		addr = netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port = binary.BigEndian.Uint16(body[32:34])
+	default: // AF_UNSPEC or AF_UNIX, which have no useful client address
+		return nil, nil
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
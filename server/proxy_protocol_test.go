@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func proxyProtocolV2Header(command byte, family byte, addresses []byte) string {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return string(append(header, addresses...))
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{198, 51, 100, 1, 10, 0, 0, 1, 0x16, 0x2e, 0x00, 0x50}
+	ipv6 := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x16, 0x2e, 0x01, 0xbb)
+
+	testCases := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 198.51.100.1 10.0.0.1 5678 80\r\n", "198.51.100.1:5678"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 5678 443\r\n", "[2001:db8::1]:5678"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", ""},
+		{proxyProtocolV2Header(0x1, 0x11, ipv4), "198.51.100.1:5678"},
+		{proxyProtocolV2Header(0x1, 0x21, ipv6), "[2001:db8::1]:5678"},
+		{proxyProtocolV2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "198.51.100.1:5678"},
+		{proxyProtocolV2Header(0x0, 0x00, nil), ""},
+		{proxyProtocolV2Header(0x1, 0x00, nil), ""},
+	}
+
+	for _, testCase := range testCases {
+		reader := bufio.NewReader(strings.NewReader(testCase.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			t.Errorf("Expected no error for header %q, but got %v", testCase.header, err)
+			continue
+		}
+
+		actual := ""
+		if addr != nil {
+			actual = addr.String()
+		}
+		if actual != testCase.expected {
+			t.Errorf("Expected address '%s' for header %q, but got '%s'", testCase.expected, testCase.header, actual)
+		}
+
+		if rest, _ := io.ReadAll(reader); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("Expected the request to follow header %q, but got %q", testCase.header, rest)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderErrors(t *testing.T) {
+	ipv4 := []byte{198, 51, 100, 1, 10, 0, 0, 1, 0x16, 0x2e, 0x00, 0x50}
+
+	testCases := []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 198.51.100.1 10.0.0.1 5678 80\n",
+		"PROXY TCP4 198.51.100.1 10.0.0.1 5678\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 5678 80\r\n",
+		"PROXY TCP6 198.51.100.1 10.0.0.1 5678 80\r\n",
+		"PROXY TCP4 198.51.100.1 10.0.0.1 99999 80\r\n",
+		"PROXY UDP4 198.51.100.1 10.0.0.1 5678 80\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"PROXY",
+		proxyProtocolV2Header(0x2, 0x11, ipv4),
+		proxyProtocolV2Header(0x1, 0x11, ipv4[:8]),
+		proxyProtocolV2Header(0x1, 0x21, ipv4),
+		proxyProtocolV2Header(0x1, 0x11, ipv4)[:20],
+		strings.Replace(proxyProtocolV2Header(0x1, 0x11, ipv4), "\x21", "\x11", 1),
+	}
+
+	for _, header := range testCases {
+		if addr, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Expected an error for header %q, but got address %v", header, addr)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	trusted := atomic.Bool{}
+	trusted.Store(true)
+	listener := NewProxyProtocolListener(inner, func(addr netip.Addr) bool {
+		if addr != netip.MustParseAddr("127.0.0.1") {
+			t.Errorf("Expected trust to be checked for 127.0.0.1, but got %s", addr)
+		}
+		return trusted.Load()
+	})
+
+	remoteAddrs := make(chan string, 1)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	}))
+	defer listener.Close()
+
+	request := func(header string) (string, bool) {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Unable to connect: %v", err)
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", false
+		}
+		response.Body.Close()
+		return <-remoteAddrs, true
+	}
+
+	if remoteAddr, ok := request("PROXY TCP4 198.51.100.1 10.0.0.1 5678 80\r\n"); !ok || remoteAddr != "198.51.100.1:5678" {
+		t.Errorf("Expected remote address 198.51.100.1:5678 from v1 header, but got '%s'", remoteAddr)
+	}
+
+	if remoteAddr, ok := request(proxyProtocolV2Header(0x0, 0x00, nil)); !ok || !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("Expected connection's remote address from v2 LOCAL header, but got '%s'", remoteAddr)
+	}
+
+	if remoteAddr, ok := request(""); ok {
+		t.Errorf("Expected connection from trusted source without header to be closed, but got request from '%s'", remoteAddr)
+	}
+
+	trusted.Store(false)
+	if remoteAddr, ok := request(""); !ok || !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("Expected connection's remote address from untrusted source, but got '%s'", remoteAddr)
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerProxy(t *testing.T) {
+	var upstreamRequest *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequest = r
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("X-Remove-Me", "please")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("proxied body"))
+	}))
+	defer upstream.Close()
+
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^/api(/.*)$"),
+					Replacement: upstream.URL + "/v1$1",
+					Action:      configuration.ActionProxy,
+					Proxy: &configuration.ProxyOptions{
+						XForwarded: true,
+						RequestHeaders: map[string]string{
+							"X-Added":    "added",
+							"X-Stripped": "",
+						},
+						ResponseHeaders: map[string]string{
+							"X-Remove-Me":  "",
+							"X-Downstream": "yes",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/api/things?x=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Stripped", "secret")
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTeapot, rr.Code)
+	}
+	if body, _ := io.ReadAll(rr.Body); string(body) != "proxied body" {
+		t.Errorf("Expected body '%s', but got '%s'", "proxied body", body)
+	}
+	if rr.Header().Get("X-Upstream") != "yes" || rr.Header().Get("X-Downstream") != "yes" || rr.Header().Get("X-Remove-Me") != "" {
+		t.Errorf("Expected response headers to be rewritten, but got %v", rr.Header())
+	}
+
+	if upstreamRequest == nil {
+		t.Fatalf("Expected request to reach upstream, but it did not")
+	}
+	if upstreamRequest.URL.RequestURI() != "/v1/things?x=1" {
+		t.Errorf("Expected upstream request URI %s, but got %s", "/v1/things?x=1", upstreamRequest.URL.RequestURI())
+	}
+	if upstreamRequest.Host == "example.com" {
+		t.Errorf("Expected upstream Host header to be the destination host, but got %s", upstreamRequest.Host)
+	}
+	if upstreamRequest.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For to be %s, but got %s", "192.0.2.1", upstreamRequest.Header.Get("X-Forwarded-For"))
+	}
+	if upstreamRequest.Header.Get("X-Forwarded-Host") != "example.com" {
+		t.Errorf("Expected X-Forwarded-Host to be %s, but got %s", "example.com", upstreamRequest.Header.Get("X-Forwarded-Host"))
+	}
+	if upstreamRequest.Header.Get("X-Added") != "added" || upstreamRequest.Header.Get("X-Stripped") != "" {
+		t.Errorf("Expected request headers to be rewritten, but got %v", upstreamRequest.Header)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "418"}, 1)
+}
+
+func TestHandlerProxyPreserveHost(t *testing.T) {
+	var upstreamRequest *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequest = r
+	}))
+	defer upstream.Close()
+
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^(.*)$"),
+					Replacement: upstream.URL + "$1",
+					Action:      configuration.ActionProxy,
+					Proxy:       &configuration.ProxyOptions{PreserveHost: true},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/", nil)
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if upstreamRequest == nil || upstreamRequest.Host != "example.com" {
+		t.Errorf("Expected upstream Host header to be %s, but got %v", "example.com", upstreamRequest)
+	}
+	if upstreamRequest != nil && upstreamRequest.Header.Get("X-Forwarded-For") != "" {
+		t.Errorf("Expected no X-Forwarded-For header, but got %s", upstreamRequest.Header.Get("X-Forwarded-For"))
+	}
+}
+
+func TestHandlerProxyTimeoutDoesNotLimitBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("chunk\n"))
+			http.NewResponseController(w).Flush()
+			time.Sleep(25 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^/stream$"),
+					Replacement: upstream.URL,
+					Action:      configuration.ActionProxy,
+					Proxy:       &configuration.ProxyOptions{Timeout: configuration.Duration(50 * time.Millisecond)},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/stream", nil)
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if expected := strings.Repeat("chunk\n", 4); rr.Body.String() != expected {
+		t.Errorf("Expected whole body %q to be streamed after the timeout, but got %q", expected, rr.Body.String())
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "200"}, 1)
+}
+
+func TestHandlerProxyErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^/slow$"),
+					Replacement: upstream.URL,
+					Action:      configuration.ActionProxy,
+					Proxy:       &configuration.ProxyOptions{Timeout: configuration.Duration(10 * time.Millisecond)},
+				},
+				{
+					Regexp:      regexp.MustCompile("^/unreachable$"),
+					Replacement: "http://127.0.0.1:1/",
+					Action:      configuration.ActionProxy,
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/slow", nil)
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code %d, but got %d", http.StatusGatewayTimeout, rr.Code)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "504"}, 1)
+
+	req = httptest.NewRequest("", "http://example.com/unreachable", nil)
+	rr = httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadGateway, rr.Code)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "1", "split_destination": "", "method": "GET", "code": "502"}, 1)
+}
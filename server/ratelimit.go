@@ -0,0 +1,121 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+// rateLimiters holds the state of the global rate limit and each domain's rate limit. It is kept outside the Config so
+// that clients' buckets survive config reloads; a limit's buckets are only reset if its settings change.
+type rateLimiters struct {
+	mutex sync.Mutex
+	// limiters is keyed by domain origin, or "" for the global limit
+	limiters map[string]*rateLimiter
+	now      func() time.Time
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{limiters: map[string]*rateLimiter{}, now: time.Now}
+}
+
+// check returns the first rate limit which a request from remoteAddr to domain exceeds, and a label identifying it
+// ("global", or the domain), or nil if the request is within all limits. The request is counted against each limit it
+// is checked against.
+func (s *rateLimiters) check(config *configuration.Config, domain string, remoteAddr string) (*configuration.RateLimit, string) {
+	if limit := config.RateLimit; limit != nil && !s.allow("", limit, remoteAddr) {
+		return limit, "global"
+	}
+
+	if domain != "" {
+		if limit := config.Domains[domain].RateLimit; limit != nil && !s.allow(domain, limit, remoteAddr) {
+			return limit, domain
+		}
+	}
+
+	return nil, ""
+}
+
+// allow reports whether a request from remoteAddr is within limit, and if so, counts it against the limit. scope is
+// the domain origin which limit belongs to, or "" for the global limit.
+func (s *rateLimiters) allow(scope string, limit *configuration.RateLimit, remoteAddr string) bool {
+	s.mutex.Lock()
+	limiter, ok := s.limiters[scope]
+	if !ok || !limiter.hasSettings(limit) {
+		limiter = newRateLimiter(limit)
+		s.limiters[scope] = limiter
+	}
+	s.mutex.Unlock()
+
+	client := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		client = host
+	}
+	return limiter.allow(client, s.now())
+}
+
+// rateLimiter keeps a token bucket for each client. Only maxClients buckets are kept; when a new client arrives, the
+// bucket of the least recently seen client is forgotten, which is equivalent to that client's bucket being full.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	maxClients int
+
+	mutex sync.Mutex
+	// buckets maps each client to its element in recent, which is ordered from most to least recently seen
+	buckets map[string]*list.Element
+	recent  *list.List
+}
+
+type tokenBucket struct {
+	client  string
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limit *configuration.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		rate:       limit.Rate,
+		burst:      float64(limit.BurstSize()),
+		maxClients: limit.ClientLimit(),
+		buckets:    map[string]*list.Element{},
+		recent:     list.New(),
+	}
+}
+
+func (l *rateLimiter) hasSettings(limit *configuration.RateLimit) bool {
+	return l.rate == limit.Rate && l.burst == float64(limit.BurstSize()) && l.maxClients == limit.ClientLimit()
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *tokenBucket
+	if element, ok := l.buckets[client]; ok {
+		l.recent.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+			bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		}
+		bucket.updated = now
+	} else {
+		if l.recent.Len() >= l.maxClients {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).client)
+		}
+		bucket = &tokenBucket{client: client, tokens: l.burst, updated: now}
+		l.buckets[client] = l.recent.PushFront(bucket)
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
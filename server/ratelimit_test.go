@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(&configuration.RateLimit{Rate: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("192.0.2.1", start) {
+			t.Errorf("Expected request %d within burst to be allowed", i)
+		}
+	}
+	if limiter.allow("192.0.2.1", start) {
+		t.Errorf("Expected request over burst to be refused")
+	}
+	if !limiter.allow("192.0.2.2", start) {
+		t.Errorf("Expected request from another client to be allowed")
+	}
+
+	if !limiter.allow("192.0.2.1", start.Add(500*time.Millisecond)) {
+		t.Errorf("Expected request after one token was added to be allowed")
+	}
+	if limiter.allow("192.0.2.1", start.Add(500*time.Millisecond)) {
+		t.Errorf("Expected second request after one token was added to be refused")
+	}
+
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("192.0.2.1", later) {
+			t.Errorf("Expected request %d after bucket refilled to be allowed", i)
+		}
+	}
+	if limiter.allow("192.0.2.1", later) {
+		t.Errorf("Expected bucket to refill to no more than burst")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(&configuration.RateLimit{Rate: 1, Burst: 1, MaxClients: 2})
+
+	limiter.allow("192.0.2.1", now)
+	limiter.allow("192.0.2.2", now)
+	if limiter.allow("192.0.2.1", now) {
+		t.Errorf("Expected second request from 192.0.2.1 to be refused")
+	}
+
+	// 192.0.2.2 is now the least recently seen, so is forgotten to make room for 192.0.2.3
+	limiter.allow("192.0.2.3", now)
+	if len(limiter.buckets) != 2 || limiter.recent.Len() != 2 {
+		t.Errorf("Expected 2 clients to be tracked, but got %d (%d in list)", len(limiter.buckets), limiter.recent.Len())
+	}
+	if !limiter.allow("192.0.2.2", now) {
+		t.Errorf("Expected evicted client to be allowed")
+	}
+	if limiter.allow("192.0.2.3", now) {
+		t.Errorf("Expected second request from 192.0.2.3 to be refused")
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	resetConfigAndMetrics()
+	config.RateLimit = &configuration.RateLimit{Rate: 1, Burst: 2}
+	config.Domains["example.com"] = configuration.Domain{
+		RewriteRules: []configuration.Rule{
+			{Regexp: regexp.MustCompile("^(.*)$"), Replacement: "https://www.example.com$1", Code: http.StatusMovedPermanently},
+		},
+		RateLimit: &configuration.RateLimit{
+			Rate:     1,
+			Burst:    1,
+			Response: &configuration.DefaultResponse{Code: http.StatusServiceUnavailable, Body: "slow down\n"},
+		},
+	}
+
+	config.Domains["quiet.example.com"] = configuration.Domain{
+		RateLimit: &configuration.RateLimit{Rate: 1, Burst: 1},
+	}
+
+	handler := MakeHandler(config, metrics)
+	request := func(url string, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("", url, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	if rr := request("http://example.com/", "192.0.2.1:1234"); rr.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected first request to be redirected, but got code %d", rr.Code)
+	}
+	if rr := request("http://example.com/", "192.0.2.1:1235"); rr.Code != http.StatusServiceUnavailable || rr.Body.String() != "slow down\n" {
+		t.Errorf("Expected second request to get domain's over-limit response, but got code %d and body %q", rr.Code, rr.Body.String())
+	}
+	if rr := request("http://example.net/", "192.0.2.1:1236"); rr.Code != http.StatusTooManyRequests || rr.Result().Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected third request to get global over-limit response, but got code %d and Content-Type %q", rr.Code, rr.Result().Header.Get("Content-Type"))
+	}
+	if rr := request("http://example.com/", "192.0.2.2:1234"); rr.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected request from another client to be redirected, but got code %d", rr.Code)
+	}
+	request("http://quiet.example.com/", "192.0.2.3:1234")
+	if rr := request("http://quiet.example.com/", "192.0.2.3:1235"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected second request to a domain without rewrites to be rate limited, but got code %d", rr.Code)
+	}
+
+	expectCounterValue(t, metrics.RateLimitedRequests, prometheus.Labels{"limit": "example.com"}, 1)
+	expectCounterValue(t, metrics.RateLimitedRequests, prometheus.Labels{"limit": "global"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "rate_limited", "split_destination": "", "method": "GET", "code": "503"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "rate_limited", "split_destination": "", "method": "GET", "code": "429"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "quiet.example.com", "rule_index": "rate_limited", "split_destination": "", "method": "GET", "code": "429"}, 1)
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerRateLimitCloseConnection(t *testing.T) {
+	resetConfigAndMetrics()
+	config.RateLimit = &configuration.RateLimit{Rate: 1, Burst: 1, Response: &configuration.DefaultResponse{Code: 0}}
+
+	handler := MakeHandler(config, metrics)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("", "http://example.com/", nil)
+		rr := &hijackableResponse{httptest.NewRecorder(), false}
+		handler(rr, req)
+
+		if rr.wasClosed != (i == 1) {
+			t.Errorf("Expected connection for request %d to be closed only if over the limit, but got closed = %v", i, rr.wasClosed)
+		}
+	}
+
+	expectCounterValue(t, metrics.RateLimitedRequests, prometheus.Labels{"limit": "global"}, 1)
+
+	resetConfigAndMetrics()
+}
+
+func TestRateLimitersKeepStateAcrossReloads(t *testing.T) {
+	limiters := newRateLimiters()
+	first := &configuration.Config{RateLimit: &configuration.RateLimit{Rate: 1, Burst: 1}}
+	reloaded := &configuration.Config{RateLimit: &configuration.RateLimit{Rate: 1, Burst: 1}}
+	changed := &configuration.Config{RateLimit: &configuration.RateLimit{Rate: 1, Burst: 2}}
+
+	if limit, _ := limiters.check(first, "", "192.0.2.1:1234"); limit != nil {
+		t.Errorf("Expected first request to be allowed")
+	}
+	if limit, _ := limiters.check(reloaded, "", "192.0.2.1:1234"); limit == nil {
+		t.Errorf("Expected request after reload with the same limit to be refused")
+	}
+	if limit, _ := limiters.check(changed, "", "192.0.2.1:1234"); limit != nil {
+		t.Errorf("Expected request after the limit changed to be allowed")
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
+	"github.com/mjec/redirector/accesslog"
 	"github.com/mjec/redirector/configuration"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -16,22 +17,44 @@ type contextKey int
 const (
 	configFromContext contextKey = iota
 	metricsFromContext
+	rateLimitersFromContext
+	accessLogsFromContext
 )
 
 type Metrics struct {
-	InFlightRequests prometheus.Gauge
-	TotalRequests    *prometheus.CounterVec
-	HandlerDuration  *prometheus.HistogramVec
+	InFlightRequests    prometheus.Gauge
+	TotalRequests       *prometheus.CounterVec
+	HandlerDuration     *prometheus.HistogramVec
+	RateLimitedRequests *prometheus.CounterVec
+	BlockedRequests     *prometheus.CounterVec
 }
 
+// MakeHandler returns a handler which always serves requests using config.
 func MakeHandler(config *configuration.Config, metrics *Metrics) func(http.ResponseWriter, *http.Request) {
+	return makeHandler(func() *configuration.Config { return config }, metrics)
+}
+
+// MakeReloadableHandler returns a handler which serves each request using the config current in store at the time
+// the request arrives. Replacing the config in store does not affect requests which are already in flight.
+func MakeReloadableHandler(store *configuration.Store, metrics *Metrics) func(http.ResponseWriter, *http.Request) {
+	return makeHandler(store.Current, metrics)
+}
+
+func makeHandler(currentConfig func() *configuration.Config, metrics *Metrics) func(http.ResponseWriter, *http.Request) {
+	limiters := newRateLimiters()
+	logs := &accessLogs{}
 	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if !config.IsTrustedProxy(r.RemoteAddr) {
+			// Only trusted proxies can tell us the scheme the client used; anyone else could be lying about it
+			r.Header.Del("X-Forwarded-Proto")
+		}
 		ctx := context.WithValue(r.Context(), configFromContext, config)
 		ctx = context.WithValue(ctx, metricsFromContext, metrics)
+		ctx = context.WithValue(ctx, rateLimitersFromContext, limiters)
+		ctx = context.WithValue(ctx, accessLogsFromContext, logs)
 		req := r.WithContext(ctx)
-		if config.ClientIPHeader != "" && r.Header.Get(config.ClientIPHeader) != "" {
-			req.RemoteAddr = r.Header.Get(config.ClientIPHeader)
-		}
+		req.RemoteAddr = config.ClientAddr(r)
 		handler(w, req)
 	}
 }
@@ -62,64 +85,126 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 	defer func() { metrics.TotalRequests.With(metricLabels).Inc() }()
 
-	defaultResponse := config.DefaultResponse
-	defaultResponseSource := "default"
+	r, span := startSpan(r)
 	requestUri := r.URL.RequestURI()
-
-	for origin, domain := range config.Domains {
-		if strings.EqualFold(r.Host, origin) || (domain.MatchSubdomains && strings.HasSuffix(strings.ToLower(r.Host), "."+origin)) {
-			for index, rule := range domain.RewriteRules {
-				if !rule.Regexp.MatchString(requestUri) {
-					continue
-				}
-				destination := rule.Regexp.ReplaceAllString(requestUri, rule.Replacement)
-
-				setMetricsLabels(metricLabels, origin, index, r.Method, rule.Code)
-
-				if rule.LogHits {
-					slog.Default().Info(
-						"Redirect",
-						"remote_addr", r.RemoteAddr,
-						"method", r.Method,
-						"host", r.Host,
-						"request_uri", requestUri,
-						"user_agent", r.Header.Get("user-agent"),
-						"referer", r.Header.Get("referer"),
-						"rule_domain", origin,
-						"rule_index", index,
-						"regexp", rule.Regexp,
-						"code", rule.Code,
-						"destination", destination,
-					)
-				}
-				http.Redirect(w, r, destination, rule.Code)
-				return
+	resolution := config.Resolve(r)
+
+	// entry is logged to the access log once the response has been written, if logHit is set
+	start := time.Now()
+	recorder := &responseRecorder{ResponseWriter: w}
+	w = recorder
+	entry := &accesslog.Entry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		RequestURI: requestUri,
+		Protocol:   r.Proto,
+		UserAgent:  r.Header.Get("user-agent"),
+		Referer:    r.Header.Get("referer"),
+	}
+	defer endSpan(span, entry)
+
+	logHit := false
+	if logs, ok := r.Context().Value(accessLogsFromContext).(*accessLogs); ok {
+		defer func() {
+			if logHit {
+				entry.RemoteAddr = config.LogPrivacy.ClientAddr(entry.RemoteAddr)
+				entry.Referer = config.LogPrivacy.Referer(entry.Referer)
+				entry.Bytes = recorder.bytes
+				entry.Latency = time.Since(start)
+				logs.current(config.AccessLog).Log(entry)
 			}
+		}()
+	}
 
-			if domain.DefaultResponse != nil {
-				defaultResponse = domain.DefaultResponse
-				defaultResponseSource = origin
-			}
-			break
+	if denial := resolution.Blocked; denial != nil {
+		response := denial.Response
+		metrics.BlockedRequests.With(prometheus.Labels{"list": denial.List, "reason": denial.Reason}).Inc()
+		setMetricsLabels(metricLabels, resolution.DomainLabel(), resolution.RuleLabel(), "", r.Method, response.Code)
+
+		entry.Message, entry.Action, entry.Code = "Blocked", resolution.Action(), response.Code
+		entry.Domain, entry.Rule, entry.Labels = resolution.Domain, resolution.RuleLabel(), resolution.Labels()
+		entry.List, entry.Reason = denial.List, denial.Reason
+		logHit = response.LogHits
+		serveDefaultResponse(w, response)
+		return
+	}
+
+	if limiters, ok := r.Context().Value(rateLimitersFromContext).(*rateLimiters); ok {
+		if limit, limitLabel := limiters.check(config, resolution.Domain, r.RemoteAddr); limit != nil {
+			response := limit.OverLimitResponse()
+			metrics.RateLimitedRequests.With(prometheus.Labels{"limit": limitLabel}).Inc()
+			setMetricsLabels(metricLabels, domainLabel(resolution.Domain), response.Label("rate_limited"), "", r.Method, response.Code)
+
+			entry.Message, entry.Action, entry.Code = "Rate limited", "rate_limited", response.Code
+			entry.Domain, entry.Rule, entry.Labels = resolution.Domain, response.Label("rate_limited"), response.Labels
+			entry.Limit = limitLabel
+			logHit = response.LogHits
+			serveDefaultResponse(w, response)
+			return
 		}
 	}
 
-	setMetricsLabels(metricLabels, defaultResponseSource, -1, r.Method, defaultResponse.Code)
+	entry.Domain, entry.Rule, entry.Labels = resolution.Domain, resolution.RuleLabel(), resolution.Labels()
+	entry.Destination, entry.SplitDestination = resolution.Destination, resolution.SplitDestination
+
+	if redirectMapEntry := resolution.RedirectMapEntry; redirectMapEntry != nil {
+		setMetricsLabels(metricLabels, resolution.Domain, resolution.RuleLabel(), resolution.SplitDestination, r.Method, redirectMapEntry.Code)
+
+		entry.Message, entry.Action, entry.Code = "Redirect", configuration.ActionRedirect, redirectMapEntry.Code
+		entry.RedirectMapSource, entry.RedirectMapLine = resolution.RedirectMapSource, redirectMapEntry.Line
+		logHit = config.Domains[resolution.Domain].RedirectMapLogHits
+		http.Redirect(w, r, resolution.Destination, redirectMapEntry.Code)
+		return
+	}
+
+	if rule := resolution.Rule; rule != nil {
+		if rule.Regexp != nil {
+			entry.Regexp = rule.Regexp.String()
+		}
+		logHit = rule.LogHits
+
+		if rule.Action == configuration.ActionProxy {
+			code := serveProxy(w, r, resolution.Destination, rule.Proxy)
+			setMetricsLabels(metricLabels, resolution.Domain, resolution.RuleLabel(), resolution.SplitDestination, r.Method, code)
+			entry.Message, entry.Action, entry.Code = "Proxy", configuration.ActionProxy, code
+			return
+		}
 
-	if defaultResponse.LogHits {
-		slog.Default().Info(
-			"Default response",
-			"remote_addr", r.RemoteAddr,
+		setMetricsLabels(metricLabels, resolution.Domain, resolution.RuleLabel(), resolution.SplitDestination, r.Method, rule.Code)
+		entry.Message, entry.Action, entry.Code = "Redirect", configuration.ActionRedirect, rule.Code
+		http.Redirect(w, r, resolution.Destination, rule.Code)
+		return
+	}
+
+	if resolution.Error != nil {
+		slog.Default().Error(
+			"Error handling request; using default response",
+			"remote_addr", config.LogPrivacy.ClientAddr(r.RemoteAddr),
 			"method", r.Method,
 			"host", r.Host,
 			"request_uri", requestUri,
-			"user_agent", r.Header.Get("user-agent"),
-			"referer", r.Header.Get("referer"),
-			"code", defaultResponse.Code,
-			"source", defaultResponseSource,
+			"error", resolution.Error,
 		)
 	}
 
+	defaultResponse := resolution.DefaultResponse
+	setMetricsLabels(metricLabels, resolution.DomainLabel(), resolution.RuleLabel(), resolution.SplitDestination, r.Method, defaultResponse.Code)
+
+	entry.Message, entry.Action, entry.Code = "Default response", "default_response", defaultResponse.Code
+	entry.Source = resolution.DefaultResponseSource
+	logHit = defaultResponse.LogHits
+	serveDefaultResponse(w, defaultResponse)
+}
+
+// serveDefaultResponse writes defaultResponse, or closes the connection if its code is 0.
+func serveDefaultResponse(w http.ResponseWriter, defaultResponse *configuration.DefaultResponse) {
+	// Headers must be set before WriteHeader() is called, or they are not sent
+	for header, value := range defaultResponse.Headers {
+		w.Header().Add(header, value)
+	}
+
 	if defaultResponse.Code == 0 {
 		conn, _, err := http.NewResponseController(w).Hijack()
 		if err == nil && conn != nil {
@@ -132,19 +217,21 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(defaultResponse.Code)
 	}
 
-	for header, value := range defaultResponse.Headers {
-		w.Header().Add(header, value)
-	}
 	w.Write([]byte(defaultResponse.Body))
 }
 
-func setMetricsLabels(labels prometheus.Labels, domain string, rule_index int, method string, code int) {
-	labels["domain"] = domain
-	if rule_index < 0 {
-		labels["rule_index"] = "default"
-	} else {
-		labels["rule_index"] = strconv.FormatInt(int64(rule_index), 10)
+// domainLabel returns domain, or "default" if no domain matched, for use as the domain metric label.
+func domainLabel(domain string) string {
+	if domain == "" {
+		return "default"
 	}
+	return domain
+}
+
+func setMetricsLabels(labels prometheus.Labels, domain string, rule_index string, split_destination string, method string, code int) {
+	labels["domain"] = domain
+	labels["rule_index"] = rule_index
+	labels["split_destination"] = split_destination
 	labels["method"] = method
 	labels["code"] = strconv.FormatInt(int64(code), 10)
 }
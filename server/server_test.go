@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"log/slog"
 	"net"
 	"net/http"
@@ -19,9 +20,11 @@ import (
 
 var config *configuration.Config = &configuration.Config{}
 var metrics *Metrics = &Metrics{
-	InFlightRequests: prometheus.NewGauge(prometheus.GaugeOpts{Name: "in_flight_requests", Help: "A gauge of requests currently being served"}),
-	TotalRequests:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "A counter for requests"}, []string{"domain", "rule_index", "method", "code"}),
-	HandlerDuration:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "request_duration_seconds", Help: "A histogram of latencies for requests"}, []string{"domain", "rule_index", "method", "code"}),
+	InFlightRequests:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "in_flight_requests", Help: "A gauge of requests currently being served"}),
+	TotalRequests:       prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "A counter for requests"}, []string{"domain", "rule_index", "split_destination", "method", "code"}),
+	HandlerDuration:     prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "request_duration_seconds", Help: "A histogram of latencies for requests"}, []string{"domain", "rule_index", "split_destination", "method", "code"}),
+	RateLimitedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rate_limited_requests_total", Help: "A counter for requests refused by a rate limit"}, []string{"limit"}),
+	BlockedRequests:     prometheus.NewCounterVec(prometheus.CounterOpts{Name: "blocked_requests_total", Help: "A counter for requests refused by allow_cidrs or deny_cidrs"}, []string{"list", "reason"}),
 }
 
 func TestHandlerDefaultResponse421(t *testing.T) {
@@ -39,7 +42,7 @@ func TestHandlerDefaultResponse421(t *testing.T) {
 	if rr.Body.String() != expectedBody {
 		t.Errorf("Expected body '%s', but got '%s'", expectedBody, rr.Body.String())
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "421"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "421"}, 1)
 }
 
 func TestHandlerDefaultResponseNonHijackable(t *testing.T) {
@@ -56,7 +59,7 @@ func TestHandlerDefaultResponseNonHijackable(t *testing.T) {
 		t.Errorf("Expected status code %d, but got %d", 500, rr.Code)
 	}
 	// We expect this to record with code 0, because it's only not instantly closing the connection because rr is not Hijackable
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "0"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "0"}, 1)
 }
 
 func TestHandlerDefaultResponseCloseConnection(t *testing.T) {
@@ -75,7 +78,7 @@ func TestHandlerDefaultResponseCloseConnection(t *testing.T) {
 	if !rr.wasClosed {
 		t.Errorf("Expected hijacked connection to be closed: %v", rr)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "0"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "0"}, 1)
 }
 
 func TestHandlerSimpleMatching(t *testing.T) {
@@ -108,7 +111,7 @@ func TestHandlerSimpleMatching(t *testing.T) {
 	if rr.Code != http.StatusMovedPermanently {
 		t.Errorf("Expected status code %d, but got %d", http.StatusMovedPermanently, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "method": "GET", "code": "301"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "301"}, 1)
 }
 
 func TestHandlerDomainSpecificDefaultResponse(t *testing.T) {
@@ -139,7 +142,7 @@ func TestHandlerDomainSpecificDefaultResponse(t *testing.T) {
 		// Nothing matches, go to default response
 		t.Errorf("Expected status code %d, but got %d", http.StatusMisdirectedRequest, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "421"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "421"}, 1)
 
 	req = httptest.NewRequest("", "http://mjec.example.com/welcome", nil)
 	rr = httptest.NewRecorder()
@@ -150,7 +153,7 @@ func TestHandlerDomainSpecificDefaultResponse(t *testing.T) {
 		// Nothing matches, go to default response for this domain
 		t.Errorf("Expected status code %d, but got %d", http.StatusGone, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "mjec.example.com", "rule_index": "default", "method": "GET", "code": "410"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "mjec.example.com", "rule_index": "default", "split_destination": "", "method": "GET", "code": "410"}, 1)
 
 	req = httptest.NewRequest("", "http://mjec.example.com/only-this", nil)
 	rr = httptest.NewRecorder()
@@ -168,7 +171,7 @@ func TestHandlerDomainSpecificDefaultResponse(t *testing.T) {
 	} else {
 		t.Errorf("Expected Location header but none found: %v", err)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "mjec.example.com", "rule_index": "0", "method": "GET", "code": "301"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "mjec.example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "301"}, 1)
 }
 
 func TestHandlerMultipleRules(t *testing.T) {
@@ -206,7 +209,7 @@ func TestHandlerMultipleRules(t *testing.T) {
 	if rr.Code != http.StatusMovedPermanently {
 		t.Errorf("Expected status code %d, but got %d", http.StatusMovedPermanently, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "1", "method": "GET", "code": "301"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "1", "split_destination": "", "method": "GET", "code": "301"}, 1)
 
 	req = httptest.NewRequest("", "http://example.com/a/farewell", nil)
 	rr = httptest.NewRecorder()
@@ -223,7 +226,92 @@ func TestHandlerMultipleRules(t *testing.T) {
 	if rr.Code != http.StatusSeeOther {
 		t.Errorf("Expected status code %d, but got %d", http.StatusSeeOther, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "method": "GET", "code": "303"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "303"}, 1)
+}
+
+func TestHandlerRuleIDs(t *testing.T) {
+	resetConfigAndMetrics()
+	config.DefaultResponse.ID = "unknown-host"
+	config.DenyCIDRs = []string{"203.0.113.0/24"}
+	config.BlockedResponse = &configuration.DefaultResponse{Code: http.StatusForbidden, ID: "denied"}
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^/new"),
+					Replacement: "https://new.example.com/",
+					Code:        http.StatusFound,
+				},
+				{
+					Regexp:      regexp.MustCompile("(.*)"),
+					Replacement: "https://www.example.com$1",
+					Code:        http.StatusMovedPermanently,
+					ID:          "everything",
+				},
+			},
+		},
+	}
+
+	handler := MakeHandler(config, metrics)
+	for _, url := range []string{"http://example.com/welcome", "http://example.com/new", "http://example.org/"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("", url, nil))
+	}
+	req := httptest.NewRequest("", "http://example.com/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	handler(httptest.NewRecorder(), req)
+
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "everything", "split_destination": "", "method": "GET", "code": "301"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "302"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "unknown-host", "split_destination": "", "method": "GET", "code": "421"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "denied", "split_destination": "", "method": "GET", "code": "403"}, 1)
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerRedirectMap(t *testing.T) {
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RedirectMap: map[string]configuration.RedirectMapEntry{
+				"/old": {Destination: "https://new.example.com/new", Code: http.StatusFound},
+			},
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("(.*)"),
+					Replacement: "https://www.example.com$1",
+					Code:        http.StatusMovedPermanently,
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/old?utm_source=test", nil)
+	rr := httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if loc, err := rr.Result().Location(); err == nil {
+		if loc.String() != "https://new.example.com/new" {
+			t.Errorf("Expected URL %s, but got %s", "https://new.example.com/new", loc)
+		}
+	} else {
+		t.Errorf("Expected Location header but none found: %v", err)
+	}
+	if rr.Code != http.StatusFound {
+		t.Errorf("Expected status code %d, but got %d", http.StatusFound, rr.Code)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "redirect_map", "split_destination": "", "method": "GET", "code": "302"}, 1)
+
+	// Paths not in the map fall through to rewrites
+	req = httptest.NewRequest("", "http://example.com/older", nil)
+	rr = httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected status code %d, but got %d", http.StatusMovedPermanently, rr.Code)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "301"}, 1)
 }
 
 func TestHandlerSubdomainMatching(t *testing.T) {
@@ -257,7 +345,7 @@ func TestHandlerSubdomainMatching(t *testing.T) {
 		// We should not see a match on this domain
 		t.Errorf("Expected status code %d, but got %d", http.StatusMisdirectedRequest, rr.Code)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "421"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "421"}, 1)
 
 	config.Domains["example.com"] = configuration.Domain{
 		MatchSubdomains: true,
@@ -281,7 +369,7 @@ func TestHandlerSubdomainMatching(t *testing.T) {
 	} else {
 		t.Errorf("Expected Location header but none found: %v", err)
 	}
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "method": "GET", "code": "301"}, 1)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "301"}, 1)
 
 	req = httptest.NewRequest("", "http://www.not-example.com/welcome", nil)
 	rr = httptest.NewRecorder()
@@ -293,7 +381,7 @@ func TestHandlerSubdomainMatching(t *testing.T) {
 		t.Errorf("Expected status code %d, but got %d", http.StatusMisdirectedRequest, rr.Code)
 	}
 	// Second request that hits default, so counter should be at 2
-	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "method": "GET", "code": "421"}, 2)
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "421"}, 2)
 }
 
 func TestHandlerLogging(t *testing.T) {
@@ -463,6 +551,35 @@ func TestHandlerClientIPFromHeader(t *testing.T) {
 
 	config.DefaultResponse.LogHits = true
 	config.ClientIPHeader = IP_HEADER
+	config.TrustedProxies = []string{CONNECTION_REMOTE_ADDR}
+
+	req = httptest.NewRequest("", "http://example.com/welcome", nil)
+	req.RemoteAddr = CONNECTION_REMOTE_ADDR
+	req.Header.Set(IP_HEADER, REAL_IP)
+	rr = httptest.NewRecorder()
+
+	MakeHandler(config, metrics)(rr, req)
+
+	if loggerSpy.lineCounter != 1 {
+		t.Errorf("Expected one line logged, but got %d lines logged (%v)", loggerSpy.lineCounter, loggerSpy.lines)
+	}
+
+	loggerSpy.lines[0].Attrs(func(a slog.Attr) bool {
+		if a.Key == "remote_addr" {
+			if a.Value.String() != REAL_IP+":0" {
+				t.Errorf("Expected remote_addr to be %s:0 (header used), but got %s", REAL_IP, a.Value)
+			}
+			return true
+		}
+		return false
+	})
+
+	loggerSpy.reset()
+	resetConfigAndMetrics()
+
+	config.DefaultResponse.LogHits = true
+	config.ClientIPHeader = IP_HEADER
+	config.TrustedProxies = []string{"10.0.0.0/8"}
 
 	req = httptest.NewRequest("", "http://example.com/welcome", nil)
 	req.RemoteAddr = CONNECTION_REMOTE_ADDR
@@ -477,8 +594,8 @@ func TestHandlerClientIPFromHeader(t *testing.T) {
 
 	loggerSpy.lines[0].Attrs(func(a slog.Attr) bool {
 		if a.Key == "remote_addr" {
-			if a.Value.String() != REAL_IP {
-				t.Errorf("Expected remote_addr to be %s (header used), but got %s", REAL_IP, a.Value)
+			if a.Value.String() != CONNECTION_REMOTE_ADDR {
+				t.Errorf("Expected remote_addr to be %s (header ignored from untrusted peer), but got %s", CONNECTION_REMOTE_ADDR, a.Value)
 			}
 			return true
 		}
@@ -489,6 +606,173 @@ func TestHandlerClientIPFromHeader(t *testing.T) {
 	resetConfigAndMetrics()
 }
 
+func TestHandlerSchemeFromTrustedProxy(t *testing.T) {
+	resetConfigAndMetrics()
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp:      regexp.MustCompile("^(.*)$"),
+					Replacement: "https://secure.example.com$1",
+					Code:        http.StatusMovedPermanently,
+					Match:       &configuration.MatchConditions{Scheme: "https"},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{"10.0.0.1:1234", http.StatusMovedPermanently},
+		{"192.0.2.1:1234", http.StatusMisdirectedRequest},
+	} {
+		req := httptest.NewRequest("", "http://example.com/", nil)
+		req.RemoteAddr = testCase.remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rr := httptest.NewRecorder()
+
+		MakeHandler(config, metrics)(rr, req)
+
+		if rr.Code != testCase.expected {
+			t.Errorf("Expected status code %d for X-Forwarded-Proto from %s, but got %d", testCase.expected, testCase.remoteAddr, rr.Code)
+		}
+	}
+}
+
+func TestReloadableHandlerUsesCurrentConfig(t *testing.T) {
+	resetConfigAndMetrics()
+	store := configuration.NewStore("")
+	store.Replace(config)
+	handler := MakeReloadableHandler(store, metrics)
+
+	req := httptest.NewRequest("", "http://example.com/welcome", nil)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	if rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status code %d, but got %d", http.StatusMisdirectedRequest, rr.Code)
+	}
+
+	store.Replace(&configuration.Config{
+		DefaultResponse: config.DefaultResponse,
+		Domains: map[string]configuration.Domain{
+			"example.com": {
+				RewriteRules: []configuration.Rule{
+					{
+						Regexp:      regexp.MustCompile("(.*)"),
+						Replacement: "https://www.example.com$1",
+						Code:        http.StatusMovedPermanently,
+					},
+				},
+			},
+		},
+	})
+
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+
+	if rr.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected status code %d after config was replaced, but got %d", http.StatusMovedPermanently, rr.Code)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": "", "method": "GET", "code": "301"}, 1)
+}
+
+func TestHandlerTemplate(t *testing.T) {
+	previousLogger := slog.Default()
+	defer slog.SetDefault(previousLogger)
+	loggerSpy := &logSpy{}
+	slog.SetDefault(slog.New(loggerSpy))
+
+	resetConfigAndMetrics()
+
+	rule := configuration.Rule{}
+	if err := json.Unmarshal([]byte(`{"regexp": "^/go", "template": "{{.Query.Get \"to\"}}", "code": 302}`), &rule); err != nil {
+		t.Fatalf("Unable to unmarshal rule: %v", err)
+	}
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {RewriteRules: []configuration.Rule{rule}},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/go?to=https%3A%2F%2Fexample.org%2F", nil)
+	rr := httptest.NewRecorder()
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://example.org/" {
+		t.Errorf("Expected 302 redirect to https://example.org/, but got %d redirect to '%s'", rr.Code, rr.Header().Get("Location"))
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/go?to=%2Fsomewhere", nil)
+	rr = httptest.NewRecorder()
+	MakeHandler(config, metrics)(rr, req)
+
+	if rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected default response code %d after template error, but got %d", http.StatusMisdirectedRequest, rr.Code)
+	}
+	if loggerSpy.lineCounter != 1 || loggerSpy.lines[0].Level != slog.LevelError {
+		t.Errorf("Expected 1 error logged, but got %d lines logged (%v)", loggerSpy.lineCounter, loggerSpy.lines)
+	}
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "default", "rule_index": "default", "split_destination": "", "method": "GET", "code": "421"}, 1)
+}
+
+func TestHandlerWeightedDestinations(t *testing.T) {
+	previousLogger := slog.Default()
+	defer slog.SetDefault(previousLogger)
+	loggerSpy := &logSpy{}
+	slog.SetDefault(slog.New(loggerSpy))
+
+	resetConfigAndMetrics()
+	config.Domains = map[string]configuration.Domain{
+		"example.com": {
+			RewriteRules: []configuration.Rule{
+				{
+					Regexp: regexp.MustCompile("^(.*)$"),
+					Code:   http.StatusFound,
+					Destinations: []configuration.WeightedDestination{
+						{Name: "old", Replacement: "https://old.example.com$1", Weight: 1},
+						{Name: "new", Replacement: "https://new.example.com$1", Weight: 1},
+					},
+					Sticky:  configuration.StickyClientIP,
+					LogHits: true,
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	rr := httptest.NewRecorder()
+	MakeHandler(config, metrics)(rr, req)
+
+	location := rr.Header().Get("Location")
+	split := ""
+	switch location {
+	case "https://old.example.com/page":
+		split = "old"
+	case "https://new.example.com/page":
+		split = "new"
+	default:
+		t.Fatalf("Expected redirect to one of the destinations, but got '%s'", location)
+	}
+
+	expectCounterValue(t, metrics.TotalRequests, prometheus.Labels{"domain": "example.com", "rule_index": "0", "split_destination": split, "method": "GET", "code": "302"}, 1)
+
+	if loggerSpy.lineCounter != 1 {
+		t.Fatalf("Expected 1 line logged, but got %d lines logged (%v)", loggerSpy.lineCounter, loggerSpy.lines)
+	}
+	logged := ""
+	loggerSpy.lines[0].Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "split_destination" {
+			logged = attr.Value.String()
+		}
+		return true
+	})
+	if logged != split {
+		t.Errorf("Expected split_destination '%s' to be logged, but got '%s'", split, logged)
+	}
+}
+
 func TestHandlerPanicsWithoutConfig(t *testing.T) {
 	defer func() {
 		if recover() == nil {
@@ -517,6 +801,8 @@ func resetConfigAndMetrics() {
 	metrics.InFlightRequests.Set(0)
 	metrics.TotalRequests.Reset()
 	metrics.HandlerDuration.Reset()
+	metrics.RateLimitedRequests.Reset()
+	metrics.BlockedRequests.Reset()
 }
 
 type hijackableResponse struct {
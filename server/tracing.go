@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/mjec/redirector/accesslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans created by this package. The tracer is looked up from the global TracerProvider for
+// each request, so that tracing is only done if main (or a test) has set one up.
+const tracerName = "github.com/mjec/redirector/server"
+
+// startSpan starts a server span for r, continuing any trace given in its traceparent header, and returns r with the
+// span in its context.
+func startSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(
+		ctx,
+		r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.ServerAddress(r.Host),
+			semconv.URLPath(r.URL.Path),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endSpan records how the request was handled, as described by entry, and ends span.
+func endSpan(span trace.Span, entry *accesslog.Entry) {
+	span.SetAttributes(
+		semconv.HTTPResponseStatusCode(entry.Code),
+		attribute.String("redirector.action", entry.Action),
+		attribute.String("redirector.domain", entry.Domain),
+		attribute.String("redirector.rule", entry.Rule),
+	)
+	if entry.Destination != "" {
+		span.SetAttributes(attribute.String("redirector.destination", entry.Destination))
+	}
+	if entry.SplitDestination != "" {
+		span.SetAttributes(attribute.String("redirector.split_destination", entry.SplitDestination))
+	}
+	for name, value := range entry.Labels {
+		span.SetAttributes(attribute.String("redirector.label."+name, value))
+	}
+	if entry.Code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(entry.Code))
+	}
+	span.End()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/mjec/redirector/configuration"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	incomingTraceID    = "4bf92f3577b34da6a3ce929d0e0e4736"
+	incomingParentSpan = "00f067aa0ba902b7"
+)
+
+// useInMemoryTracing makes spans available from the returned exporter until the test finishes.
+func useInMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exporter
+}
+
+func TestHandlerTracing(t *testing.T) {
+	exporter := useInMemoryTracing(t)
+
+	resetConfigAndMetrics()
+	config.Domains["example.com"] = configuration.Domain{
+		RewriteRules: []configuration.Rule{
+			{Regexp: regexp.MustCompile("^/old(.*)$"), Replacement: "https://example.net/new$1", Code: http.StatusMovedPermanently},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/old/page?secret=1", nil)
+	req.Header.Set("Traceparent", "00-"+incomingTraceID+"-"+incomingParentSpan+"-01")
+	MakeHandler(config, metrics)(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, but got %d spans: %v", len(spans), spans)
+	}
+	span := spans[0]
+
+	if span.SpanKind != trace.SpanKindServer || span.Name != "GET" {
+		t.Errorf("Expected server span named GET, but got %s span named %s", span.SpanKind, span.Name)
+	}
+	if traceID := span.SpanContext.TraceID().String(); traceID != incomingTraceID {
+		t.Errorf("Expected span to continue incoming trace %s, but got trace %s", incomingTraceID, traceID)
+	}
+	if parent := span.Parent.SpanID().String(); parent != incomingParentSpan {
+		t.Errorf("Expected span's parent to be incoming span %s, but got %s", incomingParentSpan, parent)
+	}
+
+	expectSpanAttributes(t, span, map[attribute.Key]attribute.Value{
+		"http.request.method":          attribute.StringValue("GET"),
+		"server.address":               attribute.StringValue("example.com"),
+		"url.path":                     attribute.StringValue("/old/page"),
+		"http.response.status_code":    attribute.IntValue(http.StatusMovedPermanently),
+		"redirector.action":            attribute.StringValue("redirect"),
+		"redirector.domain":            attribute.StringValue("example.com"),
+		"redirector.rule":              attribute.StringValue("0"),
+		"redirector.destination":       attribute.StringValue("https://example.net/new/page?secret=1"),
+		"redirector.split_destination": {},
+	})
+
+	resetConfigAndMetrics()
+}
+
+func TestHandlerTracingProxy(t *testing.T) {
+	exporter := useInMemoryTracing(t)
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	resetConfigAndMetrics()
+	config.Domains["example.com"] = configuration.Domain{
+		RewriteRules: []configuration.Rule{
+			{Regexp: regexp.MustCompile("^(.*)$"), Replacement: upstream.URL + "$1", Action: configuration.ActionProxy},
+		},
+	}
+
+	req := httptest.NewRequest("", "http://example.com/status", nil)
+	req.Header.Set("Traceparent", "00-"+incomingTraceID+"-"+incomingParentSpan+"-01")
+	MakeHandler(config, metrics)(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, but got %d spans: %v", len(spans), spans)
+	}
+	// Spans are exported as they end, so the proxy span comes first
+	proxySpan, serverSpan := spans[0], spans[1]
+
+	if proxySpan.SpanKind != trace.SpanKindClient {
+		t.Errorf("Expected proxy span to be a client span, but got %s", proxySpan.SpanKind)
+	}
+	if proxySpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("Expected proxy span to be a child of the server span %s, but got parent %s", serverSpan.SpanContext.SpanID(), proxySpan.Parent.SpanID())
+	}
+	if expected := "00-" + incomingTraceID + "-" + proxySpan.SpanContext.SpanID().String() + "-01"; upstreamTraceparent != expected {
+		t.Errorf("Expected upstream to receive traceparent %s, but got %s", expected, upstreamTraceparent)
+	}
+
+	expectSpanAttributes(t, proxySpan, map[attribute.Key]attribute.Value{
+		"url.full":                  attribute.StringValue(upstream.URL + "/status"),
+		"http.response.status_code": attribute.IntValue(http.StatusServiceUnavailable),
+	})
+	expectSpanAttributes(t, serverSpan, map[attribute.Key]attribute.Value{
+		"redirector.action":         attribute.StringValue("proxy"),
+		"http.response.status_code": attribute.IntValue(http.StatusServiceUnavailable),
+	})
+	if proxySpan.Status.Code != codes.Error || serverSpan.Status.Code != codes.Error {
+		t.Errorf("Expected both spans to have error status for a 503, but got %s and %s", proxySpan.Status.Code, serverSpan.Status.Code)
+	}
+
+	resetConfigAndMetrics()
+}
+
+// expectSpanAttributes checks that span has each of expected. An empty Value means the attribute must not be set.
+func expectSpanAttributes(t *testing.T, span tracetest.SpanStub, expected map[attribute.Key]attribute.Value) {
+	t.Helper()
+	actual := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes {
+		actual[attr.Key] = attr.Value
+	}
+
+	for key, value := range expected {
+		got, ok := actual[key]
+		if value.Type() == attribute.INVALID {
+			if ok {
+				t.Errorf("Expected span %s not to have attribute %s, but got %s", span.Name, key, got.Emit())
+			}
+			continue
+		}
+		if !ok || got != value {
+			t.Errorf("Expected span %s to have attribute %s=%s, but got %s", span.Name, key, value.Emit(), got.Emit())
+		}
+	}
+}
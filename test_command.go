@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+// headerFlags collects repeated --header flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if name, _, found := strings.Cut(value, ":"); !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be in the form 'Name: value'")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// runTest implements `redirector test`, which shows how the config would respond to each URL in args without
+// listening for connections. It returns the exit status.
+func runTest(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: redirector test [options] URL...\n\nShows how each URL would be handled by the config.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+
+	configFilePath := os.Getenv("REDIRECTOR_CONFIG")
+	if configFilePath == "" {
+		configFilePath = "config.json"
+	}
+	flags.StringVar(&configFilePath, "config", configFilePath, "path to the config file (defaults to $REDIRECTOR_CONFIG or config.json)")
+	method := flags.String("method", http.MethodGet, "request method")
+	at := flags.String("at", "", "evaluate the config as at this RFC 3339 time, instead of now")
+	remoteAddr := flags.String("remote-addr", "", "the client's address, e.g. 192.0.2.1, to check against allow_cidrs and deny_cidrs")
+	headers := headerFlags{}
+	flags.Var(&headers, "header", "request header in the form 'Name: value' (may be repeated)")
+
+	// Allow flags to come after URLs, which the flag package does not do by itself
+	urls := []string{}
+	remaining := args
+	for {
+		if err := flags.Parse(remaining); err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		urls = append(urls, flags.Arg(0))
+		remaining = flags.Args()[1:]
+	}
+
+	if len(urls) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	store := configuration.NewStore(configFilePath)
+	if problems := store.Reload(); len(problems) > 0 {
+		fmt.Fprintf(stderr, "Errors in configuration file %s:\n", configFilePath)
+		for _, problem := range problems {
+			fmt.Fprintf(stderr, "  %s\n", problem)
+		}
+		return 1
+	}
+	config := store.Current()
+	for _, warning := range config.Warnings {
+		fmt.Fprintf(stderr, "Warning: %s\n", warning)
+	}
+
+	if *at != "" {
+		now, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid time for -at: %v\n", err)
+			return 2
+		}
+		config.Clock = func() time.Time { return now }
+	}
+
+	status := 0
+	for index, url := range urls {
+		if index > 0 {
+			fmt.Fprintln(stdout)
+		}
+
+		req, err := http.NewRequest(*method, url, nil)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid URL %s: %v\n", url, err)
+			status = 1
+			continue
+		}
+		for _, header := range headers {
+			name, value, _ := strings.Cut(header, ":")
+			req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		req.RemoteAddr = *remoteAddr
+
+		printResolution(stdout, req, config.Resolve(req))
+	}
+	return status
+}
+
+func printResolution(w io.Writer, req *http.Request, resolution configuration.Resolution) {
+	fmt.Fprintf(w, "%s %s\n", req.Method, req.URL)
+	if resolution.Domain != "" {
+		fmt.Fprintf(w, "  domain:      %s\n", resolution.Domain)
+	} else {
+		fmt.Fprintf(w, "  domain:      (none)\n")
+	}
+
+	switch {
+	case resolution.Blocked != nil:
+		fmt.Fprintf(w, "  matched:     blocked_response from %s (client refused by %s)\n", resolution.Blocked.List, resolution.Blocked.Reason)
+	case resolution.RedirectMapEntry != nil:
+		fmt.Fprintf(w, "  matched:     redirect_map %s (line %d)\n", resolution.RedirectMapSource, resolution.RedirectMapEntry.Line)
+	case resolution.Rule != nil && resolution.Rule.ID != "":
+		fmt.Fprintf(w, "  matched:     rule %s at index %d (regexp %s)\n", resolution.Rule.ID, resolution.RuleIndex, resolution.Rule.Regexp)
+	case resolution.Rule != nil:
+		fmt.Fprintf(w, "  matched:     rule %d (regexp %s)\n", resolution.RuleIndex, resolution.Rule.Regexp)
+	case resolution.DefaultResponse != nil && resolution.DefaultResponse.ID != "":
+		fmt.Fprintf(w, "  matched:     default_response %s from %s\n", resolution.DefaultResponse.ID, resolution.DefaultResponseSource)
+	default:
+		fmt.Fprintf(w, "  matched:     default_response from %s\n", resolution.DefaultResponseSource)
+	}
+	if labels := resolution.Labels(); len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for index, name := range names {
+			names[index] = name + "=" + labels[name]
+		}
+		fmt.Fprintf(w, "  labels:      %s\n", strings.Join(names, ", "))
+	}
+
+	if resolution.Error != nil {
+		fmt.Fprintf(w, "  error:       %v\n", resolution.Error)
+	}
+	fmt.Fprintf(w, "  action:      %s\n", resolution.Action())
+	if resolution.Destination != "" {
+		fmt.Fprintf(w, "  destination: %s\n", resolution.Destination)
+	}
+	if resolution.SplitDestination != "" {
+		fmt.Fprintf(w, "  split:       %s\n", resolution.SplitDestination)
+	}
+
+	switch {
+	case resolution.Action() == configuration.ActionProxy:
+		fmt.Fprintf(w, "  code:        (from upstream)\n")
+	case resolution.Code == 0:
+		fmt.Fprintf(w, "  code:        0 (connection closed)\n")
+	default:
+		fmt.Fprintf(w, "  code:        %d\n", resolution.Code)
+	}
+}
@@ -0,0 +1,78 @@
+// Package tracing exports OpenTelemetry traces over OTLP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+const defaultServiceName = "redirector"
+
+// NewProvider returns a TracerProvider which samples and exports spans according to options. The provider should be
+// shut down before exiting, so that spans which have not yet been exported are not lost.
+func NewProvider(ctx context.Context, options *configuration.Tracing) (*sdktrace.TracerProvider, error) {
+	exporter, err := newExporter(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := options.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	ratio := 1.0
+	if options.SampleRatio != nil {
+		ratio = *options.SampleRatio
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	), nil
+}
+
+func newExporter(ctx context.Context, options *configuration.Tracing) (*otlptrace.Exporter, error) {
+	switch options.Protocol {
+	case "", configuration.TracingProtocolHTTP:
+		clientOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(options.Endpoint)}
+		if options.Insecure {
+			clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+		}
+		if options.URLPath != "" {
+			clientOptions = append(clientOptions, otlptracehttp.WithURLPath(options.URLPath))
+		}
+		if len(options.Headers) > 0 {
+			clientOptions = append(clientOptions, otlptracehttp.WithHeaders(options.Headers))
+		}
+		if options.Timeout > 0 {
+			clientOptions = append(clientOptions, otlptracehttp.WithTimeout(time.Duration(options.Timeout)))
+		}
+		return otlptracehttp.New(ctx, clientOptions...)
+	case configuration.TracingProtocolGRPC:
+		clientOptions := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(options.Endpoint)}
+		if options.Insecure {
+			clientOptions = append(clientOptions, otlptracegrpc.WithInsecure())
+		}
+		if len(options.Headers) > 0 {
+			clientOptions = append(clientOptions, otlptracegrpc.WithHeaders(options.Headers))
+		}
+		if options.Timeout > 0 {
+			clientOptions = append(clientOptions, otlptracegrpc.WithTimeout(time.Duration(options.Timeout)))
+		}
+		return otlptracegrpc.New(ctx, clientOptions...)
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", options.Protocol)
+	}
+}
@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mjec/redirector/configuration"
+)
+
+func TestNewProviderExportsOverHTTP(t *testing.T) {
+	var path, authorization string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization = r.URL.Path, r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	provider, err := NewProvider(context.Background(), &configuration.Tracing{
+		Endpoint: strings.TrimPrefix(collector.URL, "http://"),
+		Insecure: true,
+		URLPath:  "/custom/traces",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error creating provider, but got %v", err)
+	}
+
+	_, span := provider.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected no error shutting down provider, but got %v", err)
+	}
+
+	if path != "/custom/traces" || authorization != "Bearer token" {
+		t.Errorf("Expected span to be exported to /custom/traces with configured headers, but got path '%s' and Authorization '%s'", path, authorization)
+	}
+}
+
+func TestNewProviderSampleRatio(t *testing.T) {
+	ratio := 0.0
+	provider, err := NewProvider(context.Background(), &configuration.Tracing{Endpoint: "localhost:4317", Protocol: configuration.TracingProtocolGRPC, Insecure: true, SampleRatio: &ratio})
+	if err != nil {
+		t.Fatalf("Expected no error creating provider, but got %v", err)
+	}
+	defer provider.Shutdown(context.Background())
+
+	_, span := provider.Tracer("test").Start(context.Background(), "span")
+	if span.SpanContext().IsSampled() {
+		t.Errorf("Expected span not to be sampled with sample_ratio 0")
+	}
+	span.End()
+}